@@ -0,0 +1,551 @@
+package main
+
+import (
+	"MiniDocker/cgroup/subsystems"
+	"MiniDocker/container"
+	"MiniDocker/image"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// buildCacheRepository 构建时每一步的结果都登记为这个仓库下的中间镜像，标签是这一步的缓存键
+// 下次构建时同样的步骤直接使用中间镜像，images 命令默认不显示它们，可以通过 images -a 查看、builder prune 删除
+const buildCacheRepository = "minidocker-build-cache"
+
+// buildOptions build 命令的选项
+type buildOptions struct {
+	Tag        string // 构建出的镜像名
+	Dockerfile string // Dockerfile 的路径，为空时使用构建上下文中的 Dockerfile
+	Context    string // 构建上下文目录，COPY 的源路径相对于它
+	NoCache    bool   // 不使用缓存，所有步骤都重新执行
+}
+
+// instruction Dockerfile 中的一条指令
+type instruction struct {
+	Line     int    // 指令在 Dockerfile 中的起始行号
+	Command  string // 大写的指令名，例如 RUN
+	Args     string // 指令的参数
+	Original string // 合并续行之后的原始指令，用于日志和镜像历史
+}
+
+// buildState 构建过程中的当前状态，每执行一步都会登记为一个中间镜像
+type buildState struct {
+	Key    string            // 当前状态的缓存键，由基础镜像和之前的所有指令计算得到
+	Image  *image.Image      // 当前状态对应的中间镜像
+	Config *image.ConfigFile // 当前状态的镜像 config
+}
+
+// buildImage 按 Dockerfile 构建镜像，支持 FROM、RUN、COPY、ENV、WORKDIR、CMD 和 ENTRYPOINT
+// RUN 在基于上一步结果的容器中执行，执行后容器的修改保存为新的一层；COPY 把构建上下文中的文件打包为新的一层
+func buildImage(opts buildOptions) error {
+	// 构建可能耗时很长，先检查镜像名，避免构建完才发现不能登记
+	if ref, err := image.ParseReference(opts.Tag); err != nil {
+		return err
+	} else if ref.Digest != "" {
+		return fmt.Errorf("镜像名 %s 不能带摘要", opts.Tag)
+	}
+	contextDir, err := filepath.Abs(opts.Context)
+	if err != nil {
+		return err
+	}
+	if stat, err := os.Stat(contextDir); err != nil || !stat.IsDir() {
+		return fmt.Errorf("构建上下文 %s 不是目录", opts.Context)
+	}
+	dockerfile := opts.Dockerfile
+	if dockerfile == "" {
+		dockerfile = filepath.Join(contextDir, "Dockerfile")
+	}
+	f, err := os.Open(dockerfile)
+	if err != nil {
+		return fmt.Errorf("打开 Dockerfile 失败: %v", err)
+	}
+	instructions, err := parseDockerfile(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("解析 %s 失败: %v", dockerfile, err)
+	}
+
+	var state *buildState
+	for i, inst := range instructions {
+		logrus.Infof("Step %d/%d : %s", i+1, len(instructions), inst.Original)
+		if inst.Command == "FROM" {
+			state, err = buildFrom(inst.Args)
+		} else {
+			state, err = buildStep(state, inst, contextDir, opts.NoCache)
+		}
+		if err != nil {
+			return fmt.Errorf("第 %d 行 %s 执行失败: %v", inst.Line, inst.Command, err)
+		}
+		logrus.Infof(" ---> %s", state.Image.ShortID())
+	}
+	img, err := image.Tag(state.Image.Reference(), opts.Tag)
+	if err != nil {
+		return fmt.Errorf("登记镜像 %s 失败: %v", opts.Tag, err)
+	}
+	logrus.Infof("镜像 %s 构建成功，ID: %s", img.Reference(), img.ShortID())
+	return nil
+}
+
+// parseDockerfile 解析 Dockerfile，行尾的 \ 表示续行，# 开头的行是注释，指令名不区分大小写
+// 第一条指令必须是 FROM，不支持多阶段构建
+func parseDockerfile(r io.Reader) ([]instruction, error) {
+	var instructions []instruction
+	var current []string
+	start := 0
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if len(current) == 0 {
+			start = lineNum
+		}
+		if strings.HasSuffix(line, "\\") {
+			current = append(current, strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+			continue
+		}
+		current = append(current, line)
+		inst, err := parseInstruction(start, strings.Join(current, " "))
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, inst)
+		current = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		return nil, fmt.Errorf("第 %d 行: 续行没有结束", start)
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("没有任何指令")
+	}
+	for i, inst := range instructions {
+		if (i == 0) != (inst.Command == "FROM") {
+			if i == 0 {
+				return nil, fmt.Errorf("第 %d 行: 第一条指令必须是 FROM", inst.Line)
+			}
+			return nil, fmt.Errorf("第 %d 行: 不支持多阶段构建", inst.Line)
+		}
+	}
+	return instructions, nil
+}
+
+// parseInstruction 解析一条合并续行之后的指令
+func parseInstruction(line int, text string) (instruction, error) {
+	command, args, _ := strings.Cut(text, " ")
+	inst := instruction{
+		Line:     line,
+		Command:  strings.ToUpper(command),
+		Args:     strings.TrimSpace(args),
+		Original: strings.ToUpper(command) + " " + strings.TrimSpace(args),
+	}
+	switch inst.Command {
+	case "FROM", "RUN", "COPY", "ENV", "WORKDIR", "CMD", "ENTRYPOINT":
+	default:
+		return instruction{}, fmt.Errorf("第 %d 行: 不支持的指令 %s，只支持 FROM、RUN、COPY、ENV、WORKDIR、CMD 和 ENTRYPOINT", line, command)
+	}
+	if inst.Args == "" {
+		return instruction{}, fmt.Errorf("第 %d 行: %s 缺少参数", line, inst.Command)
+	}
+	if inst.Command == "FROM" && len(strings.Fields(inst.Args)) != 1 {
+		return instruction{}, fmt.Errorf("第 %d 行: FROM 只能指定一个镜像", line)
+	}
+	return inst, nil
+}
+
+// buildFrom 执行 FROM 指令，scratch 表示从空镜像开始构建
+// 基础镜像也登记为一个中间镜像，之后的 RUN 可以直接基于它启动容器
+func buildFrom(ref string) (*buildState, error) {
+	var layers []string
+	var size int64
+	var parentID string
+	config := &image.ConfigFile{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+	key := cacheKey("", "FROM scratch")
+	if ref != "scratch" {
+		base, err := image.Get(ref)
+		if err != nil {
+			return nil, fmt.Errorf("获取基础镜像 %s 失败: %v", ref, err)
+		}
+		if layers, err = parentLayers(base); err != nil {
+			return nil, err
+		}
+		if config, err = base.Config(); err != nil {
+			return nil, fmt.Errorf("读取镜像 %s 的 config 失败: %v", ref, err)
+		}
+		size, parentID = base.Size, base.ID
+		key = cacheKey("", "FROM "+base.ID)
+	}
+	config.RootFS = image.RootFS{Type: "layers", DiffIDs: layers}
+	if img, err := cachedImage(key); err == nil {
+		return &buildState{Key: key, Image: img, Config: config}, nil
+	}
+	return commitBuildState(key, config, size, parentID)
+}
+
+// buildStep 执行 FROM 之外的一条指令，得到新的构建状态
+// 没有禁用缓存并且同样的步骤已经执行过时直接使用上次的结果
+func buildStep(state *buildState, inst instruction, contextDir string, noCache bool) (*buildState, error) {
+	// COPY 的结果取决于文件内容，先打包再用镜像层的 diff_id 计算缓存键
+	var copyLayer string
+	var copySize int64
+	key := cacheKey(state.Key, inst.Original)
+	if inst.Command == "COPY" {
+		var err error
+		if copyLayer, copySize, err = createCopyLayer(contextDir, inst.Args, state.Config.Config.WorkingDir); err != nil {
+			return nil, err
+		}
+		key = cacheKey(state.Key, inst.Original+" "+copyLayer)
+	}
+	if !noCache {
+		if img, err := cachedImage(key); err == nil {
+			config, err := img.Config()
+			if err == nil {
+				logrus.Infof(" ---> 使用缓存")
+				return &buildState{Key: key, Image: img, Config: config}, nil
+			}
+		}
+	}
+
+	config := *state.Config
+	config.Config.Env = append([]string{}, config.Config.Env...)
+	size := state.Image.Size
+	newLayer := ""
+	switch inst.Command {
+	case "RUN":
+		cmd, err := parseCommandArgs(inst.Args)
+		if err != nil {
+			return nil, err
+		}
+		diffID, layerSize, err := runBuildCommand(state, cmd)
+		if err != nil {
+			return nil, err
+		}
+		newLayer, size = diffID, size+layerSize
+	case "COPY":
+		newLayer, size = copyLayer, size+copySize
+	case "WORKDIR":
+		// 相对路径相对于之前的工作目录
+		dir := inst.Args
+		if !path.IsAbs(dir) {
+			dir = path.Join("/", config.Config.WorkingDir, dir)
+		}
+		if err := applyConfigChange(&config.Config, "WORKDIR "+dir); err != nil {
+			return nil, err
+		}
+	default:
+		if err := applyConfigChange(&config.Config, inst.Original); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	config.Created = now
+	config.History = append(append([]image.History{}, config.History...), image.History{
+		Created:    now,
+		CreatedBy:  inst.Original,
+		EmptyLayer: newLayer == "",
+	})
+	layers := append([]string{}, config.RootFS.DiffIDs...)
+	if newLayer != "" {
+		layers = append(layers, newLayer)
+	}
+	config.RootFS = image.RootFS{Type: "layers", DiffIDs: layers}
+	return commitBuildState(key, &config, size, state.Image.ID)
+}
+
+// cacheKey 根据上一步的缓存键和当前指令计算这一步的缓存键
+func cacheKey(parent string, instruction string) string {
+	sum := sha256.Sum256([]byte(parent + "\n" + instruction))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedImage 查找缓存键对应的中间镜像，镜像层已经被删除的中间镜像不能使用
+func cachedImage(key string) (*image.Image, error) {
+	img, err := image.Get(buildCacheRepository + ":" + key)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range img.Layers {
+		if !image.LayerExists(layer) {
+			return nil, fmt.Errorf("镜像层 %s 不存在", layer)
+		}
+	}
+	return img, nil
+}
+
+// commitBuildState 把构建状态登记为中间镜像
+func commitBuildState(key string, config *image.ConfigFile, size int64, parentID string) (*buildState, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	img, err := image.RegisterConfig([]string{buildCacheRepository + ":" + key}, content, config.RootFS.DiffIDs, size, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("登记中间镜像失败: %v", err)
+	}
+	return &buildState{Key: key, Image: img, Config: config}, nil
+}
+
+// pruneBuildCache 删除 build 缓存的所有中间镜像
+// 中间镜像与构建出的镜像共用镜像层，image.Remove 只删除不再被其他镜像使用的层
+func pruneBuildCache() error {
+	images, err := image.List()
+	if err != nil {
+		return fmt.Errorf("读取镜像索引失败: %v", err)
+	}
+	removed := 0
+	for _, img := range images {
+		if img.Name != buildCacheRepository {
+			continue
+		}
+		if _, err := image.Remove(img.Reference(), checkImageInUse); err != nil {
+			return fmt.Errorf("删除中间镜像 %s 失败: %v", img.Reference(), err)
+		}
+		removed++
+	}
+	logrus.Infof("已删除 %d 个 build 缓存的中间镜像", removed)
+	return nil
+}
+
+// runBuildCommand 基于构建状态对应的中间镜像启动一个临时容器执行 RUN 的命令，
+// 命令成功退出后把容器的修改打包为新的一层，返回它的 diff_id 和大小。临时容器用完即删
+// 与 docker build 一致，命令不分配终端，标准输入为 /dev/null，标准输出和标准错误写入容器日志，边执行边输出到当前的标准输出
+func runBuildCommand(state *buildState, cmd []string) (string, int64, error) {
+	if len(state.Image.Layers) == 0 {
+		return "", 0, fmt.Errorf("镜像中没有任何文件，无法执行命令")
+	}
+	cfg := &runConfig{
+		Tty:          false,
+		CommandArray: cmd,
+		Resource:     &subsystems.ResourceConfig{},
+		ContainerID:  randStringBytes(10),
+		ImageName:    state.Image.Reference(),
+		// RUN 的命令不经过镜像的 Entrypoint
+		Entrypoint: []string{},
+	}
+	cfg.ContainerName = "build-" + cfg.ContainerID
+	if err := applyImageConfig(cfg, &state.Config.Config); err != nil {
+		return "", 0, err
+	}
+	parent, cgroupManager, err := startContainer(cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	defer deleteContainerInfo(cfg.ContainerName)
+	defer container.DeleteWorkSpace(cfg.Volume, cfg.ContainerName)
+
+	logPath := fmt.Sprintf(container.DefaultInfoLocation, cfg.ContainerName) + container.ContainerLogFile
+	exited := make(chan struct{})
+	followed := make(chan struct{})
+	go func() {
+		defer close(followed)
+		if err := followLog(logPath, os.Stdout, exited); err != nil {
+			logrus.Warnf("输出命令的日志失败: %v", err)
+		}
+	}()
+	parent.Wait()
+	close(exited)
+	<-followed
+	recordContainerExit(cfg.ContainerName, parent.ProcessState, cgroupManager)
+	cgroupManager.Destroy()
+	if code := exitCodeFromState(parent.ProcessState); code != 0 {
+		return "", 0, fmt.Errorf("命令 %s 的退出码为 %d", strings.Join(cmd, " "), code)
+	}
+	return createDiffLayer(cfg.ContainerName, nil)
+}
+
+// followLog 持续把日志文件中新写入的内容复制到 w，直到 exited 关闭后把剩下的内容复制完
+func followLog(logPath string, w io.Writer, exited <-chan struct{}) error {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		select {
+		case <-exited:
+			_, err := io.Copy(w, f)
+			return err
+		case <-time.After(stopPollInterval):
+			if _, err := io.Copy(w, f); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// createCopyLayer 把 COPY 指令要复制的文件放到临时目录中，打包成镜像层并保存到层存储中，返回它的 diff_id 和大小
+func createCopyLayer(contextDir string, args string, workingDir string) (string, int64, error) {
+	staging, err := ioutil.TempDir("", "MiniDocker-build-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(staging)
+	if err := stageCopy(contextDir, args, workingDir, staging); err != nil {
+		return "", 0, err
+	}
+	return createDirLayer(staging, nil)
+}
+
+// stageCopy 按 COPY 指令把构建上下文中的文件复制到 staging 目录中目标路径对应的位置
+// 参数可以是 JSON 数组或以空格分隔的路径，最后一个是容器中的目标路径，相对路径相对于工作目录。
+// 源路径支持通配符，不能超出构建上下文；源路径是目录时复制目录中的内容。
+// 复制出的文件属于 root，保留源文件的权限和修改时间，新建的上级目录修改时间统一为 0，保证同样的内容打出同样的包
+func stageCopy(contextDir string, args string, workingDir string, staging string) error {
+	var paths []string
+	if strings.HasPrefix(args, "[") {
+		if err := json.Unmarshal([]byte(args), &paths); err != nil {
+			return fmt.Errorf("解析参数失败: %v", err)
+		}
+	} else {
+		paths = strings.Fields(args)
+	}
+	if len(paths) > 0 && strings.HasPrefix(paths[0], "--") {
+		return fmt.Errorf("不支持参数 %s", paths[0])
+	}
+	if len(paths) < 2 {
+		return fmt.Errorf("至少需要一个源路径和一个目标路径")
+	}
+	dest := paths[len(paths)-1]
+	destIsDir := strings.HasSuffix(dest, "/") || len(paths) > 2
+	if !path.IsAbs(dest) {
+		dest = path.Join("/", workingDir, dest)
+	}
+
+	var sources []string
+	for _, src := range paths[:len(paths)-1] {
+		// 先按绝对路径清理掉 ..，保证源路径不会超出构建上下文
+		matches, err := filepath.Glob(filepath.Join(contextDir, path.Clean("/"+src)))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("构建上下文中没有 %s", src)
+		}
+		sources = append(sources, matches...)
+	}
+	if len(sources) > 1 {
+		destIsDir = true
+	}
+
+	target := filepath.Join(staging, dest)
+	var createdDirs []string
+	for _, src := range sources {
+		stat, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		dir, dst := target, target
+		if !stat.IsDir() {
+			if destIsDir {
+				dst = filepath.Join(target, filepath.Base(src))
+			} else {
+				dir = filepath.Dir(target)
+			}
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		createdDirs = append(createdDirs, dir)
+		if stat.IsDir() {
+			err = copyDirContents(src, dst)
+		} else {
+			err = copyEntry(src, dst, stat)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, dir := range createdDirs {
+		for ; dir != staging && strings.HasPrefix(dir, staging); dir = filepath.Dir(dir) {
+			if err := os.Chtimes(dir, time.Unix(0, 0), time.Unix(0, 0)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyDirContents 把目录 src 中的内容复制到已经存在的目录 dst 中
+func copyDirContents(src string, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := copyEntry(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyEntry 复制一个文件、符号链接或目录，符号链接原样复制，不跟随
+func copyEntry(src string, dst string, stat os.FileInfo) error {
+	switch {
+	case stat.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+		return os.Lchown(dst, 0, 0)
+	case stat.IsDir():
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return err
+		}
+		if err := copyDirContents(src, dst); err != nil {
+			return err
+		}
+	case stat.Mode().IsRegular():
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("不支持复制特殊文件 %s", src)
+	}
+	if err := os.Chmod(dst, stat.Mode().Perm()|stat.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := os.Lchown(dst, 0, 0); err != nil {
+		return err
+	}
+	// 目录的修改时间在复制完其中的内容之后再设置
+	return os.Chtimes(dst, stat.ModTime(), stat.ModTime())
+}
+
+// copyFile 复制普通文件的内容
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	dockerfile := `# 注释
+from busybox:latest
+
+RUN echo hello \
+    && echo world
+# 续行中间的注释
+env A=1
+COPY ["a b", "/app/"]
+cmd ["sh"]
+`
+	instructions, err := parseDockerfile(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []instruction{
+		{Line: 2, Command: "FROM", Args: "busybox:latest", Original: "FROM busybox:latest"},
+		{Line: 4, Command: "RUN", Args: "echo hello && echo world", Original: "RUN echo hello && echo world"},
+		{Line: 7, Command: "ENV", Args: "A=1", Original: "ENV A=1"},
+		{Line: 8, Command: "COPY", Args: `["a b", "/app/"]`, Original: `COPY ["a b", "/app/"]`},
+		{Line: 9, Command: "CMD", Args: `["sh"]`, Original: `CMD ["sh"]`},
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("解析出 %d 条指令，期望 %d 条: %+v", len(instructions), len(want), instructions)
+	}
+	for i := range want {
+		if instructions[i] != want[i] {
+			t.Errorf("第 %d 条指令为 %+v，期望 %+v", i, instructions[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"RUN ls",
+		"FROM a\nFROM b",
+		"FROM a b",
+		"FROM busybox\nADD x /x",
+		"FROM busybox\nRUN",
+		"FROM busybox\nRUN ls \\",
+	} {
+		if _, err := parseDockerfile(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseDockerfile(%q) 期望报错", bad)
+		}
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	first := cacheKey("", "FROM sha256:1234")
+	if cacheKey("", "FROM sha256:1234") != first {
+		t.Error("同样的指令应该得到同样的缓存键")
+	}
+	if cacheKey(first, "RUN ls") == cacheKey(cacheKey("", "FROM sha256:5678"), "RUN ls") {
+		t.Error("基础镜像不同时缓存键应该不同")
+	}
+}
+
+func TestStageCopy(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("需要 root 权限修改文件属主")
+	}
+	contextDir := t.TempDir()
+	mustWrite := func(name string, content string, mode os.FileMode) {
+		file := filepath.Join(contextDir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite("main.sh", "echo hi", 0755)
+	mustWrite("conf/a.conf", "a", 0644)
+	mustWrite("conf/sub/b.conf", "b", 0600)
+
+	cases := []struct {
+		args  string
+		files map[string]string
+	}{
+		{"main.sh /usr/bin/run", map[string]string{"usr/bin/run": "echo hi"}},
+		{"main.sh bin/", map[string]string{"app/bin/main.sh": "echo hi"}},
+		{`["conf", "/etc/app"]`, map[string]string{"etc/app/a.conf": "a", "etc/app/sub/b.conf": "b"}},
+		{"conf/*.conf main.sh /opt", map[string]string{"opt/a.conf": "a", "opt/main.sh": "echo hi"}},
+		{"../../conf/a.conf /a", map[string]string{"a": "a"}},
+	}
+	for _, c := range cases {
+		staging := t.TempDir()
+		if err := stageCopy(contextDir, c.args, "/app", staging); err != nil {
+			t.Errorf("stageCopy(%q) 失败: %v", c.args, err)
+			continue
+		}
+		for name, content := range c.files {
+			got, err := ioutil.ReadFile(filepath.Join(staging, name))
+			if err != nil || string(got) != content {
+				t.Errorf("COPY %s 之后 %s 的内容为 %q (%v)，期望 %q", c.args, name, got, err, content)
+			}
+		}
+	}
+
+	staging := t.TempDir()
+	if err := stageCopy(contextDir, "main.sh /usr/local/bin/run", "", staging); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(filepath.Join(staging, "usr/local/bin/run"))
+	if err != nil || stat.Mode().Perm() != 0755 {
+		t.Errorf("复制的文件应该保留权限: %v %v", stat, err)
+	}
+	for _, dir := range []string{"usr", "usr/local", "usr/local/bin"} {
+		if stat, err := os.Stat(filepath.Join(staging, dir)); err != nil || !stat.ModTime().Equal(time.Unix(0, 0)) {
+			t.Errorf("新建的上级目录 %s 的修改时间应该为 0: %v %v", dir, stat, err)
+		}
+	}
+
+	for _, bad := range []string{"main.sh", "missing /x", "--chown=1 main.sh /x", `["main.sh"`} {
+		if err := stageCopy(contextDir, bad, "/", t.TempDir()); err == nil {
+			t.Errorf("stageCopy(%q) 期望报错", bad)
+		}
+	}
+}
@@ -2,11 +2,14 @@ package cgroup
 
 import (
 	"MiniDocker/cgroup/subsystems"
+	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
 )
 
 // CgroupManager 管理cgroup的结构体
+// 宿主机是 cgroup v1 还是 v2 由 subsystems 在访问路径时自动判断，
+// v1 下每个子系统各自有一个目录，v2 下所有子系统共用 unified hierarchy 中的同一个目录
 type CgroupManager struct {
 	// cgroup在hierarchy中的路径 相当于创建的cgroup目录相对于root cgroup目录的路径
 	Path string
@@ -23,26 +26,46 @@ func NewCgroupManager(path string) *CgroupManager {
 // Apply 将进程pid加入到这个cgroup中
 func (c *CgroupManager) Apply(pid int) error {
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Apply(c.Path, pid)
+		if err := subSysIns.Apply(c.Path, pid); err != nil {
+			return fmt.Errorf("将进程 %d 加入 %s cgroup 失败: %v", pid, subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
 // Set 设置cgroup资源限制
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
+	if err := subsystems.ValidateResourceConfig(res); err != nil {
+		return err
+	}
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil {
+			return fmt.Errorf("设置 %s cgroup 资源限制失败: %v", subSysIns.Name(), err)
+		}
 	}
+	c.Resource = res
 	return nil
 }
 
+// GetStats 读取cgroup的资源使用情况
+func (c *CgroupManager) GetStats() (*subsystems.Stats, error) {
+	stats := &subsystems.Stats{}
+	for _, subSysIns := range subsystems.SubsystemsIns {
+		if err := subSysIns.GetStats(c.Path, stats); err != nil {
+			return nil, fmt.Errorf("读取 %s cgroup 资源使用情况失败: %v", subSysIns.Name(), err)
+		}
+	}
+	return stats, nil
+}
+
+// OOMKills 读取cgroup中被 OOM killer 杀死的进程数，只读 memory 子系统
+func (c *CgroupManager) OOMKills() (uint64, error) {
+	return subsystems.OOMKills(c.Path)
+}
+
 // Destroy 释放cgroup
+// 各子系统会忽略已经不存在的 cgroup 目录，所以重复调用是安全的
 func (c *CgroupManager) Destroy() error {
-	// 先检查 cgroup 是否存在
-	if exists, _ := PathExists(c.Path); !exists {
-		logrus.Warnf("cgroup %s 不存在，跳过删除", c.Path)
-		return nil
-	}
 	for _, subSysIns := range subsystems.SubsystemsIns {
 		if err := subSysIns.Remove(c.Path); err != nil {
 			logrus.Warnf("删除cgroup %s 失败: %v", c.Path, err)
@@ -11,17 +11,44 @@ import (
 // CpuSubSystem 是 cpu 子系统的实现，用于设置 CPU 使用权重（shares）
 type CpuSubSystem struct{}
 
+// cpu.shares 的取值范围，与内核保持一致
+const (
+	minCpuShare = 2
+	maxCpuShare = 262144
+)
+
+// Validate 检查 CPU 权重是否在内核允许的范围内
+func (s *CpuSubSystem) Validate(res *ResourceConfig) error {
+	if res.CpuShare != 0 && (res.CpuShare < minCpuShare || res.CpuShare > maxCpuShare) {
+		return fmt.Errorf("CPU 权重 %d 超出范围，取值范围为 %d~%d", res.CpuShare, minCpuShare, maxCpuShare)
+	}
+	return nil
+}
+
 // Set 设置某个 cgroup 在 cpu 子系统中的资源限制
 // 这里通过设置 cpu.shares 来限制进程的 CPU 调度权重
 // 权重越高，进程分配到的 CPU 时间越多（相对的）
 func (s *CpuSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	// 获取当前子系统对应的 cgroup 路径（create = true 会创建目录）
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
-		// 如果配置了 CPU 权重（如 "512"），写入 cpu.shares 文件
-		if res.CpuShare != "" {
+		// 如果配置了 CPU 权重（如 "512"），写入 cpu.shares 文件，没有配置时恢复为默认的 1024
+		// v2 没有 cpu.shares，需要换算成 cpu.weight（默认为 100）
+		shareFile, defaultShare := "cpu.shares", "1024"
+		if IsCgroup2UnifiedMode() {
+			shareFile, defaultShare = "cpu.weight", "100"
+		}
+		if res.CpuShare == 0 {
+			if err := resetCgroupFile(subsysCgroupPath, shareFile, defaultShare); err != nil {
+				return fmt.Errorf("恢复默认 CPU 权重失败: %v", err)
+			}
+		} else {
+			share := res.CpuShare
+			if IsCgroup2UnifiedMode() {
+				share = ConvertCPUSharesToCgroupV2Value(res.CpuShare)
+			}
 			if err := ioutil.WriteFile(
-				path.Join(subsysCgroupPath, "cpu.shares"),
-				[]byte(res.CpuShare),
+				path.Join(subsysCgroupPath, shareFile),
+				[]byte(strconv.FormatUint(share, 10)),
 				0644); err != nil {
 				return fmt.Errorf("设置 CPU 权重失败: %v", err)
 			}
@@ -38,7 +65,7 @@ func (s *CpuSubSystem) Remove(cgroupPath string) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		return os.RemoveAll(subsysCgroupPath)
 	} else {
-		return err
+		return ignoreNotExist(err)
 	}
 }
 
@@ -46,7 +73,7 @@ func (s *CpuSubSystem) Remove(cgroupPath string) error {
 func (s *CpuSubSystem) Apply(cgroupPath string, pid int) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		if err := ioutil.WriteFile(
-			path.Join(subsysCgroupPath, "tasks"),
+			path.Join(subsysCgroupPath, ProcsFile()),
 			[]byte(strconv.Itoa(pid)),
 			0644); err != nil {
 			return fmt.Errorf("将进程加入 CPU cgroup 失败: %v", err)
@@ -57,7 +84,42 @@ func (s *CpuSubSystem) Apply(cgroupPath string, pid int) error {
 	}
 }
 
+// GetStats 读取累计使用的 CPU 时间
+// v1 读取 cpuacct.usage（要求 cpu 和 cpuacct 挂载在同一个层级），v2 读取 cpu.stat 中的 usage_usec
+func (s *CpuSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	if IsCgroup2UnifiedMode() {
+		usage, err := readCgroupKeyedUint(subsysCgroupPath, "cpu.stat", "usage_usec")
+		if err != nil {
+			return fmt.Errorf("读取 CPU 使用时间失败: %v", err)
+		}
+		stats.CpuUsage = usage * 1000
+		return nil
+	}
+	usage, err := readCgroupUint(subsysCgroupPath, "cpuacct.usage")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("读取 CPU 使用时间失败: %v", err)
+	}
+	stats.CpuUsage = usage
+	return nil
+}
+
 // Name 返回该子系统的名称，用于路径拼接
 func (s *CpuSubSystem) Name() string {
 	return "cpu"
 }
+
+// ConvertCPUSharesToCgroupV2Value 将 v1 的 cpu.shares（2~262144）线性换算为 v2 的 cpu.weight（1~10000）
+// 换算方式与 runc 保持一致，0 表示未设置
+func ConvertCPUSharesToCgroupV2Value(cpuShares uint64) uint64 {
+	if cpuShares == 0 {
+		return 0
+	}
+	if cpuShares < 2 {
+		cpuShares = 2
+	}
+	return 1 + ((cpuShares-2)*9999)/262142
+}
@@ -0,0 +1,116 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+)
+
+// CpuQuotaSubSystem 用 CFS 带宽控制实现 CPU 硬上限，例如 --cpus 1.5 表示最多使用 1.5 个 CPU
+// 它和 CpuSubSystem 位于同一个 cpu 层级中，只是写入的文件不同
+type CpuQuotaSubSystem struct{}
+
+// CFS 调度周期的取值范围（微秒），与内核保持一致
+const (
+	DefaultCpuPeriod = 100000
+	minCpuPeriod     = 1000
+	maxCpuPeriod     = 1000000
+	minCpuQuota      = 1000
+)
+
+// Validate 检查 CPU 配额和周期是否合法
+func (s *CpuQuotaSubSystem) Validate(res *ResourceConfig) error {
+	if res.CpuQuota == 0 {
+		return nil
+	}
+	if res.CpuPeriod < minCpuPeriod || res.CpuPeriod > maxCpuPeriod {
+		return fmt.Errorf("CPU 调度周期 %d 超出范围，取值范围为 %d~%d 微秒", res.CpuPeriod, minCpuPeriod, maxCpuPeriod)
+	}
+	if res.CpuQuota < minCpuQuota {
+		return fmt.Errorf("CPU 配额 %d 过小，最小为 %d 微秒", res.CpuQuota, minCpuQuota)
+	}
+	if res.CpuQuota > int64(res.CpuPeriod)*int64(runtime.NumCPU()) {
+		return fmt.Errorf("CPU 配额超过了宿主机的 %d 个 CPU", runtime.NumCPU())
+	}
+	return nil
+}
+
+// Set 设置某个 cgroup 的 CPU 配额
+// v1 写入 cpu.cfs_period_us 和 cpu.cfs_quota_us，v2 写入 cpu.max（格式为 "配额 周期"）
+func (s *CpuQuotaSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		// 没有设置配额时写入 -1（v2 为 max，周期保持不变）取消之前的限制
+		if res.CpuQuota == 0 {
+			quotaFile, unlimited := "cpu.cfs_quota_us", "-1"
+			if IsCgroup2UnifiedMode() {
+				quotaFile, unlimited = "cpu.max", "max"
+			}
+			if err := resetCgroupFile(subsysCgroupPath, quotaFile, unlimited); err != nil {
+				return fmt.Errorf("取消 CPU 配额失败: %v", err)
+			}
+		} else {
+			if IsCgroup2UnifiedMode() {
+				if err := ioutil.WriteFile(
+					path.Join(subsysCgroupPath, "cpu.max"),
+					[]byte(fmt.Sprintf("%d %d", res.CpuQuota, res.CpuPeriod)),
+					0644); err != nil {
+					return fmt.Errorf("设置 CPU 配额失败: %v", err)
+				}
+				return nil
+			}
+			// 先写周期再写配额，否则内核可能因为配额大于旧周期下的上限而拒绝
+			if err := ioutil.WriteFile(
+				path.Join(subsysCgroupPath, "cpu.cfs_period_us"),
+				[]byte(strconv.FormatUint(res.CpuPeriod, 10)),
+				0644); err != nil {
+				return fmt.Errorf("设置 CPU 调度周期失败: %v", err)
+			}
+			if err := ioutil.WriteFile(
+				path.Join(subsysCgroupPath, "cpu.cfs_quota_us"),
+				[]byte(strconv.FormatInt(res.CpuQuota, 10)),
+				0644); err != nil {
+				return fmt.Errorf("设置 CPU 配额失败: %v", err)
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+// Remove 删除 cpu 子系统下的 cgroup 目录
+func (s *CpuQuotaSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.RemoveAll(subsysCgroupPath)
+	} else {
+		return ignoreNotExist(err)
+	}
+}
+
+// Apply 将进程 pid 加入到该 cgroup 中
+func (s *CpuQuotaSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(
+			path.Join(subsysCgroupPath, ProcsFile()),
+			[]byte(strconv.Itoa(pid)),
+			0644); err != nil {
+			return fmt.Errorf("将进程加入 CPU cgroup 失败: %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("获取 CPU cgroup 失败 %s: %v", cgroupPath, err)
+	}
+}
+
+// GetStats CPU 配额没有需要统计的使用量
+func (s *CpuQuotaSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	return nil
+}
+
+// Name 返回该子系统的名称，CPU 配额同样由 cpu 子系统控制
+func (s *CpuQuotaSubSystem) Name() string {
+	return "cpu"
+}
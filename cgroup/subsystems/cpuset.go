@@ -5,21 +5,57 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
+	"strings"
 )
 
 // CpusetSubSystem 是 cpuset 子系统的实现
 // 用于限制容器使用指定的 CPU 核心（如只使用 CPU 0 和 1）
 type CpusetSubSystem struct{}
 
+// Validate 检查 CPU 列表格式是否正确，并且只包含宿主机上存在的 CPU
+func (s *CpusetSubSystem) Validate(res *ResourceConfig) error {
+	if res.CpuSet == "" {
+		return nil
+	}
+	cpus, err := ParseCpuSet(res.CpuSet)
+	if err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		if cpu >= runtime.NumCPU() {
+			return fmt.Errorf("CPU %d 不存在，宿主机共有 %d 个 CPU", cpu, runtime.NumCPU())
+		}
+	}
+	return nil
+}
+
 // Set 设置某个 cgroup 在 cpuset 子系统中的资源限制
 // 通过写入 cpuset.cpus 文件，指定可以使用的 CPU 编号
 // 比如 "0", "0-2", "0,1" 等格式
 func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	// 获取当前子系统对应的 cgroup 路径（create = true 表示创建路径）
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
-		// 若用户配置了 CPU 核分配，则写入 cpuset.cpus 文件
-		if res.CpuSet != "" {
+		// v1 下新建的 cpuset cgroup 的 cpuset.cpus 和 cpuset.mems 为空，这时加入进程会失败（ENOSPC）
+		if !IsCgroup2UnifiedMode() {
+			if err := initCpuset(cgroupPath); err != nil {
+				return err
+			}
+		}
+		// 没有配置 CPU 核分配时恢复为可以使用所有 CPU：v1 复制上一级的 cpuset.cpus，v2 写入空字符串表示继承上一级
+		if res.CpuSet == "" {
+			all := ""
+			if !IsCgroup2UnifiedMode() {
+				if all, err = readCpusetFile(path.Dir(subsysCgroupPath), "cpuset.cpus"); err != nil {
+					return err
+				}
+			}
+			if err := resetCgroupFile(subsysCgroupPath, "cpuset.cpus", all); err != nil {
+				return fmt.Errorf("取消 cpuset 限制失败: %v", err)
+			}
+		} else {
+			// 若用户配置了 CPU 核分配，则写入 cpuset.cpus 文件
 			if err := ioutil.WriteFile(
 				path.Join(subsysCgroupPath, "cpuset.cpus"),
 				[]byte(res.CpuSet),
@@ -33,12 +69,53 @@ func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	}
 }
 
+// initCpuset 从 cgroup 根目录开始逐级检查 cgroupPath 上的每一级 cgroup，
+// cpuset.cpus 或 cpuset.mems 为空时从上一级复制，与内核在 cgroup.clone_children 为 1 时的行为一致
+func initCpuset(cgroupPath string) error {
+	parent := FindCgroupMountpoint("cpuset")
+	for _, dir := range strings.Split(strings.Trim(cgroupPath, "/"), "/") {
+		current := path.Join(parent, dir)
+		for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+			value, err := readCpusetFile(current, file)
+			if err != nil {
+				return err
+			}
+			if value != "" {
+				continue
+			}
+			if value, err = readCpusetFile(parent, file); err != nil {
+				return err
+			}
+			if value == "" {
+				continue
+			}
+			if err := ioutil.WriteFile(path.Join(current, file), []byte(value), 0644); err != nil {
+				return fmt.Errorf("初始化 %s 的 %s 失败: %v", current, file, err)
+			}
+		}
+		parent = current
+	}
+	return nil
+}
+
+// readCpusetFile 读取 cpuset 的配置文件，文件不存在时返回空字符串
+func readCpusetFile(dir string, file string) (string, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("读取 %s 失败: %v", path.Join(dir, file), err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
 // Remove 删除 cpuset 子系统下的 cgroup 目录
 func (s *CpusetSubSystem) Remove(cgroupPath string) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		return os.RemoveAll(subsysCgroupPath)
 	} else {
-		return err
+		return ignoreNotExist(err)
 	}
 }
 
@@ -46,7 +123,7 @@ func (s *CpusetSubSystem) Remove(cgroupPath string) error {
 func (s *CpusetSubSystem) Apply(cgroupPath string, pid int) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		if err := ioutil.WriteFile(
-			path.Join(subsysCgroupPath, "tasks"),
+			path.Join(subsysCgroupPath, ProcsFile()),
 			[]byte(strconv.Itoa(pid)),
 			0644); err != nil {
 			return fmt.Errorf("添加进程到 cpuset cgroup 失败: %v", err)
@@ -57,6 +134,11 @@ func (s *CpusetSubSystem) Apply(cgroupPath string, pid int) error {
 	}
 }
 
+// GetStats cpuset没有需要统计的使用量
+func (s *CpusetSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	return nil
+}
+
 // Name 返回当前子系统的名称
 func (s *CpusetSubSystem) Name() string {
 	return "cpuset"
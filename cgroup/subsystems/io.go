@@ -0,0 +1,117 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// IoSubSystem 用于限制容器对块设备的读写速率
+// v1 中对应 blkio 子系统，v2 中对应 io 控制器
+type IoSubSystem struct{}
+
+// Validate 检查设备限速配置
+func (s *IoSubSystem) Validate(res *ResourceConfig) error {
+	for _, devices := range [][]*ThrottleDevice{res.BlkioDeviceReadBps, res.BlkioDeviceWriteBps} {
+		for _, d := range devices {
+			if d.Rate == 0 {
+				return fmt.Errorf("设备 %d:%d 的限速不能为 0", d.Major, d.Minor)
+			}
+		}
+	}
+	return nil
+}
+
+// Set 设置某个 cgroup 的块设备读写限速
+// v1 每个设备一行，分别写入 blkio.throttle.read_bps_device 和 blkio.throttle.write_bps_device
+// v2 每个设备一行写入 io.max，格式为 "major:minor rbps=N wbps=N"
+// 宿主机没有挂载 blkio/io 子系统时只有设置了限速才报错
+func (s *IoSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if IsCgroup2UnifiedMode() {
+			// 同一个设备的读写限速需要合并到一行中
+			var devices []string
+			limits := map[string][]string{}
+			for _, d := range res.BlkioDeviceReadBps {
+				if _, ok := limits[d.String()]; !ok {
+					devices = append(devices, d.String())
+				}
+				limits[d.String()] = append(limits[d.String()], "rbps="+strconv.FormatUint(d.Rate, 10))
+			}
+			for _, d := range res.BlkioDeviceWriteBps {
+				if _, ok := limits[d.String()]; !ok {
+					devices = append(devices, d.String())
+				}
+				limits[d.String()] = append(limits[d.String()], "wbps="+strconv.FormatUint(d.Rate, 10))
+			}
+			for _, device := range devices {
+				if err := ioutil.WriteFile(
+					path.Join(subsysCgroupPath, "io.max"),
+					[]byte(device+" "+strings.Join(limits[device], " ")),
+					0644); err != nil {
+					return fmt.Errorf("设置设备 %s 限速失败: %v", device, err)
+				}
+			}
+			return nil
+		}
+		for file, devices := range map[string][]*ThrottleDevice{
+			"blkio.throttle.read_bps_device":  res.BlkioDeviceReadBps,
+			"blkio.throttle.write_bps_device": res.BlkioDeviceWriteBps,
+		} {
+			for _, d := range devices {
+				if err := ioutil.WriteFile(
+					path.Join(subsysCgroupPath, file),
+					[]byte(fmt.Sprintf("%s %d", d, d.Rate)),
+					0644); err != nil {
+					return fmt.Errorf("设置设备 %s 限速失败: %v", d, err)
+				}
+			}
+		}
+		return nil
+	} else {
+		return skipNotMounted(err, len(res.BlkioDeviceReadBps) > 0 || len(res.BlkioDeviceWriteBps) > 0)
+	}
+}
+
+// Remove 删除 blkio/io 子系统下的 cgroup 目录
+func (s *IoSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.RemoveAll(subsysCgroupPath)
+	} else {
+		return ignoreNotExist(err)
+	}
+}
+
+// Apply 将进程 pid 加入到该 cgroup 中，宿主机没有挂载 blkio/io 子系统时跳过
+func (s *IoSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(
+			path.Join(subsysCgroupPath, ProcsFile()),
+			[]byte(strconv.Itoa(pid)),
+			0644); err != nil {
+			return fmt.Errorf("将进程加入 %s cgroup 失败: %v", s.Name(), err)
+		}
+		return nil
+	} else {
+		if skipNotMounted(err, false) == nil {
+			return nil
+		}
+		return fmt.Errorf("获取 %s cgroup 失败 %s: %v", s.Name(), cgroupPath, err)
+	}
+}
+
+// GetStats 块设备限速没有需要统计的使用量
+func (s *IoSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	return nil
+}
+
+// Name 返回该子系统的名称，v1 为 blkio，v2 为 io
+func (s *IoSubSystem) Name() string {
+	if IsCgroup2UnifiedMode() {
+		return "io"
+	}
+	return "blkio"
+}
@@ -11,18 +11,41 @@ import (
 // MemorySubSystem 是 memory 子系统的实现，用于设置内存限制
 type MemorySubSystem struct{}
 
+// minMemoryLimit 允许设置的最小内存限制，过小的限制会让容器 init 进程直接被 OOM 杀死
+const minMemoryLimit = 4 << 20
+
+// Validate 检查内存限制是否合法
+func (s *MemorySubSystem) Validate(res *ResourceConfig) error {
+	if res.MemoryLimit < 0 {
+		return fmt.Errorf("内存限制不能为负数")
+	}
+	if res.MemoryLimit > 0 && res.MemoryLimit < minMemoryLimit {
+		return fmt.Errorf("内存限制 %d 字节过小，最小为 4m", res.MemoryLimit)
+	}
+	return nil
+}
+
 // Set 设置某个 cgroup 在 memory 子系统中的内存限制
 // 参数 cgroupPath 是 cgroup 的相对路径，例如 "mydocker-cgroup/container1"
 // 参数 res 包含用户设置的资源限制（这里使用 res.MemoryLimit）
 func (s *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	// 获取对应子系统的绝对路径，并确保目录存在（create = true）
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
-		// 如果用户设置了内存限制，就写入到 memory.limit_in_bytes 文件中
-		if res.MemoryLimit != "" {
+		// 如果用户设置了内存限制，就写入到 memory.limit_in_bytes（v2 为 memory.max）文件中，
+		// 没有设置时写入 -1（v2 为 max）取消之前的限制
+		limitFile, unlimited := "memory.limit_in_bytes", "-1"
+		if IsCgroup2UnifiedMode() {
+			limitFile, unlimited = "memory.max", "max"
+		}
+		if res.MemoryLimit == 0 {
+			if err := resetCgroupFile(subsysCgroupPath, limitFile, unlimited); err != nil {
+				return fmt.Errorf("取消内存限制失败: %v", err)
+			}
+		} else {
 			// 将内存限制写入 memory 子系统的配置文件中（单位是字节）
 			if err := ioutil.WriteFile(
-				path.Join(subsysCgroupPath, "memory.limit_in_bytes"),
-				[]byte(res.MemoryLimit),
+				path.Join(subsysCgroupPath, limitFile),
+				[]byte(strconv.FormatInt(res.MemoryLimit, 10)),
 				0644); err != nil {
 				return fmt.Errorf("设置内存限制失败: %v", err)
 			}
@@ -41,7 +64,7 @@ func (s *MemorySubSystem) Remove(cgroupPath string) error {
 		// 删除目录（会清理所有限制设置）
 		return os.RemoveAll(subsysCgroupPath)
 	} else {
-		return err
+		return ignoreNotExist(err)
 	}
 }
 
@@ -49,9 +72,9 @@ func (s *MemorySubSystem) Remove(cgroupPath string) error {
 func (s *MemorySubSystem) Apply(cgroupPath string, pid int) error {
 	// 获取该 cgroup 的路径
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
-		// 向 tasks 文件写入 pid，即将进程加入到该 cgroup 中
+		// 向 tasks（v2 为 cgroup.procs）文件写入 pid，即将进程加入到该 cgroup 中
 		if err := ioutil.WriteFile(
-			path.Join(subsysCgroupPath, "tasks"),
+			path.Join(subsysCgroupPath, ProcsFile()),
 			[]byte(strconv.Itoa(pid)),
 			0644); err != nil {
 			return fmt.Errorf("加入内存 cgroup 失败: %v", err)
@@ -62,6 +85,50 @@ func (s *MemorySubSystem) Apply(cgroupPath string, pid int) error {
 	}
 }
 
+// GetStats 读取内存使用量、内存上限和 OOM 次数
+// v1 读取 memory.usage_in_bytes、memory.limit_in_bytes 和 memory.oom_control，
+// v2 读取 memory.current、memory.max 和 memory.events
+func (s *MemorySubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return err
+	}
+	usageFile, limitFile := "memory.usage_in_bytes", "memory.limit_in_bytes"
+	if IsCgroup2UnifiedMode() {
+		usageFile, limitFile = "memory.current", "memory.max"
+	}
+	if stats.MemoryUsage, err = readCgroupUint(subsysCgroupPath, usageFile); err != nil {
+		return fmt.Errorf("读取内存使用量失败: %v", err)
+	}
+	if stats.MemoryLimit, err = readCgroupUint(subsysCgroupPath, limitFile); err != nil {
+		return fmt.Errorf("读取内存上限失败: %v", err)
+	}
+	if stats.OomKills, err = readOOMKills(subsysCgroupPath); err != nil {
+		return fmt.Errorf("读取 OOM 事件失败: %v", err)
+	}
+	return nil
+}
+
+// OOMKills 读取 cgroup 中被 OOM killer 杀死的进程数
+// 只读 memory 子系统，其他子系统没有挂载或读取失败时不影响结果；memory 子系统没有挂载时返回 0
+func OOMKills(cgroupPath string) (uint64, error) {
+	subsysCgroupPath, err := GetCgroupPath("memory", cgroupPath, false)
+	if err != nil {
+		return 0, ignoreNotExist(err)
+	}
+	return readOOMKills(subsysCgroupPath)
+}
+
+// readOOMKills 读取 v1 的 memory.oom_control 或 v2 的 memory.events 中的 oom_kill 一项
+// 两个版本中被 OOM killer 杀死的进程数都记录在这一项，旧内核没有这一项时为 0
+func readOOMKills(subsysCgroupPath string) (uint64, error) {
+	eventsFile := "memory.oom_control"
+	if IsCgroup2UnifiedMode() {
+		eventsFile = "memory.events"
+	}
+	return readCgroupKeyedUint(subsysCgroupPath, eventsFile, "oom_kill")
+}
+
 // Name 返回该子系统的名称，用于在 /sys/fs/cgroup 下定位路径
 func (s *MemorySubSystem) Name() string {
 	return "memory"
@@ -0,0 +1,90 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+// PidsSubSystem 是 pids 子系统的实现，用于限制容器内的进程数量（防止 fork 炸弹）
+type PidsSubSystem struct{}
+
+// Validate 检查进程数限制是否合法
+// 0 表示不设置，-1 表示不限制
+func (s *PidsSubSystem) Validate(res *ResourceConfig) error {
+	if res.PidsLimit < -1 {
+		return fmt.Errorf("进程数限制 %d 不合法，-1 表示不限制", res.PidsLimit)
+	}
+	return nil
+}
+
+// Set 设置某个 cgroup 在 pids 子系统中的进程数限制
+// v1 和 v2 都是通过写入 pids.max 文件实现，宿主机没有挂载 pids 子系统时只有设置了限制才报错
+func (s *PidsSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if res.PidsLimit != 0 {
+			limit := "max"
+			if res.PidsLimit > 0 {
+				limit = strconv.FormatInt(res.PidsLimit, 10)
+			}
+			if err := ioutil.WriteFile(
+				path.Join(subsysCgroupPath, "pids.max"),
+				[]byte(limit),
+				0644); err != nil {
+				return fmt.Errorf("设置进程数限制失败: %v", err)
+			}
+		}
+		return nil
+	} else {
+		return skipNotMounted(err, res.PidsLimit != 0)
+	}
+}
+
+// Remove 删除 pids 子系统下的 cgroup 目录
+func (s *PidsSubSystem) Remove(cgroupPath string) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.RemoveAll(subsysCgroupPath)
+	} else {
+		return ignoreNotExist(err)
+	}
+}
+
+// Apply 将进程 pid 加入到该 pids cgroup 中，宿主机没有挂载 pids 子系统时跳过
+func (s *PidsSubSystem) Apply(cgroupPath string, pid int) error {
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(
+			path.Join(subsysCgroupPath, ProcsFile()),
+			[]byte(strconv.Itoa(pid)),
+			0644); err != nil {
+			return fmt.Errorf("将进程加入 pids cgroup 失败: %v", err)
+		}
+		return nil
+	} else {
+		if skipNotMounted(err, false) == nil {
+			return nil
+		}
+		return fmt.Errorf("获取 pids cgroup 失败 %s: %v", cgroupPath, err)
+	}
+}
+
+// GetStats 读取当前进程数和进程数上限
+func (s *PidsSubSystem) GetStats(cgroupPath string, stats *Stats) error {
+	subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false)
+	if err != nil {
+		return skipNotMounted(err, false)
+	}
+	if stats.PidsCurrent, err = readCgroupUint(subsysCgroupPath, "pids.current"); err != nil {
+		return fmt.Errorf("读取进程数失败: %v", err)
+	}
+	if stats.PidsLimit, err = readCgroupUint(subsysCgroupPath, "pids.max"); err != nil {
+		return fmt.Errorf("读取进程数上限失败: %v", err)
+	}
+	return nil
+}
+
+// Name 返回该子系统的名称
+func (s *PidsSubSystem) Name() string {
+	return "pids"
+}
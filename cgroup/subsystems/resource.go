@@ -0,0 +1,129 @@
+package subsystems
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strconv"
+	"strings"
+)
+
+// memoryUnits 内存单位与字节数的对应关系，与 docker 一致按 1024 进制换算
+var memoryUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"ki":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mi":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gi":  1 << 30,
+	"gib": 1 << 30,
+}
+
+// ValidateResourceConfig 依次调用所有子系统检查资源限制
+func ValidateResourceConfig(res *ResourceConfig) error {
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Validate(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseMemory 将带单位的内存大小解析为字节数
+// 支持 b/k/m/g 以及 Ki/Mi/Gi 等单位（不区分大小写），例如 "512m"、"1Gi"、"1.5g"、"1048576"
+func ParseMemory(s string) (int64, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	// 找到数字部分与单位部分的分界
+	i := 0
+	for i < len(str) && (str[i] >= '0' && str[i] <= '9' || str[i] == '.') {
+		i++
+	}
+	num, unit := str[:i], strings.TrimSpace(str[i:])
+	if num == "" {
+		return 0, fmt.Errorf("内存大小 %q 格式错误，例如: 512m", s)
+	}
+	multiplier, ok := memoryUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("内存大小 %q 的单位 %q 不支持，可用单位: b、k、m、g、Ki、Mi、Gi", s, unit)
+	}
+	size, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("内存大小 %q 格式错误: %v", s, err)
+	}
+	bytes := size * float64(multiplier)
+	if bytes > float64(1<<62) {
+		return 0, fmt.Errorf("内存大小 %q 超出范围", s)
+	}
+	return int64(bytes), nil
+}
+
+// ParseCpuSet 解析 cpuset 格式的 CPU 列表，例如 "0-2,4"，返回其中包含的 CPU 编号
+func ParseCpuSet(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, fmt.Errorf("CPU 列表 %q 格式错误，例如: 0-2,4", s)
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("CPU 列表 %q 中的 %q 不是合法的 CPU 编号", s, part)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, fmt.Errorf("CPU 列表 %q 中的范围 %q 不合法", s, part)
+			}
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// ParseCpus 将 --cpus 指定的 CPU 个数（如 "1.5"）换算成默认调度周期下的 CFS 配额
+// 返回值依次为调度周期和配额，单位均为微秒；0 表示不限制，例如 update --cpus 0 取消之前的限制
+func ParseCpus(s string) (uint64, int64, error) {
+	cpus, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || cpus < 0 {
+		return 0, 0, fmt.Errorf("CPU 个数 %q 不合法，例如: --cpus 1.5", s)
+	}
+	if cpus == 0 {
+		return 0, 0, nil
+	}
+	return DefaultCpuPeriod, int64(cpus * DefaultCpuPeriod), nil
+}
+
+// ParseThrottleDevice 解析块设备限速配置，格式为 "设备路径:速率"，例如 "/dev/sda:1mb"
+// 速率与内存大小使用相同的单位
+func ParseThrottleDevice(s string) (*ThrottleDevice, error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return nil, fmt.Errorf("设备限速 %q 格式错误，例如: /dev/sda:1mb", s)
+	}
+	devicePath, rateStr := s[:i], s[i+1:]
+	rate, err := ParseMemory(rateStr)
+	if err != nil {
+		return nil, fmt.Errorf("设备限速 %q 的速率错误: %v", s, err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(devicePath, &stat); err != nil {
+		return nil, fmt.Errorf("获取设备 %s 信息失败: %v", devicePath, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return nil, fmt.Errorf("%s 不是块设备", devicePath)
+	}
+	return &ThrottleDevice{
+		Major: int64(unix.Major(stat.Rdev)),
+		Minor: int64(unix.Minor(stat.Rdev)),
+		Rate:  uint64(rate),
+	}, nil
+}
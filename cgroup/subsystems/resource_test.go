@@ -0,0 +1,114 @@
+package subsystems
+
+import "testing"
+
+func TestParseMemory(t *testing.T) {
+	cases := map[string]int64{
+		"1024":  1024,
+		"100b":  100,
+		"4k":    4 << 10,
+		"512m":  512 << 20,
+		"512M":  512 << 20,
+		"512Mi": 512 << 20,
+		"1g":    1 << 30,
+		"2Gi":   2 << 30,
+		"1.5g":  3 << 29,
+		"64MB":  64 << 20,
+	}
+	for s, want := range cases {
+		got, err := ParseMemory(s)
+		if err != nil {
+			t.Errorf("ParseMemory(%q) 返回错误: %v", s, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("ParseMemory(%q) = %d, 期望 %d", s, got, want)
+		}
+	}
+
+	for _, s := range []string{"", "m", "abc", "12x", "1.2.3m", "-1m"} {
+		if _, err := ParseMemory(s); err == nil {
+			t.Errorf("ParseMemory(%q) 应当返回错误", s)
+		}
+	}
+}
+
+func TestParseCpuSet(t *testing.T) {
+	cpus, err := ParseCpuSet("0-2,4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{0, 1, 2, 4}
+	if len(cpus) != len(want) {
+		t.Fatalf("ParseCpuSet = %v, 期望 %v", cpus, want)
+	}
+	for i := range want {
+		if cpus[i] != want[i] {
+			t.Fatalf("ParseCpuSet = %v, 期望 %v", cpus, want)
+		}
+	}
+
+	for _, s := range []string{"", "a", "2-1", "0,,1", "-1"} {
+		if _, err := ParseCpuSet(s); err == nil {
+			t.Errorf("ParseCpuSet(%q) 应当返回错误", s)
+		}
+	}
+}
+
+func TestParseCpus(t *testing.T) {
+	period, quota, err := ParseCpus("1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if period != DefaultCpuPeriod || quota != 150000 {
+		t.Errorf("ParseCpus(1.5) = %d %d, 期望 %d 150000", period, quota, DefaultCpuPeriod)
+	}
+	// 0 表示不限制
+	if period, quota, err := ParseCpus("0"); err != nil || period != 0 || quota != 0 {
+		t.Errorf("ParseCpus(0) = %d %d %v, 期望 0 0", period, quota, err)
+	}
+	for _, s := range []string{"", "-1", "abc"} {
+		if _, _, err := ParseCpus(s); err == nil {
+			t.Errorf("ParseCpus(%q) 应当返回错误", s)
+		}
+	}
+}
+
+func TestParseThrottleDevice(t *testing.T) {
+	for _, s := range []string{"", "/dev/sda", "/dev/sda:", ":1mb", "/dev/sda:abc", "/dev/null:1mb"} {
+		if _, err := ParseThrottleDevice(s); err == nil {
+			t.Errorf("ParseThrottleDevice(%q) 应当返回错误", s)
+		}
+	}
+}
+
+func TestValidateResourceConfig(t *testing.T) {
+	good := &ResourceConfig{
+		MemoryLimit: 512 << 20,
+		CpuShare:    512,
+		CpuSet:      "0",
+		CpuPeriod:   DefaultCpuPeriod,
+		CpuQuota:    50000,
+		PidsLimit:   100,
+	}
+	if err := ValidateResourceConfig(good); err != nil {
+		t.Fatalf("ValidateResourceConfig(%+v) 返回错误: %v", good, err)
+	}
+
+	bad := []*ResourceConfig{
+		{MemoryLimit: 1 << 10},                             // 内存过小
+		{CpuShare: 1},                                      // CPU 权重过小
+		{CpuSet: "0-"},                                     // CPU 列表格式错误
+		{CpuSet: "99999"},                                  // CPU 不存在
+		{CpuPeriod: 10, CpuQuota: 50000},                   // 调度周期过小
+		{CpuPeriod: DefaultCpuPeriod, CpuQuota: 10},        // 配额过小
+		{CpuPeriod: DefaultCpuPeriod, CpuQuota: 1 << 40},   // 配额超过宿主机 CPU 数
+		{PidsLimit: -2},                                    // 进程数不合法
+		{BlkioDeviceReadBps: []*ThrottleDevice{{8, 0, 0}}}, // 限速为 0
+	}
+	for _, res := range bad {
+		if err := ValidateResourceConfig(res); err == nil {
+			t.Errorf("ValidateResourceConfig(%+v) 应当返回错误", res)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package subsystems
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Stats 记录一个 cgroup 当前的资源使用情况，由各个子系统的 GetStats 分别填充
+type Stats struct {
+	MemoryUsage uint64 `json:"memoryUsage"` // 当前内存使用量（字节）
+	MemoryLimit uint64 `json:"memoryLimit"` // 内存上限（字节），0 表示没有限制
+	CpuUsage    uint64 `json:"cpuUsage"`    // 累计使用的 CPU 时间（纳秒）
+	PidsCurrent uint64 `json:"pidsCurrent"` // 当前进程数
+	PidsLimit   uint64 `json:"pidsLimit"`   // 进程数上限，0 表示没有限制
+	OomKills    uint64 `json:"oomKills"`    // 因超出内存限制被 OOM killer 杀死的进程数
+}
+
+// unlimitedValue 超过这个值的限制视为没有限制
+// v1 中未设置内存限制时 memory.limit_in_bytes 是一个接近 int64 上限的数
+const unlimitedValue = 1 << 62
+
+// readCgroupUint 读取 cgroup 文件中的单个整数，"max" 和超大值都视为 0（没有限制）
+func readCgroupUint(dir string, file string) (uint64, error) {
+	content, err := ioutil.ReadFile(path.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+	str := strings.TrimSpace(string(content))
+	if str == "max" {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("解析 %s 失败: %v", file, err)
+	}
+	if value >= unlimitedValue {
+		return 0, nil
+	}
+	return value, nil
+}
+
+// readCgroupKeyedUint 读取 "key value" 格式的 cgroup 文件（如 cpu.stat、memory.events）中指定 key 的值
+// 文件不存在或没有该 key 时返回 0
+func readCgroupKeyedUint(dir string, file string, key string) (uint64, error) {
+	f, err := os.Open(path.Join(dir, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, scanner.Err()
+}
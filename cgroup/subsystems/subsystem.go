@@ -1,28 +1,52 @@
 package subsystems
 
+import "fmt"
+
 // ResourceConfig 用于传递资源限制配置
-// 用户可以通过该结构体限制容器的 CPU、内存等资源
+// 用户可以通过该结构体限制容器的 CPU、内存等资源，字段为零值时表示不做限制
 type ResourceConfig struct {
-	MemoryLimit string // 内存限制，例如 "500m"
-	CpuShare    string // CPU 使用权重，例如 "1024"
-	CpuSet      string // CPU 核绑定，例如 "0-2"、"0,1"
+	MemoryLimit         int64             `json:"memoryLimit,omitempty"`         // 内存限制（字节），例如 -m 500m 解析后为 524288000
+	CpuShare            uint64            `json:"cpuShare,omitempty"`            // CPU 使用权重，例如 1024
+	CpuSet              string            `json:"cpuSet,omitempty"`              // CPU 核绑定，例如 "0-2"、"0,1"
+	CpuPeriod           uint64            `json:"cpuPeriod,omitempty"`           // CFS 调度周期（微秒），与 CpuQuota 一起使用
+	CpuQuota            int64             `json:"cpuQuota,omitempty"`            // 每个调度周期内可使用的 CPU 时间（微秒），例如 --cpus 1.5 对应 150000
+	PidsLimit           int64             `json:"pidsLimit,omitempty"`           // 容器内最大进程数，-1 表示不限制
+	BlkioDeviceReadBps  []*ThrottleDevice `json:"blkioDeviceReadBps,omitempty"`  // 块设备读速率限制
+	BlkioDeviceWriteBps []*ThrottleDevice `json:"blkioDeviceWriteBps,omitempty"` // 块设备写速率限制
+}
+
+// ThrottleDevice 描述一个块设备的限速配置
+type ThrottleDevice struct {
+	Major int64  `json:"major"` // 设备主设备号
+	Minor int64  `json:"minor"` // 设备次设备号
+	Rate  uint64 `json:"rate"`  // 限速（字节/秒）
+}
+
+// String 返回 "major:minor" 格式的设备号，cgroup 文件中使用这种格式指定设备
+func (d *ThrottleDevice) String() string {
+	return fmt.Sprintf("%d:%d", d.Major, d.Minor)
 }
 
 // Subsystem 接口，每种 cgroup 子系统（如 memory、cpu、cpuset）都实现这个接口
 // 这样就能统一管理不同资源类型
 type Subsystem interface {
-	Name() string                          // 返回子系统名称，如 "cpu"、"memory"
-	Set(path string, res *ResourceConfig) error  // 设置资源限制
-	Apply(path string, pid int) error     // 将某个进程加入到这个 cgroup 中
-	Remove(path string) error             // 删除这个 cgroup
+	Name() string                               // 返回子系统名称，如 "cpu"、"memory"
+	Validate(res *ResourceConfig) error         // 检查资源限制是否在合法范围内
+	Set(path string, res *ResourceConfig) error // 设置资源限制
+	Apply(path string, pid int) error           // 将某个进程加入到这个 cgroup 中
+	Remove(path string) error                   // 删除这个 cgroup
+	GetStats(path string, stats *Stats) error   // 读取这个 cgroup 的资源使用情况
 }
 
 // SubsystemsIns 是各个子系统的注册列表（一个工厂）
 // 后续可以通过遍历它来统一设置或清理资源限制
 var (
 	SubsystemsIns = []Subsystem{
-		&CpusetSubSystem{},  // CPU 核心绑定限制
-		&MemorySubSystem{},  // 内存限制
-		&CpuSubSystem{},     // CPU 权重限制
+		&CpusetSubSystem{},   // CPU 核心绑定限制
+		&MemorySubSystem{},   // 内存限制
+		&CpuSubSystem{},      // CPU 权重限制
+		&CpuQuotaSubSystem{}, // CPU 配额限制
+		&PidsSubSystem{},     // 进程数限制
+		&IoSubSystem{},       // 块设备读写限速
 	}
 )
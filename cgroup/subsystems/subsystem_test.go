@@ -0,0 +1,384 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeCgroupV1 在临时目录下伪造一套 cgroup v1 层级，并让 mountinfo 指向它
+func fakeCgroupV1(t *testing.T) string {
+	root := t.TempDir()
+	var lines []string
+	for i, subsystem := range []string{"cpu", "cpuset", "memory", "pids", "blkio"} {
+		dir := path.Join(root, subsystem)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%d 1 0:%d / %s rw,relatime - cgroup cgroup rw,%s", 30+i, 30+i, dir, subsystem))
+	}
+	setMountInfo(t, root, lines)
+	return root
+}
+
+// fakeCgroupV2 在临时目录下伪造一个 cgroup v2 的 unified 层级
+func fakeCgroupV2(t *testing.T) string {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(path.Join(root, "cgroup.controllers"), []byte("cpuset cpu io memory pids"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "cgroup.subtree_control"), []byte(""), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setMountInfo(t, root, []string{
+		fmt.Sprintf("30 1 0:30 / %s rw,nosuid,nodev,noexec,relatime - cgroup2 cgroup2 rw,nsdelegate", root),
+	})
+	return root
+}
+
+// setMountInfo 写入伪造的 mountinfo，并在测试结束后恢复
+func setMountInfo(t *testing.T, root string, lines []string) {
+	mountInfoFile := path.Join(root, "mountinfo")
+	content := "22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw\n" + strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(mountInfoFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := mountInfoPath
+	mountInfoPath = mountInfoFile
+	t.Cleanup(func() { mountInfoPath = old })
+}
+
+func readCgroupFile(t *testing.T, file string) string {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("读取 %s 失败: %v", file, err)
+	}
+	return string(content)
+}
+
+func TestCgroupV1(t *testing.T) {
+	root := fakeCgroupV1(t)
+	if IsCgroup2UnifiedMode() {
+		t.Fatal("伪造的 v1 层级被识别成了 v2")
+	}
+	res := &ResourceConfig{
+		MemoryLimit:         100 << 20,
+		CpuShare:            512,
+		CpuSet:              "0",
+		CpuPeriod:           DefaultCpuPeriod,
+		CpuQuota:            50000,
+		PidsLimit:           100,
+		BlkioDeviceReadBps:  []*ThrottleDevice{{Major: 8, Minor: 0, Rate: 1 << 20}},
+		BlkioDeviceWriteBps: []*ThrottleDevice{{Major: 8, Minor: 0, Rate: 2 << 20}},
+	}
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Set("test", res); err != nil {
+			t.Fatalf("%s Set 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.Apply("test", 1234); err != nil {
+			t.Fatalf("%s Apply 失败: %v", subSysIns.Name(), err)
+		}
+	}
+
+	checks := map[string]string{
+		"memory/test/memory.limit_in_bytes":          "104857600",
+		"cpu/test/cpu.shares":                        "512",
+		"cpuset/test/cpuset.cpus":                    "0",
+		"cpu/test/cpu.cfs_period_us":                 "100000",
+		"cpu/test/cpu.cfs_quota_us":                  "50000",
+		"pids/test/pids.max":                         "100",
+		"blkio/test/blkio.throttle.read_bps_device":  "8:0 1048576",
+		"blkio/test/blkio.throttle.write_bps_device": "8:0 2097152",
+		"memory/test/tasks":                          "1234",
+		"cpu/test/tasks":                             "1234",
+		"cpuset/test/tasks":                          "1234",
+	}
+	for file, want := range checks {
+		if got := readCgroupFile(t, path.Join(root, file)); got != want {
+			t.Errorf("%s = %q, 期望 %q", file, got, want)
+		}
+	}
+
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Remove("test"); err != nil {
+			t.Fatalf("%s Remove 失败: %v", subSysIns.Name(), err)
+		}
+		if _, err := os.Stat(path.Join(root, subSysIns.Name(), "test")); !os.IsNotExist(err) {
+			t.Errorf("%s 的 cgroup 目录没有被删除", subSysIns.Name())
+		}
+	}
+}
+
+func TestCgroupV2(t *testing.T) {
+	root := fakeCgroupV2(t)
+	if !IsCgroup2UnifiedMode() {
+		t.Fatal("伪造的 v2 层级没有被识别出来")
+	}
+	if got := FindCgroupMountpoint("memory"); got != root {
+		t.Fatalf("FindCgroupMountpoint(memory) = %s, 期望 %s", got, root)
+	}
+	res := &ResourceConfig{
+		MemoryLimit:         100 << 20,
+		CpuShare:            1024,
+		CpuSet:              "0",
+		CpuPeriod:           DefaultCpuPeriod,
+		CpuQuota:            150000,
+		PidsLimit:           -1,
+		BlkioDeviceReadBps:  []*ThrottleDevice{{Major: 8, Minor: 0, Rate: 1 << 20}},
+		BlkioDeviceWriteBps: []*ThrottleDevice{{Major: 8, Minor: 0, Rate: 2 << 20}},
+	}
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Set("test", res); err != nil {
+			t.Fatalf("%s Set 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.Apply("test", 1234); err != nil {
+			t.Fatalf("%s Apply 失败: %v", subSysIns.Name(), err)
+		}
+	}
+
+	checks := map[string]string{
+		"test/memory.max":   "104857600",
+		"test/cpu.weight":   "39",
+		"test/cpuset.cpus":  "0",
+		"test/cpu.max":      "150000 100000",
+		"test/pids.max":     "max",
+		"test/io.max":       "8:0 rbps=1048576 wbps=2097152",
+		"test/cgroup.procs": "1234",
+	}
+	for file, want := range checks {
+		if got := readCgroupFile(t, path.Join(root, file)); got != want {
+			t.Errorf("%s = %q, 期望 %q", file, got, want)
+		}
+	}
+	// 根 cgroup 中应当开启过控制器
+	if got := readCgroupFile(t, path.Join(root, "cgroup.subtree_control")); !strings.HasPrefix(got, "+") {
+		t.Errorf("cgroup.subtree_control = %q, 期望写入过控制器", got)
+	}
+
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Remove("test"); err != nil {
+			t.Fatalf("%s Remove 失败: %v", subSysIns.Name(), err)
+		}
+	}
+	if _, err := os.Stat(path.Join(root, "test")); !os.IsNotExist(err) {
+		t.Error("cgroup 目录没有被删除")
+	}
+}
+
+func TestConvertCPUSharesToCgroupV2Value(t *testing.T) {
+	cases := map[uint64]uint64{0: 0, 2: 1, 1024: 39, 262144: 10000}
+	for shares, want := range cases {
+		if got := ConvertCPUSharesToCgroupV2Value(shares); got != want {
+			t.Errorf("ConvertCPUSharesToCgroupV2Value(%d) = %d, 期望 %d", shares, got, want)
+		}
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	root := fakeCgroupV2(t)
+	dir := path.Join(root, "test")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"memory.current": "1048576\n",
+		"memory.max":     "max\n",
+		"memory.events":  "low 0\nhigh 0\nmax 5\noom 1\noom_kill 1\n",
+		"cpu.stat":       "usage_usec 2500\nuser_usec 2000\nsystem_usec 500\n",
+		"pids.current":   "3\n",
+		"pids.max":       "100\n",
+	}
+	for file, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := &Stats{}
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.GetStats("test", stats); err != nil {
+			t.Fatalf("%s GetStats 失败: %v", subSysIns.Name(), err)
+		}
+	}
+	want := Stats{MemoryUsage: 1 << 20, MemoryLimit: 0, CpuUsage: 2500000, PidsCurrent: 3, PidsLimit: 100, OomKills: 1}
+	if *stats != want {
+		t.Errorf("GetStats = %+v, 期望 %+v", *stats, want)
+	}
+}
+
+func TestCgroupHierarchies(t *testing.T) {
+	root := fakeCgroupV1(t)
+	hierarchies, err := CgroupHierarchies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hierarchies) != 5 {
+		t.Fatalf("找到 %d 个 cgroup 层级，期望 5 个: %+v", len(hierarchies), hierarchies)
+	}
+	want := Hierarchy{Mountpoint: path.Join(root, "memory"), FsType: "cgroup", Options: "rw,memory"}
+	if hierarchies[2] != want {
+		t.Errorf("第 3 个层级为 %+v，期望 %+v", hierarchies[2], want)
+	}
+}
+
+func TestCgroupV1OptionalSubsystems(t *testing.T) {
+	root := t.TempDir()
+	var lines []string
+	for i, subsystem := range []string{"cpu", "cpuset", "memory"} {
+		dir := path.Join(root, subsystem)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fmt.Sprintf("%d 1 0:%d / %s rw,relatime - cgroup cgroup rw,%s", 30+i, 30+i, dir, subsystem))
+	}
+	setMountInfo(t, root, lines)
+
+	// 没有挂载 pids 和 blkio 时，不设置对应的限制就不影响容器运行
+	res := &ResourceConfig{MemoryLimit: 100 << 20}
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Set("test", res); err != nil {
+			t.Fatalf("%s Set 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.Apply("test", 1234); err != nil {
+			t.Fatalf("%s Apply 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.GetStats("test", &Stats{}); err != nil && subSysIns.Name() == "pids" {
+			t.Fatalf("%s GetStats 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.Remove("test"); err != nil {
+			t.Fatalf("%s Remove 失败: %v", subSysIns.Name(), err)
+		}
+	}
+
+	if err := (&PidsSubSystem{}).Set("test", &ResourceConfig{PidsLimit: 100}); err == nil {
+		t.Error("没有挂载 pids 子系统时设置进程数限制期望报错")
+	}
+	io := &IoSubSystem{}
+	if err := io.Set("test", &ResourceConfig{BlkioDeviceReadBps: []*ThrottleDevice{{Major: 8, Rate: 1}}}); err == nil {
+		t.Error("没有挂载 blkio 子系统时设置设备限速期望报错")
+	}
+}
+
+func TestOOMKills(t *testing.T) {
+	cases := []struct {
+		name   string
+		fake   func(t *testing.T) string
+		dir    string
+		file   string
+		events string
+		want   uint64
+	}{
+		{name: "v1", fake: fakeCgroupV1, dir: "memory/test", file: "memory.oom_control", events: "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n", want: 2},
+		{name: "v1 旧内核", fake: fakeCgroupV1, dir: "memory/test", file: "memory.oom_control", events: "oom_kill_disable 0\nunder_oom 0\n", want: 0},
+		{name: "v2", fake: fakeCgroupV2, dir: "test", file: "memory.events", events: "low 0\nhigh 0\nmax 5\noom 1\noom_kill 1\n", want: 1},
+	}
+	for _, c := range cases {
+		root := c.fake(t)
+		dir := path.Join(root, c.dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, c.file), []byte(c.events), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// 其他子系统的统计文件都不存在，不影响读取 OOM 事件
+		got, err := OOMKills("test")
+		if err != nil {
+			t.Errorf("%s: OOMKills 失败: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: OOMKills = %d, 期望 %d", c.name, got, c.want)
+		}
+	}
+
+	// cgroup 已经被删除时返回 0
+	fakeCgroupV2(t)
+	if got, err := OOMKills("missing"); err != nil || got != 0 {
+		t.Errorf("cgroup 不存在时 OOMKills = %d, %v，期望 0", got, err)
+	}
+}
+
+func TestCgroupV1EmptyResourceConfig(t *testing.T) {
+	root := fakeCgroupV1(t)
+	// 宿主机上 cpuset 根 cgroup 的配置，新建的子 cgroup 中这两个文件为空
+	for file, content := range map[string]string{"cpuset.cpus": "0-3\n", "cpuset.mems": "0\n"} {
+		if err := ioutil.WriteFile(path.Join(root, "cpuset", file), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(path.Join(root, "cpuset", "MiniDocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+		if err := ioutil.WriteFile(path.Join(root, "cpuset", "MiniDocker", file), []byte("\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 没有设置任何资源限制时也要能把进程加入 cgroup
+	res := &ResourceConfig{}
+	for _, subSysIns := range SubsystemsIns {
+		if err := subSysIns.Set("MiniDocker/test", res); err != nil {
+			t.Fatalf("%s Set 失败: %v", subSysIns.Name(), err)
+		}
+		if err := subSysIns.Apply("MiniDocker/test", 1234); err != nil {
+			t.Fatalf("%s Apply 失败: %v", subSysIns.Name(), err)
+		}
+	}
+	for _, dir := range []string{"MiniDocker", "MiniDocker/test"} {
+		if got := readCgroupFile(t, path.Join(root, "cpuset", dir, "cpuset.cpus")); got != "0-3" {
+			t.Errorf("%s 的 cpuset.cpus = %q，期望从上一级复制为 0-3", dir, got)
+		}
+		if got := readCgroupFile(t, path.Join(root, "cpuset", dir, "cpuset.mems")); got != "0" {
+			t.Errorf("%s 的 cpuset.mems = %q，期望从上一级复制为 0", dir, got)
+		}
+	}
+	if got := readCgroupFile(t, path.Join(root, "cpuset", "MiniDocker", "test", "tasks")); got != "1234" {
+		t.Errorf("tasks = %q，期望 1234", got)
+	}
+}
+
+func TestResetLimits(t *testing.T) {
+	limited := &ResourceConfig{MemoryLimit: 100 << 20, CpuShare: 512, CpuSet: "0", CpuPeriod: DefaultCpuPeriod, CpuQuota: 50000}
+	cases := []struct {
+		name   string
+		fake   func(t *testing.T) string
+		checks map[string]string
+	}{
+		{name: "v1", fake: fakeCgroupV1, checks: map[string]string{
+			"memory/test/memory.limit_in_bytes": "-1",
+			"cpu/test/cpu.shares":               "1024",
+			"cpu/test/cpu.cfs_quota_us":         "-1",
+			"cpuset/test/cpuset.cpus":           "0-3",
+		}},
+		{name: "v2", fake: fakeCgroupV2, checks: map[string]string{
+			"test/memory.max":  "max",
+			"test/cpu.weight":  "100",
+			"test/cpu.max":     "max",
+			"test/cpuset.cpus": "",
+		}},
+	}
+	for _, c := range cases {
+		root := c.fake(t)
+		if err := ioutil.WriteFile(path.Join(root, "cpuset", "cpuset.cpus"), []byte("0-3\n"), 0644); err != nil && c.name == "v1" {
+			t.Fatal(err)
+		}
+		// 先设置限制，再用空的资源配置取消，update 取消限制时就是这样调用的
+		for _, res := range []*ResourceConfig{limited, {}} {
+			for _, subSysIns := range SubsystemsIns {
+				if err := subSysIns.Set("test", res); err != nil {
+					t.Fatalf("%s: %s Set 失败: %v", c.name, subSysIns.Name(), err)
+				}
+			}
+		}
+		for file, want := range c.checks {
+			if got := readCgroupFile(t, path.Join(root, file)); got != want {
+				t.Errorf("%s: 取消限制后 %s = %q, 期望 %q", c.name, file, got, want)
+			}
+		}
+	}
+}
@@ -2,45 +2,166 @@ package subsystems
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
 )
 
-// FindCgroupMountpoint 查找指定子系统的 cgroup 挂载点
-// 参数 subsystem：子系统的名称（如 "cpu", "memory", "cpuset" 等）
-// 返回值：子系统的挂载点路径，找不到时返回空字符串
-func FindCgroupMountpoint(subsystem string) string {
-	// 打开 /proc/self/mountinfo 文件，这是 Linux 系统的挂载信息
-	f, err := os.Open("/proc/self/mountinfo")
+// errNotMounted 宿主机上没有挂载某个子系统，pids、blkio 等子系统在一些 cgroup v1 宿主机上没有挂载
+var errNotMounted = errors.New("子系统没有挂载")
+
+// mountInfoPath 挂载信息文件的路径
+// 测试时可以替换成一个伪造的 mountinfo，从而把 cgroup 根目录指向临时目录
+var mountInfoPath = "/proc/self/mountinfo"
+
+// mountInfo 是 /proc/self/mountinfo 中一行挂载信息里我们关心的字段
+type mountInfo struct {
+	mountPoint   string // 挂载点
+	fsType       string // 文件系统类型，如 "cgroup"、"cgroup2"
+	superOptions string // 超级块选项，cgroup v1 在这里列出子系统名
+}
+
+// parseMountInfo 读取并解析 mountinfo 文件
+// 每行格式：id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+func parseMountInfo() ([]mountInfo, error) {
+	f, err := os.Open(mountInfoPath)
 	if err != nil {
-		return ""
+		return nil, err
 	}
 	defer f.Close()
 
-	// 按行读取 mountinfo
+	var mounts []mountInfo
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		txt := scanner.Text()             // 获取每一行的挂载信息
-		fields := strings.Split(txt, " ") // 将每行信息按空格拆分为字段
+		fields := strings.Split(scanner.Text(), " ")
+		// 找到可选字段与文件系统字段之间的分隔符 "-"
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+1 >= len(fields) {
+			continue
+		}
+		m := mountInfo{
+			mountPoint: fields[4],
+			fsType:     fields[sep+1],
+		}
+		if sep+3 < len(fields) {
+			m.superOptions = fields[sep+3]
+		}
+		mounts = append(mounts, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
 
-		// 遍历字段中最后一列，查找包含指定子系统名的挂载项
-		for _, opt := range strings.Split(fields[len(fields)-1], ",") {
+// FindCgroupMountpoint 查找指定子系统的 cgroup 挂载点
+// 参数 subsystem：子系统的名称（如 "cpu", "memory", "cpuset" 等）
+// 返回值：子系统的挂载点路径，找不到时返回空字符串
+// 在 cgroup v2（unified hierarchy）下，所有子系统共用同一个挂载点
+func FindCgroupMountpoint(subsystem string) string {
+	if IsCgroup2UnifiedMode() {
+		return FindCgroup2Mountpoint()
+	}
+	mounts, err := parseMountInfo()
+	if err != nil {
+		return ""
+	}
+	for _, m := range mounts {
+		if m.fsType != "cgroup" {
+			continue
+		}
+		// cgroup v1 的超级块选项中列出了挂载到该层级的子系统，例如 "rw,cpu,cpuacct"
+		for _, opt := range strings.Split(m.superOptions, ",") {
 			if opt == subsystem {
-				return fields[4] // 返回 cgroup 的挂载点路径
+				return m.mountPoint
 			}
 		}
 	}
+	return ""
+}
 
-	// 如果有错误发生，返回空字符串
-	if err := scanner.Err(); err != nil {
+// FindCgroup2Mountpoint 查找 cgroup v2 文件系统的挂载点，找不到时返回空字符串
+func FindCgroup2Mountpoint() string {
+	mounts, err := parseMountInfo()
+	if err != nil {
 		return ""
 	}
-
+	for _, m := range mounts {
+		if m.fsType == "cgroup2" {
+			return m.mountPoint
+		}
+	}
 	return ""
 }
 
+// Hierarchy 宿主机上挂载的一个 cgroup 层级
+type Hierarchy struct {
+	Mountpoint string // 挂载点，例如 /sys/fs/cgroup/cpu,cpuacct
+	FsType     string // cgroup 或 cgroup2（混合模式下的 unified 层级）
+	Options    string // 超级块选项，例如 "rw,cpu,cpuacct"
+}
+
+// CgroupHierarchies 列出宿主机上挂载的所有 cgroup 层级，同一个层级挂载了多次时只保留第一次
+func CgroupHierarchies() ([]Hierarchy, error) {
+	mounts, err := parseMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	var hierarchies []Hierarchy
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		if m.fsType != "cgroup" && m.fsType != "cgroup2" {
+			continue
+		}
+		key := m.fsType + " " + m.superOptions
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		hierarchies = append(hierarchies, Hierarchy{Mountpoint: m.mountPoint, FsType: m.fsType, Options: m.superOptions})
+	}
+	return hierarchies, nil
+}
+
+// IsCgroup2UnifiedMode 判断宿主机是否只使用 cgroup v2（unified hierarchy）
+// 只有挂载了 cgroup2 并且没有任何 cgroup v1 层级时才认为是 v2 模式，
+// 混合模式（v1 子系统 + /sys/fs/cgroup/unified）仍然按 v1 处理
+func IsCgroup2UnifiedMode() bool {
+	mounts, err := parseMountInfo()
+	if err != nil {
+		return false
+	}
+	hasV2 := false
+	for _, m := range mounts {
+		switch m.fsType {
+		case "cgroup":
+			return false
+		case "cgroup2":
+			hasV2 = true
+		}
+	}
+	return hasV2
+}
+
+// ProcsFile 返回将进程加入 cgroup 时需要写入的文件名
+// v1 使用 tasks，v2 使用 cgroup.procs
+func ProcsFile() string {
+	if IsCgroup2UnifiedMode() {
+		return "cgroup.procs"
+	}
+	return "tasks"
+}
+
 // GetCgroupPath 获取指定子系统的 cgroup 路径
 // 参数 subsystem：子系统名称（如 "cpu", "memory", "cpuset"）
 // 参数 cgroupPath：子系统下的 cgroup 路径（如 "my_cgroup"）
@@ -49,21 +170,86 @@ func FindCgroupMountpoint(subsystem string) string {
 func GetCgroupPath(subsystem string, cgroupPath string, autoCreate bool) (string, error) {
 	// 获取该子系统的挂载点路径
 	cgroupRoot := FindCgroupMountpoint(subsystem)
+	if cgroupRoot == "" {
+		return "", fmt.Errorf("未找到子系统 %s 的 cgroup 挂载点: %w", subsystem, errNotMounted)
+	}
 
 	// 判断 cgroupPath 是否存在
 	if _, err := os.Stat(path.Join(cgroupRoot, cgroupPath)); err == nil || (autoCreate && os.IsNotExist(err)) {
 		// 如果路径不存在且允许自动创建，则创建该 cgroup 路径
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(path.Join(cgroupRoot, cgroupPath), 0755); err == nil {
-				// 创建成功，返回路径
-			} else {
+			if err := os.MkdirAll(path.Join(cgroupRoot, cgroupPath), 0755); err != nil {
 				return "", fmt.Errorf("创建 cgroup 失败: %v", err)
 			}
 		}
+		// v2 下子系统需要在每一级父 cgroup 的 cgroup.subtree_control 中开启才能使用
+		if autoCreate && IsCgroup2UnifiedMode() {
+			if err := enableCgroup2Controller(cgroupRoot, cgroupPath, subsystem); err != nil {
+				logrus.Warnf("开启 cgroup v2 控制器 %s 失败: %v", subsystem, err)
+			}
+		}
 		// 返回 cgroup 的绝对路径
 		return path.Join(cgroupRoot, cgroupPath), nil
 	} else {
 		// 如果路径已存在或发生其他错误，返回错误信息
-		return "", fmt.Errorf("获取 cgroup 路径失败: %v", err)
+		return "", fmt.Errorf("获取 cgroup 路径失败: %w", err)
+	}
+}
+
+// resetCgroupFile 取消资源限制时把 cgroup 文件恢复为不限制的值，update 取消之前设置的限制时才能生效
+// 文件不存在（v2 下对应的控制器没有开启）时没有限制需要取消，直接跳过
+func resetCgroupFile(dir string, file string, value string) error {
+	if _, err := os.Stat(path.Join(dir, file)); os.IsNotExist(err) {
+		return nil
+	}
+	return ioutil.WriteFile(path.Join(dir, file), []byte(value), 0644)
+}
+
+// ignoreNotExist 忽略 cgroup 目录不存在的错误
+// v2 下所有子系统共用同一个目录，删除时后执行的子系统会发现目录已经不存在；没有挂载的子系统也没有目录需要删除
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, errNotMounted) {
+		return nil
+	}
+	return err
+}
+
+// skipNotMounted 可选的子系统（pids、blkio/io）没有挂载时跳过，不影响其他子系统
+// required 为 true 表示用户设置了这个子系统的限制，这时仍然返回错误
+func skipNotMounted(err error, required bool) error {
+	if errors.Is(err, errNotMounted) && !required {
+		return nil
+	}
+	return err
+}
+
+// enableCgroup2Controller 从 cgroup v2 根目录开始，依次在 cgroupPath 的每一级父目录中
+// 向 cgroup.subtree_control 写入 "+controller"，使该控制器在目标 cgroup 中可用
+func enableCgroup2Controller(cgroupRoot string, cgroupPath string, controller string) error {
+	dir := cgroupRoot
+	parts := strings.Split(strings.Trim(path.Clean(cgroupPath), "/"), "/")
+	for _, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		controlFile := path.Join(dir, "cgroup.subtree_control")
+		content, err := ioutil.ReadFile(controlFile)
+		if err != nil {
+			return err
+		}
+		enabled := false
+		for _, c := range strings.Fields(string(content)) {
+			if c == controller {
+				enabled = true
+				break
+			}
+		}
+		if !enabled {
+			if err := ioutil.WriteFile(controlFile, []byte("+"+controller), 0644); err != nil {
+				return err
+			}
+		}
+		dir = path.Join(dir, part)
 	}
+	return nil
 }
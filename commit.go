@@ -2,45 +2,253 @@ package main
 
 import (
 	"MiniDocker/container"
-	"context"
-	"errors"
+	"MiniDocker/image"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
+	"strings"
 	"time"
 )
 
-func commitContainer(containerName string, imageName string) {
-	mntURL := fmt.Sprintf(container.MntURL, containerName) // 挂载点路径
-	imageTar := container.RootURL + "/" + imageName + ".tar"
+// commitOptions commit 命令的选项
+type commitOptions struct {
+	Message string   // 提交说明，记录在镜像历史中
+	Author  string   // 作者
+	Changes []string // 对镜像配置的修改，格式与 Dockerfile 指令相同，例如 CMD ["sh"]、ENV KEY=value
+}
+
+// commitContainer 将容器的修改提交为新的镜像，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+// 只打包容器 overlay 的 upper 目录作为新的一层，新镜像由父镜像的各层加上这一层组成
+func commitContainer(containerRef string, imageName string, opts commitOptions) error {
+	info, err := resolveContainer(containerRef)
+	if err != nil {
+		return fmt.Errorf("获取容器信息失败: %v", err)
+	}
+	parentRef := info.ImageID
+	if parentRef == "" {
+		parentRef = info.Image
+	}
+	parent, err := image.Get(parentRef)
+	if err != nil {
+		return fmt.Errorf("获取容器 %s 的镜像失败: %v", info.Name, err)
+	}
+	layers, err := parentLayers(parent)
+	if err != nil {
+		return err
+	}
+	config, err := parent.Config()
+	if err != nil {
+		return fmt.Errorf("读取镜像 %s 的 config 失败: %v", parent.Reference(), err)
+	}
+	for _, change := range opts.Changes {
+		if err := applyConfigChange(&config.Config, change); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("正在提交容器 %s 的修改", info.Name)
+	diffID, size, err := createDiffLayer(info.Name, info.UserNamespace)
+	if err != nil {
+		return fmt.Errorf("打包容器 %s 的修改失败: %v", info.Name, err)
+	}
+	layers = append(layers, diffID)
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	config.Created = now
+	config.Author = opts.Author
+	config.RootFS = image.RootFS{Type: "layers", DiffIDs: layers}
+	config.History = append(config.History, image.History{
+		Created:   now,
+		CreatedBy: "MiniDocker commit " + info.Name,
+		Author:    opts.Author,
+		Comment:   opts.Message,
+	})
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	img, err := image.RegisterConfig([]string{imageName}, content, layers, parent.Size+size, parent.ID)
+	if err != nil {
+		return fmt.Errorf("登记镜像 %s 失败: %v", imageName, err)
+	}
+	logrus.Infof("容器 %s 已成功提交为镜像 %s，ID: %s", info.Name, img.Reference(), img.ShortID())
+	return nil
+}
 
-	// 构造 tar 命令，排除 proc、sys、dev
-	cmdArgs := []string{
-		"-czf", imageTar,
-		"--exclude=proc", "--exclude=sys", "--exclude=dev",
-		"-C", mntURL, ".",
+// parentLayers 返回父镜像的各层 diff_id
+// 单个 tar 包的镜像没有分层，把整个 tar 包作为一层保存到层存储中
+func parentLayers(img *image.Image) ([]string, error) {
+	if len(img.Layers) > 0 {
+		return img.Layers, nil
+	}
+	diffID, err := image.DiffID(img.Tarball)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeLayerFile(diffID, img.Tarball); err != nil {
+		return nil, err
 	}
+	return []string{diffID}, nil
+}
 
-	// 设置超时（例如 60 秒）
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
+// createDiffLayer 将容器的 upper 目录打包成镜像层并保存到层存储中，返回它的 diff_id 和大小
+// overlayfs 的 whiteout 在打包时转换成 OCI 的格式，运行在用户命名空间中的容器的文件属主换算回容器中的 uid/gid
+func createDiffLayer(containerName string, userns *container.UserNamespace) (string, int64, error) {
+	if container.IsCopiedRootfs(containerName) {
+		return "", 0, fmt.Errorf("容器 %s 的根文件系统是复制出来的（rootless 模式下没有可用的 overlay 文件系统），修改没有单独记录，无法提交", containerName)
+	}
+	return createDirLayer(container.UpperDir(containerName), userns)
+}
 
-	cmd := exec.CommandContext(ctx, "tar", cmdArgs...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// createDirLayer 将目录打包成镜像层并保存到层存储中，返回它的 diff_id 和大小
+// userns 不为 nil 时文件属主按它的映射换算回容器中的 uid/gid
+func createDirLayer(dir string, userns *container.UserNamespace) (string, int64, error) {
+	tmpFile, err := ioutil.TempFile("", "MiniDocker-layer-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	h := sha256.New()
+	if err := container.TarWithUserNamespace(dir, io.MultiWriter(tmpFile, h), userns); err != nil {
+		return "", 0, err
+	}
+	diffID := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	size, err := tmpFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := storeLayerFile(diffID, tmpFile.Name()); err != nil {
+		return "", 0, err
+	}
+	return diffID, size, nil
+}
 
-	logrus.Infof("正在打包容器 %s 到镜像 %s", containerName, imageTar)
+// storeLayerFile 把镜像层文件（可能经过压缩的 tar 包）解压到层存储中，同时保存原始文件
+func storeLayerFile(diffID string, file string) error {
+	err := image.CreateLayer(diffID, func(dir string) error {
+		return container.UnpackLayer(file, dir)
+	})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := image.SaveLayerTarball(diffID, f); err != nil {
+		return fmt.Errorf("保存镜像层 %s 失败: %v", diffID, err)
+	}
+	return nil
+}
 
-	if err := cmd.Run(); err != nil {
-		// 检查是否是超时
-		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-			logrus.Errorf("压缩命令超时")
+// applyConfigChange 按 Dockerfile 指令的格式修改镜像配置，支持 CMD、ENTRYPOINT、ENV、WORKDIR、USER 和 EXPOSE
+func applyConfigChange(config *image.ContainerConfig, change string) error {
+	instruction, args, _ := strings.Cut(strings.TrimSpace(change), " ")
+	args = strings.TrimSpace(args)
+	switch strings.ToUpper(instruction) {
+	case "CMD", "ENTRYPOINT":
+		cmd, err := parseCommandArgs(args)
+		if err != nil {
+			return fmt.Errorf("解析 %s 失败: %v", change, err)
+		}
+		if strings.ToUpper(instruction) == "CMD" {
+			config.Cmd = cmd
 		} else {
-			logrus.Errorf("压缩失败: %v", err)
+			config.Entrypoint = cmd
+		}
+	case "ENV":
+		envs, err := parseEnvArgs(args)
+		if err != nil {
+			return fmt.Errorf("解析 %s 失败: %v", change, err)
+		}
+		config.Env = mergeEnv(config.Env, envs)
+	case "WORKDIR":
+		if !path.IsAbs(args) {
+			return fmt.Errorf("解析 %s 失败: 工作目录必须是绝对路径", change)
+		}
+		config.WorkingDir = path.Clean(args)
+	case "USER":
+		if args == "" {
+			return fmt.Errorf("解析 %s 失败: 缺少用户", change)
+		}
+		config.User = args
+	case "EXPOSE":
+		ports := strings.Fields(args)
+		if len(ports) == 0 {
+			return fmt.Errorf("解析 %s 失败: 缺少端口", change)
+		}
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range ports {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			config.ExposedPorts[port] = struct{}{}
+		}
+	default:
+		return fmt.Errorf("不支持的配置修改 %q，只支持 CMD、ENTRYPOINT、ENV、WORKDIR、USER 和 EXPOSE", change)
+	}
+	return nil
+}
+
+// parseCommandArgs 解析 CMD 的参数，JSON 数组形式原样使用，否则视为 shell 形式，通过 /bin/sh -c 执行
+func parseCommandArgs(args string) ([]string, error) {
+	if strings.HasPrefix(args, "[") {
+		var cmd []string
+		if err := json.Unmarshal([]byte(args), &cmd); err != nil {
+			return nil, err
 		}
-		return
+		return cmd, nil
 	}
+	if args == "" {
+		return nil, fmt.Errorf("缺少命令")
+	}
+	return []string{"/bin/sh", "-c", args}, nil
+}
 
-	logrus.Infof("容器 %s 已成功提交为镜像 %s", containerName, imageTar)
+// parseEnvArgs 解析 ENV 的参数，支持 "KEY=value KEY2=value2" 和 "KEY value" 两种格式
+func parseEnvArgs(args string) ([]string, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("缺少环境变量")
+	}
+	if !strings.Contains(fields[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		return []string{key + "=" + strings.TrimSpace(value)}, nil
+	}
+	for _, field := range fields {
+		if !strings.Contains(field, "=") {
+			return nil, fmt.Errorf("环境变量 %s 的格式错误，应为 KEY=value", field)
+		}
+	}
+	return fields, nil
+}
+
+// mergeEnv 将 envs 合并到 base 中，同名的环境变量以 envs 中的为准
+func mergeEnv(base []string, envs []string) []string {
+	merged := append([]string{}, base...)
+	for _, env := range envs {
+		key, _, _ := strings.Cut(env, "=")
+		replaced := false
+		for i, old := range merged {
+			if oldKey, _, _ := strings.Cut(old, "="); oldKey == key {
+				merged[i] = env
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, env)
+		}
+	}
+	return merged
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"reflect"
+	"testing"
+)
+
+func TestApplyConfigChange(t *testing.T) {
+	config := &image.ContainerConfig{
+		Cmd: []string{"sh"},
+		Env: []string{"PATH=/bin", "DEBUG=0"},
+	}
+	changes := []string{
+		`CMD ["top", "-b"]`,
+		"ENV DEBUG=1 LANG=C",
+		"env GREETING hello world",
+		"WORKDIR /app/",
+		"USER nobody",
+		"EXPOSE 80 53/udp",
+	}
+	for _, change := range changes {
+		if err := applyConfigChange(config, change); err != nil {
+			t.Fatalf("applyConfigChange(%q) 失败: %v", change, err)
+		}
+	}
+	if want := []string{"top", "-b"}; !reflect.DeepEqual(config.Cmd, want) {
+		t.Errorf("Cmd = %v, 期望 %v", config.Cmd, want)
+	}
+	if want := []string{"PATH=/bin", "DEBUG=1", "LANG=C", "GREETING=hello world"}; !reflect.DeepEqual(config.Env, want) {
+		t.Errorf("Env = %v, 期望 %v", config.Env, want)
+	}
+
+	if config.WorkingDir != "/app" || config.User != "nobody" {
+		t.Errorf("WorkingDir = %q, User = %q", config.WorkingDir, config.User)
+	}
+	if _, ok := config.ExposedPorts["53/udp"]; !ok || len(config.ExposedPorts) != 2 {
+		t.Errorf("ExposedPorts = %v", config.ExposedPorts)
+	}
+
+	if err := applyConfigChange(config, "CMD echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/bin/sh", "-c", "echo hi"}; !reflect.DeepEqual(config.Cmd, want) {
+		t.Errorf("shell 形式的 Cmd = %v, 期望 %v", config.Cmd, want)
+	}
+
+	for _, change := range []string{"RUN ls", "CMD", `CMD ["sh"`, "ENV A=1 B", "WORKDIR app"} {
+		if err := applyConfigChange(config, change); err == nil {
+			t.Errorf("applyConfigChange(%q) 期望报错", change)
+		}
+	}
+}
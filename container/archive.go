@@ -0,0 +1,419 @@
+package container
+
+import (
+	"MiniDocker/image"
+	"archive/tar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// WhiteoutPrefix OCI 镜像层中表示删除文件的前缀，.wh.<name> 表示下层的 <name> 被删除
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaqueDir OCI 镜像层中表示不透明目录的文件名，所在目录屏蔽下层同名目录中的全部内容
+	WhiteoutOpaqueDir = ".wh..wh..opq"
+	// whiteoutMetaPrefix aufs 使用的其他元数据文件前缀，例如 .wh..wh.plnk，解压时直接忽略
+	whiteoutMetaPrefix = ".wh..wh."
+	// opaqueXattr overlayfs 标记不透明目录的扩展属性
+	opaqueXattr = "trusted.overlay.opaque"
+	// paxXattrPrefix tar 包中保存扩展属性的 PAX 记录前缀
+	paxXattrPrefix = "SCHILY.xattr."
+	// maxSymlinks 解析路径时最多跟随的符号链接数，与内核的限制一致
+	maxSymlinks = 40
+)
+
+// Untar 将镜像层的 tar 流（可能经过 gzip 压缩）解压到 dir 目录
+// OCI 的 whiteout 文件会转换成 overlayfs 的格式：.wh.<name> 转换为设备号 0/0 的字符设备，
+// .wh..wh..opq 转换为所在目录的 trusted.overlay.opaque=y 扩展属性，rootless 模式下为 user.overlay.opaque=y。
+// 所有路径（包括路径中的符号链接）都限制在 dir 之内，避免镜像层写到宿主机的其他位置
+func Untar(r io.Reader, dir string) error {
+	stream, err := image.DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	// 目录的修改时间在目录内容解压完成后再设置，否则会被解压子项时的修改覆盖
+	type dirTime struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []dirTime
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		parent, err := resolveInRoot(dir, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("解析 %s 失败: %v", hdr.Name, err)
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+
+		base := filepath.Base(name)
+		switch {
+		case base == WhiteoutOpaqueDir:
+			if err := unix.Lsetxattr(parent, overlayOpaqueXattr(), []byte("y"), 0); err != nil {
+				return fmt.Errorf("设置不透明目录 %s 失败: %v", filepath.Dir(name), err)
+			}
+			continue
+		case strings.HasPrefix(base, whiteoutMetaPrefix):
+			continue
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			target := filepath.Join(parent, strings.TrimPrefix(base, WhiteoutPrefix))
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := unix.Mknod(target, unix.S_IFCHR, 0); err != nil {
+				return fmt.Errorf("创建 whiteout 文件 %s 失败: %v", target, err)
+			}
+			continue
+		}
+
+		target := filepath.Join(parent, base)
+		// 同一路径在 tar 包中出现多次时以后出现的为准，只有目录会被保留下来合并内容
+		if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		if err := createTarEntry(dir, target, hdr, tr); err != nil {
+			return fmt.Errorf("解压 %s 失败: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTime{path: target, hdr: hdr})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setFileTime(dirs[i].path, dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTarEntry 根据 tar 包中的一项在 target 创建对应的文件，并恢复属主、权限、扩展属性和修改时间
+func createTarEntry(root string, target string, hdr *tar.Header, r io.Reader) error {
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		source, err := resolveLinkSource(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		fileType := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			fileType = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			fileType = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(target, fileType|uint32(mode.Perm()), dev); err != nil {
+			// 普通用户不能创建设备文件，rootless 模式下跳过，容器的 /dev 是单独挂载的
+			if Rootless() && hdr.Typeflag != tar.TypeFifo {
+				logrus.Warnf("rootless 模式下无法创建设备文件 %s，跳过", hdr.Name)
+				return nil
+			}
+			return err
+		}
+	default:
+		logrus.Warnf("跳过镜像层中不支持的文件类型 %c: %s", hdr.Typeflag, hdr.Name)
+		return nil
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		attr := strings.TrimPrefix(key, paxXattrPrefix)
+		if !allowedXattr(attr) {
+			logrus.Warnf("跳过 %s 的扩展属性 %s", hdr.Name, attr)
+			continue
+		}
+		if err := unix.Lsetxattr(target, attr, []byte(value), 0); err != nil {
+			logrus.Warnf("设置 %s 的扩展属性 %s 失败: %v", hdr.Name, attr, err)
+		}
+	}
+	// 硬链接与原文件共用 inode，符号链接本身没有权限
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		return nil
+	case tar.TypeSymlink:
+		return setFileTime(target, hdr)
+	}
+	// chown 会清除 setuid 位，所以权限放在 chown 之后设置
+	if err := os.Chmod(target, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setFileTime(target, hdr)
+}
+
+// allowedXattr 判断镜像层中的扩展属性能否设置到解压出的文件上，只允许 user.* 和文件能力 security.capability
+// trusted.overlay.*（rootless 模式下为 user.overlay.*）会被 overlayfs 当作不透明目录、重定向等标记，
+// 其他 security.* 会修改宿主机上的安全标签，都不能由镜像层决定
+func allowedXattr(attr string) bool {
+	if attr == "security.capability" {
+		return true
+	}
+	return strings.HasPrefix(attr, "user.") && !strings.HasPrefix(attr, "user.overlay.")
+}
+
+// setFileTime 恢复文件的访问时间和修改时间，不跟随符号链接
+func setFileTime(target string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// resolveLinkSource 解析硬链接指向的文件，只在 root 内解析上级目录中的符号链接，文件本身不能是符号链接：
+// 链接到符号链接时各个实现的行为不一致，可能被用来链接到 root 之外的文件
+func resolveLinkSource(root string, linkname string) (string, error) {
+	name := filepath.Clean("/" + linkname)
+	if name == "/" {
+		return "", fmt.Errorf("硬链接 %s 不能指向根目录", linkname)
+	}
+	parent, err := resolveInRoot(root, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	source := filepath.Join(parent, filepath.Base(name))
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("硬链接 %s 不能指向符号链接", linkname)
+	}
+	return source, nil
+}
+
+// resolveInRoot 在 root 目录内解析路径 name，路径中的符号链接都相对 root 解析，
+// 绝对路径的符号链接和 ".." 都不会超出 root，效果类似在 chroot 之后解析路径
+func resolveInRoot(root string, name string) (string, error) {
+	rest := strings.Split(filepath.Clean("/"+name), "/")
+	resolved := "/"
+	links := 0
+	for len(rest) > 0 {
+		part := rest[0]
+		rest = rest[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("路径 %s 中的符号链接层数过多", name)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(link, "/"), rest...)
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// Tar 将 dir 目录打包成 tar 流写入 w，是 Untar 的逆过程
+// overlayfs 的 whiteout（设备号 0/0 的字符设备）转换为 .wh.<name>，
+// 带有 trusted.overlay.opaque=y 扩展属性的目录在目录项之后追加 .wh..wh..opq，
+// 这样容器的 upper 目录打包后就是一个标准的 OCI 镜像层。
+// excludes 为相对 dir 的目录，只打包目录本身而跳过其中的内容，例如导出容器时的 proc、sys 和 dev
+func Tar(dir string, w io.Writer, excludes ...string) error {
+	return TarWithUserNamespace(dir, w, nil, excludes...)
+}
+
+// TarWithUserNamespace 与 Tar 相同，打包的是运行在用户命名空间中的容器的文件，
+// tar 包中记录的属主按 userns 的映射从宿主机上的 uid/gid 换算回容器中的 uid/gid，userns 为 nil 时不换算
+func TarWithUserNamespace(dir string, w io.Writer, userns *UserNamespace, excludes ...string) error {
+	skip := map[string]bool{}
+	for _, exclude := range excludes {
+		skip[filepath.Clean(strings.TrimPrefix(exclude, "/"))] = true
+	}
+	tw := tar.NewWriter(w)
+	// 记录已经写入的硬链接文件，同一个文件之后再出现时写成硬链接
+	inodes := map[fileID]string{}
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if err := writeTarEntry(tw, file, rel, fi, inodes, userns); err != nil {
+			return err
+		}
+		if fi.IsDir() && skip[rel] {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// fileID 用设备号和 inode 号唯一确定一个文件，rootfs 下绑定挂载的数据卷与 rootfs 不在同一个设备上，inode 号可能相同
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// writeTarEntry 把一个文件写入 tar 包，name 是文件在 tar 包中的路径
+// tar 格式不能表示 unix socket，与 docker export 一样直接跳过，socket 在容器重新启动时由创建它的程序重新创建
+func writeTarEntry(tw *tar.Writer, file string, name string, fi os.FileInfo, inodes map[fileID]string, userns *UserNamespace) error {
+	if fi.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	stat, _ := fi.Sys().(*syscall.Stat_t)
+	if fi.Mode()&os.ModeCharDevice != 0 && stat != nil && stat.Rdev == 0 {
+		return tw.WriteHeader(&tar.Header{
+			Name:     filepath.Join(filepath.Dir(name), WhiteoutPrefix+fi.Name()),
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			ModTime:  fi.ModTime(),
+		})
+	}
+
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// 不记录用户名和访问时间，同样的内容打出来的包尽量保持一致
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if userns != nil {
+		hdr.Uid = toContainer(userns.UidMappings, hdr.Uid)
+		hdr.Gid = toContainer(userns.GidMappings, hdr.Gid)
+	}
+	if stat != nil && fi.Mode().IsRegular() && stat.Nlink > 1 {
+		id := fileID{dev: uint64(stat.Dev), ino: stat.Ino}
+		if first, ok := inodes[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			inodes[id] = name
+		}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if fi.IsDir() && isOpaqueDir(file) {
+		return tw.WriteHeader(&tar.Header{
+			Name:     filepath.Join(name, WhiteoutOpaqueDir),
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			ModTime:  fi.ModTime(),
+		})
+	}
+	return nil
+}
+
+// isOpaqueDir 判断目录是否被 overlayfs 标记为不透明目录，rootless 模式下的标记保存在 user.overlay.opaque 中
+func isOpaqueDir(dir string) bool {
+	buf := make([]byte, 1)
+	for _, attr := range []string{opaqueXattr, rootlessOpaqueXattr} {
+		if n, err := unix.Lgetxattr(dir, attr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
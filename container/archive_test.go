@@ -0,0 +1,402 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+// tarEntry 测试中用来描述 tar 包中的一项
+type tarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+// buildTar 在内存中生成 tar 包
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Linkname: e.linkname, Size: int64(len(e.content))}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// requireWhiteoutSupport 创建 whiteout 需要 root 权限以及支持 trusted 扩展属性的文件系统
+func requireWhiteoutSupport(t *testing.T, dir string) {
+	if os.Geteuid() != 0 {
+		t.Skip("需要 root 权限才能创建 whiteout 文件")
+	}
+	if err := unix.Lsetxattr(dir, opaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("文件系统不支持 trusted 扩展属性: %v", err)
+	}
+	unix.Lremovexattr(dir, opaqueXattr)
+}
+
+// isWhiteout 判断文件是否为设备号 0/0 的字符设备
+func isWhiteout(t *testing.T, file string) bool {
+	var stat unix.Stat_t
+	if err := unix.Lstat(file, &stat); err != nil {
+		t.Fatalf("读取 %s 失败: %v", file, err)
+	}
+	return stat.Mode&unix.S_IFMT == unix.S_IFCHR && stat.Rdev == 0
+}
+
+func TestUntarWhiteouts(t *testing.T) {
+	dir := t.TempDir()
+	requireWhiteoutSupport(t, dir)
+
+	layer := buildTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "etc/hostname", typeflag: tar.TypeReg, content: "mini"},
+		{name: "bin/.wh.sh", typeflag: tar.TypeReg},
+		{name: ".wh..wh.plnk", typeflag: tar.TypeDir},
+	})
+	if err := Untar(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isOpaqueDir(filepath.Join(dir, "etc")) {
+		t.Error("etc 应当被标记为不透明目录")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "etc", WhiteoutOpaqueDir)); !os.IsNotExist(err) {
+		t.Error("不应当留下 .wh..wh..opq 文件")
+	}
+	if !isWhiteout(t, filepath.Join(dir, "bin", "sh")) {
+		t.Error("bin/sh 应当是 whiteout 字符设备")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "bin", ".wh.sh")); !os.IsNotExist(err) {
+		t.Error("不应当留下 .wh.sh 文件")
+	}
+	if _, err := os.Lstat(filepath.Join(dir, ".wh..wh.plnk")); !os.IsNotExist(err) {
+		t.Error("aufs 元数据应当被忽略")
+	}
+}
+
+func TestUntarStaysInRoot(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	layer := buildTar(t, []tarEntry{
+		{name: "../../escape", typeflag: tar.TypeReg, content: "x"},
+		{name: "evil", typeflag: tar.TypeSymlink, linkname: outside},
+		{name: "evil/passwd", typeflag: tar.TypeReg, content: "x"},
+		{name: "up", typeflag: tar.TypeSymlink, linkname: "../../.."},
+		{name: "up/hosts", typeflag: tar.TypeReg, content: "x"},
+	})
+	if err := Untar(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := ioutil.ReadDir(outside)
+	if len(entries) != 0 {
+		t.Errorf("镜像层的内容写到了解压目录之外: %v", entries)
+	}
+	for _, name := range []string{"escape", filepath.Join(outside, "passwd"), "hosts"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s 应当被解压到解压目录之内: %v", name, err)
+		}
+	}
+}
+
+func TestUntarHardlinkAndOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	layer := buildTar(t, []tarEntry{
+		{name: "bin/busybox", typeflag: tar.TypeReg, content: "old"},
+		{name: "bin/busybox", typeflag: tar.TypeReg, content: "new"},
+		{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"},
+	})
+	if err := Untar(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "bin", "sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "new" {
+		t.Errorf("bin/sh 的内容为 %q，期望 %q", content, "new")
+	}
+}
+
+func TestUntarHardlinkToSymlink(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "shadow")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, linkname := range []string{"evil", "dir/evil"} {
+		dir := t.TempDir()
+		layer := buildTar(t, []tarEntry{
+			{name: "dir/", typeflag: tar.TypeDir},
+			{name: linkname, typeflag: tar.TypeSymlink, linkname: secret},
+			{name: "stolen", typeflag: tar.TypeLink, linkname: linkname},
+		})
+		if err := Untar(layer, dir); err == nil {
+			t.Errorf("硬链接指向符号链接 %s 时期望报错", linkname)
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, "stolen")); err == nil {
+			t.Errorf("不应该创建指向符号链接的硬链接: %v", fi.Mode())
+		}
+	}
+
+	// 上级目录中的符号链接仍然在解压目录内解析
+	dir := t.TempDir()
+	layer := buildTar(t, []tarEntry{
+		{name: "real/file", typeflag: tar.TypeReg, content: "x"},
+		{name: "alias", typeflag: tar.TypeSymlink, linkname: "/real"},
+		{name: "link", typeflag: tar.TypeLink, linkname: "alias/file"},
+	})
+	if err := Untar(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(dir, "link")); err != nil || string(content) != "x" {
+		t.Errorf("link 的内容为 %q (%v)，期望 %q", content, err, "x")
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	requireWhiteoutSupport(t, dir)
+
+	layer := buildTar(t, []tarEntry{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/.wh..wh..opq", typeflag: tar.TypeReg},
+		{name: "etc/hostname", typeflag: tar.TypeReg, content: "mini"},
+		{name: "bin/.wh.sh", typeflag: tar.TypeReg},
+		{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+	})
+	if err := Untar(layer, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Tar(dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"bin/", "bin/.wh.sh", "etc/", "etc/.wh..wh..opq", "etc/hostname", "lib"}
+	if len(names) != len(expected) {
+		t.Fatalf("打包结果为 %v，期望 %v", names, expected)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("打包结果为 %v，期望 %v", names, expected)
+			break
+		}
+	}
+}
+
+func TestTarExcludes(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{"proc/1/status", "dev/null", "data/volume.txt", "etc/hostname"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := Tar(dir, &buf, "proc", "dev", "/data"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"data/", "dev/", "etc/", "etc/hostname", "proc/"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("打包结果为 %v，期望 %v", names, expected)
+	}
+}
+
+func TestTarSkipsSockets(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmp", "file"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrUnix{Name: filepath.Join(dir, "tmp", "daemon.sock")}); err != nil {
+		t.Skipf("无法创建 unix socket: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Tar(dir, &buf); err != nil {
+		t.Fatalf("包含 socket 的目录打包失败: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	expected := []string{"tmp/", "tmp/file"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("打包结果为 %v，期望 %v", names, expected)
+	}
+}
+
+func TestAllowedXattr(t *testing.T) {
+	cases := map[string]bool{
+		"user.mime_type":           true,
+		"security.capability":      true,
+		"trusted.overlay.opaque":   false,
+		"trusted.overlay.redirect": false,
+		"user.overlay.opaque":      false, // rootless 模式下 overlayfs 使用的标记
+		"security.selinux":         false,
+		"system.posix_acl_access":  false,
+		"trusted.some.other.thing": false,
+	}
+	for attr, want := range cases {
+		if got := allowedXattr(attr); got != want {
+			t.Errorf("allowedXattr(%q) = %v, 期望 %v", attr, got, want)
+		}
+	}
+}
+
+func TestUntarSkipsOverlayXattrs(t *testing.T) {
+	dir := t.TempDir()
+	requireWhiteoutSupport(t, dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:     "data/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			paxXattrPrefix + opaqueXattr:                "y",
+			paxXattrPrefix + "trusted.overlay.redirect": "/etc",
+		},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Untar(&buf, dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, attr := range []string{opaqueXattr, "trusted.overlay.redirect"} {
+		if _, err := unix.Lgetxattr(filepath.Join(dir, "data"), attr, make([]byte, 16)); err == nil {
+			t.Errorf("镜像层中的扩展属性 %s 不应该被设置", attr)
+		}
+	}
+}
+
+// statFileInfo 替换 os.FileInfo 中的设备号、inode 号和链接数，模拟不同设备上 inode 号相同的文件
+type statFileInfo struct {
+	os.FileInfo
+	stat *syscall.Stat_t
+}
+
+func (fi statFileInfo) Sys() interface{} { return fi.stat }
+
+func TestTarHardlinksAcrossDevices(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		name string
+		dev  uint64
+	}{
+		{name: "a", dev: 1},
+		{name: "b", dev: 2}, // 绑定挂载的数据卷中 inode 号相同的另一个文件
+		{name: "c", dev: 1}, // 与 a 是同一个文件的硬链接
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	inodes := map[fileID]string{}
+	for _, f := range files {
+		file := filepath.Join(dir, f.name)
+		if err := ioutil.WriteFile(file, []byte(f.name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := *fi.Sys().(*syscall.Stat_t)
+		stat.Dev, stat.Ino, stat.Nlink = f.dev, 42, 2
+		if err := writeTarEntry(tw, file, f.name, statFileInfo{FileInfo: fi, stat: &stat}, inodes, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "", "b": "", "c": "a"}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Linkname != want[hdr.Name] {
+			t.Errorf("%s 的硬链接目标为 %q，期望 %q", hdr.Name, hdr.Linkname, want[hdr.Name])
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package container
 
 import (
+	"MiniDocker/cgroup/subsystems"
 	"fmt"
-	"github.com/sirupsen/logrus"
 	"os"
 	"os/exec"
 	"syscall"
@@ -19,30 +19,76 @@ var (
 	RootURL             string = "/root"               // 容器根目录
 	MntURL              string = "/root/mnt/%s"        // 容器挂载点目录
 	WriteLayerURL       string = "/root/writeLayer/%s" // 容器写层目录
+	CgroupPathFormat    string = "MiniDocker/%s"       // 容器 cgroup 相对于 cgroup 根目录的路径
 )
 
 // Info 结构体定义了容器的基本信息
-// 包括 PID、ID、名称、命令、创建时间和状态等字段
+// 包括 PID、ID、名称、命令、创建时间和状态等字段，以及完整的运行参数和运行时状态
 type Info struct {
 	Pid         string   `json:"pid"`         // 容器的 init 进程在宿主机上的 PID
 	Id          string   `json:"id"`          // 容器 ID
 	Name        string   `json:"name"`        // 容器名
 	Command     string   `json:"command"`     // 容器内 init 运行命令
+	Args        []string `json:"args"`        // 容器内 init 运行命令的完整参数
+	Image       string   `json:"image"`       // 容器使用的镜像
+	ImageID     string   `json:"imageId"`     // 容器使用的镜像 ID
+	Env         []string `json:"env"`         // 容器的环境变量，由镜像中的环境变量和 -e 设置的环境变量合并而成
+	WorkingDir  string   `json:"workingDir"`  // 容器的工作目录
+	User        string   `json:"user"`        // 运行容器命令的用户
+	Tty         bool     `json:"tty"`         // 是否绑定终端运行
+	ShimPid     int      `json:"shimPid"`     // 后台运行时看护容器的 shim 进程 PID，前台运行时为 0
 	CreatedTime string   `json:"createTime"`  // 创建时间
 	Status      string   `json:"status"`      // 容器的状态
+	Rootfs      string   `json:"rootfs"`      // 容器根文件系统在宿主机上的挂载点
 	Volume      string   `json:"volume"`      // 容器的数据卷
 	PortMapping []string `json:"portMapping"` // 容器的端口映射
+	CgroupPath  string   `json:"cgroupPath"`  // 容器的 cgroup 路径
+	ExitCode    int      `json:"exitCode"`    // 容器 init 进程的退出码，被信号杀死时为 128+信号值
+	OOMKilled   bool     `json:"oomKilled"`   // 容器是否因为超出内存限制被 OOM killer 杀死
+	FinishedAt  string   `json:"finishedAt"`  // 容器退出时间
+	// 容器当前的资源限制，update 命令修改后会同步更新
+	Resource *subsystems.ResourceConfig `json:"resource,omitempty"`
+	// 容器的挂载信息，目前只有 -v 指定的数据卷
+	Mounts []*MountPoint `json:"mounts,omitempty"`
+	// 容器接入的网络端点
+	Networks []*NetworkEndpoint `json:"networks,omitempty"`
+	// 容器的用户命名空间映射，没有启用用户命名空间时为空
+	UserNamespace *UserNamespace `json:"userNamespace,omitempty"`
+	// 容器的 cgroup 命名空间模式，host 或 private
+	CgroupNamespace string `json:"cgroupNamespace,omitempty"`
+	// 容器时间命名空间中的时钟偏移量，没有启用时间命名空间时为空
+	TimeOffsets *TimeOffsets `json:"timeOffsets,omitempty"`
+}
+
+// MountPoint 描述容器中的一个挂载点
+type MountPoint struct {
+	Type        string `json:"type"`        // 挂载类型，例如 bind
+	Source      string `json:"source"`      // 宿主机上的路径
+	Destination string `json:"destination"` // 容器内的路径
+}
+
+// NetworkEndpoint 描述容器接入某个网络的端点
+type NetworkEndpoint struct {
+	Network    string `json:"network"`             // 网络名
+	EndpointID string `json:"endpointId"`          // 端点 ID
+	IPAddress  string `json:"ipAddress"`           // 容器的 IP 地址（CIDR 格式）
+	Gateway    string `json:"gateway"`             // 网关地址
+	HostDevice string `json:"hostDevice"`          // 宿主机一端的 veth 设备名
+	HelperPid  int    `json:"helperPid,omitempty"` // 为端点转发流量的用户态进程，例如 slirp4netns，没有时为 0
 }
 
 // NewParentProcess 创建一个新的父进程（容器的父进程）
 // tty 表示是否启用终端（比如交互式容器就需要）
-// 返回值包括：创建的 cmd 命令对象 和 写入端 writePipe，用于父子进程通信
-func NewParentProcess(tty bool, volume string, containerName string, imageName string, envSlice []string) (*exec.Cmd, *os.File) {
-	// 创建匿名管道：用于父子进程之间通信（传参数或控制信号）
-	readPipe, writePipe, err := NewPipe()
+// 要执行的命令、环境变量、工作目录等由调用者在启动进程之后通过 InitPipes.SendConfig 发给 init 进程，
+// 再通过 InitPipes.WaitExec 等待 init 进程报告用户命令是否执行成功
+// userns 不为 nil 时容器运行在新的用户命名空间中，容器中的 root 映射为宿主机上的普通用户
+// 返回值包括：创建的 cmd 命令对象 和 父子进程之间的同步通道。
+// 出错时已经创建的工作空间不会清理，由调用者通过 DeleteWorkSpace 删除
+func NewParentProcess(tty bool, volume string, containerName string, imageName string, userns *UserNamespace) (*exec.Cmd, *InitPipes, error) {
+	// 创建配置管道和状态管道：用于父子进程之间通信
+	pipes, err := NewInitPipes()
 	if err != nil {
-		logrus.Errorf("管道创建失败: %v", err)
-		return nil, nil
+		return nil, nil, fmt.Errorf("管道创建失败: %v", err)
 	}
 
 	// 获取当前进程的路径（init 进程）
@@ -56,6 +102,17 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 			syscall.CLONE_NEWNET | // 网络隔离
 			syscall.CLONE_NEWIPC, // IPC 隔离
 	}
+	if userns != nil {
+		// 用户命名空间与其他命名空间一起在 clone 时创建，其他命名空间都属于它。
+		// uid_map/gid_map 由 Go 在子进程 exec 之前写入，init 进程开始运行时映射已经生效，
+		// 之后 pivotRoot、挂载 proc 等操作都以容器中的 root 身份进行
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = userns.UidMappings
+		cmd.SysProcAttr.GidMappings = userns.GidMappings
+		// rootless 模式下普通用户只有先禁用 setgroups 才能写入 gid_map，容器中也就不能再调用 setgroups
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = !Rootless()
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: Rootless()}
+	}
 
 	// 如果 tty 为 true，就把子进程的标准输入输出指向当前终端
 	if tty {
@@ -65,16 +122,17 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 	} else {
 		// 创建日志目录
 		dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
-		if err := os.MkdirAll(dirURL, 0622); err != nil {
-			logrus.Errorf("创建目录 %v 失败: %v", dirURL, err)
+		if err := os.MkdirAll(dirURL, 0755); err != nil {
+			pipes.Close()
+			return nil, nil, fmt.Errorf("创建目录 %v 失败: %v", dirURL, err)
 		}
 
 		// 创建日志文件
 		stdLogFilePath := dirURL + ContainerLogFile
 		stdLogFile, err := os.Create(stdLogFilePath)
 		if err != nil {
-			logrus.Errorf("创建日志文件 %v 失败: %v", stdLogFilePath, err)
-			return nil, nil
+			pipes.Close()
+			return nil, nil, fmt.Errorf("创建日志文件 %v 失败: %v", stdLogFilePath, err)
 		}
 
 		// 设置子进程的标准输出和错误输出为日志文件
@@ -84,20 +142,44 @@ func NewParentProcess(tty bool, volume string, containerName string, imageName s
 		// 为非交互式命令提供一个空的输入源
 		devNull, err := os.Open("/dev/null")
 		if err != nil {
-			logrus.Errorf("打开 /dev/null 失败: %v", err)
-			return nil, nil
+			pipes.Close()
+			return nil, nil, fmt.Errorf("打开 /dev/null 失败: %v", err)
 		}
 		cmd.Stdin = devNull
 	}
 
-	// 把管道的读端传递给子进程（子进程从这里读取父进程传过来的数据）
-	cmd.ExtraFiles = []*os.File{readPipe}
-	cmd.Env = append(os.Environ(), envSlice...)    // 设置环境变量
-	NewWorkSpace(volume, imageName, containerName) // 创建工作空间
-	logrus.Infof("传递给容器的环境变量: %v", envSlice)
+	// 把配置管道的读端和状态管道的写端传递给子进程，分别为 fd3 和 fd4
+	cmd.ExtraFiles = pipes.childFiles
+	// 容器的环境变量通过管道传给 init 进程，init 进程本身不继承宿主机的环境变量
+	cmd.Env = []string{}
+	// 创建工作空间
+	if err := NewWorkSpace(volume, imageName, containerName, userns); err != nil {
+		pipes.Close()
+		return nil, nil, err
+	}
 	// 设置子进程的当前工作目录为挂载点目录
 	cmd.Dir = fmt.Sprintf(MntURL, containerName)
-	return cmd, writePipe
+	return cmd, pipes, nil
+}
+
+// StartParentProcess 启动 NewParentProcess 创建的容器进程
+// 启用用户命名空间时子进程切换工作目录时已经是容器中的 root，没有权限访问挂载点路径上属于宿主机 root 的目录
+// （例如权限为 700 的 /root）。这时改为由当前进程临时切换到挂载点再启动子进程，
+// clone 新的 mount 命名空间时内核会把继承来的工作目录换成新命名空间中对应的挂载点，init 进程不需要再查找路径
+func StartParentProcess(cmd *exec.Cmd, userns *UserNamespace) error {
+	if userns == nil {
+		return cmd.Start()
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(cmd.Dir); err != nil {
+		return err
+	}
+	defer os.Chdir(pwd)
+	cmd.Dir = ""
+	return cmd.Start()
 }
 
 // NewPipe 创建一个匿名管道：用于父子进程之间的通信
@@ -3,7 +3,6 @@ package container
 import (
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,119 +12,211 @@ import (
 
 // RunContainerInitProcess 是容器中的第一个进程（PID 为 1）
 // 它的任务是：
-// 1. 设置挂载点（比如挂载 /proc）
-// 2. 读取用户要运行的命令
-// 3. 使用 syscall.Exec 执行这个命令，替换 init 进程本身
+// 1. 从管道中读取父进程发来的配置
+// 2. 按配置创建 cgroup 命名空间和时间命名空间
+// 3. 切换根文件系统，挂载 /proc、/dev 等文件系统，设置主机名
+// 4. 切换到配置中的工作目录和用户，使用 syscall.Exec 执行用户命令，替换 init 进程本身
+// 任何一步失败都通过状态管道（fd4）报告给父进程，由父进程清理现场并返回错误
 func RunContainerInitProcess() error {
-	// 从管道中读取用户传入的命令（通过 ExtraFiles fd[3] 传入）
-	cmdArray := readUserCommand()
-	if cmdArray == nil || len(cmdArray) == 0 {
-		return fmt.Errorf("容器初始化获取用户命令错误，cmdArray 为空")
+	// 状态管道必须在 exec 时关闭，父进程据此知道用户命令已经开始执行
+	syscall.CloseOnExec(4)
+	status := os.NewFile(uintptr(4), "status")
+	defer status.Close()
+
+	if err := initContainer(status); err != nil {
+		reportInitStatus(status, InitStatusErrorPrefix+err.Error())
+		return err
 	}
+	return nil
+}
 
-	// 设置挂载点
-	setUpMount()
-	// 查找要执行命令的绝对路径
-	path, err := exec.LookPath(cmdArray[0])
+// initContainer 按父进程发来的配置初始化容器并执行用户命令，执行成功时不会返回
+func initContainer(status *os.File) error {
+	config, err := readInitConfig()
 	if err != nil {
-		logrus.Errorf("查找路径失败: %v", err)
 		return err
 	}
-	logrus.Infof("找到可执行文件路径: %s", path)
 
-	// 使用 syscall.Exec 替换当前进程为用户指定的命令进程
-	// cmdArray 是命令及其参数，os.Environ() 传入当前环境变量
-	if err := syscall.Exec(path, cmdArray[0:], os.Environ()); err != nil {
-		logrus.Errorf("执行用户命令失败: %v", err)
+	// cgroup 命名空间要在挂载 cgroup 文件系统之前创建，挂载的 cgroup 文件系统才会以容器的 cgroup 为根
+	if config.CgroupNamespace {
+		if err := unshareCgroupNamespace(); err != nil {
+			return err
+		}
 	}
-	return nil
+	if config.TimeOffsets != nil {
+		if err := unshareTimeNamespace(config.TimeOffsets); err != nil {
+			return err
+		}
+	}
+
+	// 设置挂载点
+	if err := setUpMount(config.Rootfs, config.Mounts); err != nil {
+		return err
+	}
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			return fmt.Errorf("设置主机名 %s 失败: %v", config.Hostname, err)
+		}
+	}
+	return execUserCommand(config, status)
+}
+
+// RunExecProcess 是 exec 进入容器的进程，nsenter 中的 C 代码已经把它放进了容器的 namespace 和根目录，
+// 这里从管道中读取父进程发来的配置，切换到配置中的工作目录和用户后执行用户命令
+func RunExecProcess() error {
+	config, err := readInitConfig()
+	if err != nil {
+		return err
+	}
+	return execUserCommand(config, nil)
 }
 
-// readUserCommand 通过文件描述符 3（fd3）读取用户传入的命令字符串
-// 父进程通过管道写入，子进程通过 fd=3 的文件描述符读取
-func readUserCommand() []string {
-	// 注意：fd=3 是通过 ExtraFiles 传入的管道读端
+// readInitConfig 通过文件描述符 3（fd3）读取父进程发来的配置
+// 注意：fd=3 是通过 ExtraFiles 传入的管道读端
+func readInitConfig() (*InitConfig, error) {
 	pipe := os.NewFile(uintptr(3), "pipe")
 	defer pipe.Close()
+	return ReadInitConfig(pipe)
+}
 
-	// 读取完整命令字符串
-	msg, err := ioutil.ReadAll(pipe)
+// execUserCommand 按配置设置环境变量、工作目录和用户，然后用 syscall.Exec 执行用户命令
+// 执行之前通过 status 向父进程报告 ready，status 为 nil 时不报告
+func execUserCommand(config *InitConfig, status *os.File) error {
+	// 用户命令只使用配置中的环境变量，查找命令路径时也使用其中的 PATH
+	os.Clearenv()
+	for _, env := range config.Env {
+		if key, value, ok := strings.Cut(env, "="); ok {
+			os.Setenv(key, value)
+		}
+	}
+	if config.Cwd != "" {
+		// 与 docker 一致，工作目录不存在时自动创建
+		if err := os.MkdirAll(config.Cwd, 0755); err != nil {
+			return fmt.Errorf("创建工作目录 %s 失败: %v", config.Cwd, err)
+		}
+		if err := os.Chdir(config.Cwd); err != nil {
+			return fmt.Errorf("切换到工作目录 %s 失败: %v", config.Cwd, err)
+		}
+	}
+	home := "/"
+	if config.User != "" {
+		user, err := LookupUser(config.User)
+		if err != nil {
+			return err
+		}
+		if err := user.SetUser(); err != nil {
+			return err
+		}
+		home = user.Home
+	}
+	if os.Getenv("HOME") == "" {
+		os.Setenv("HOME", home)
+	}
+
+	// 查找要执行命令的绝对路径
+	path, err := exec.LookPath(config.Args[0])
 	if err != nil {
-		logrus.Errorf("从管道读取命令失败: %v", err)
-		return nil
+		return fmt.Errorf("查找命令 %s 失败: %v", config.Args[0], err)
 	}
+	logrus.Infof("找到可执行文件路径: %s", path)
+	reportInitStatus(status, InitStatusReady)
 
-	// 将命令字符串按空格分割为命令数组
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	// 使用 syscall.Exec 替换当前进程为用户指定的命令进程
+	if err := syscall.Exec(path, config.Args, os.Environ()); err != nil {
+		return fmt.Errorf("执行用户命令失败: %v", err)
+	}
+	return nil
 }
 
-// pivotRoot 执行 pivot_root 系统调用，切换当前进程的根文件系统
-func pivotRoot(root string) error {
-	// 1. 先把 root 重新 mount 一次，把自己挂载到自己上，目的是为了创建一个新的 mount namespace，
-	// 避免出现 “device or resource busy” 的问题
-	if err := syscall.Mount(root, root, "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
-		logrus.Errorf("挂载 root 失败: %v", err)
+// bindRoot 把当前目录（容器的挂载点）bind mount 到自己上，然后重新进入它，之后的挂载都在这个新的挂载上进行
+// pivot_root 要求新的 root 是一个挂载点，而且不能与旧的 root 在同一个挂载上，bind mount 一次可以避免 “device or resource busy” 的问题。
+// 只使用相对路径：运行在用户命名空间中时容器中的 root 没有权限访问宿主机上挂载点所在的目录（例如权限为 700 的 /root），
+// 所以通过上一级目录重新进入，只需要访问挂载点的父目录
+func bindRoot(pwd string) error {
+	if err := syscall.Mount(".", ".", "bind", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("挂载 root 失败: %v", err)
 	}
+	return reenter(pwd)
+}
 
-	// 2. 创建一个 .pivot_root 目录用于存放旧的 root，
+// reenter 在当前目录上挂载了新的文件系统之后重新进入它
+// 当前工作目录还在原来的挂载上，通过上一级目录重新查找路径才会进入刚刚挂载到上面的文件系统
+func reenter(pwd string) error {
+	if err := os.Chdir(filepath.Join("..", filepath.Base(pwd))); err != nil {
+		return fmt.Errorf("进入 root 失败: %v", err)
+	}
+	return nil
+}
+
+// pivotRoot 执行 pivot_root 系统调用，把当前目录切换为进程的根文件系统
+func pivotRoot() error {
+	// 1. 创建一个 .pivot_root 目录用于存放旧的 root，
 	// pivot_root 系统调用要求第二个参数必须在新的 root 目录内部
-	pivotDir := filepath.Join(root, ".pivot_root")
+	pivotDir := ".pivot_root"
 	if err := os.MkdirAll(pivotDir, 0777); err != nil {
 		return fmt.Errorf("创建 pivot_root 目录失败: %v", err)
 	}
 
-	// 3. 执行 pivot_root，实际上会把当前 root 移到 .pivot_root，
-	// 并将新的 root 设置为 root（即 busybox 解压目录）
-	if err := syscall.PivotRoot(root, pivotDir); err != nil {
+	// 2. 执行 pivot_root，实际上会把当前 root 移到 .pivot_root，
+	// 并将新的 root 设置为当前目录（即镜像的挂载点）
+	if err := syscall.PivotRoot(".", pivotDir); err != nil {
 		return fmt.Errorf("执行 pivot_root 失败: %v", err)
 	}
 
-	// 4. 切换当前进程的工作目录到新的根目录，否则后续某些相对路径操作会出问题
+	// 3. 切换当前进程的工作目录到新的根目录，否则后续某些相对路径操作会出问题
 	if err := os.Chdir("/"); err != nil {
 		return fmt.Errorf("切换工作目录到新 root 失败: %v", err)
 	}
 
-	// 5. 重新定义 pivotDir，这时候它已经在新的 root 环境下，
+	// 4. 重新定义 pivotDir，这时候它已经在新的 root 环境下，
 	// 需要用新的路径表示它
-	pivotDir = filepath.Join("/", ".pivot_root")
+	pivotDir = filepath.Join("/", pivotDir)
 
-	// 6. 卸载旧的 root（现在被挂载在 /.pivot_root），使用 MNT_DETACH 表示延迟卸载，直到没有进程使用
+	// 5. 卸载旧的 root（现在被挂载在 /.pivot_root），使用 MNT_DETACH 表示延迟卸载，直到没有进程使用
 	if err := syscall.Unmount(pivotDir, syscall.MNT_DETACH); err != nil {
 		return fmt.Errorf("卸载旧的 root 失败: %v", err)
 	}
 
-	// 7. 删除 .pivot_root 目录，清理现场
+	// 6. 删除 .pivot_root 目录，清理现场
 	return os.Remove(pivotDir)
 }
 
-// setUpMount 设置容器的挂载点
-// 主要是挂载 /proc 和 /dev 目录
-func setUpMount() {
+// setUpMount 挂载配置中的文件系统，例如 /proc 和 /dev，然后切换到容器的根文件系统
+// 挂载在 pivot_root 之前进行：运行在用户命名空间中时，内核只允许在命名空间中还能看到完整的 proc 时挂载新的 proc，
+// 卸载旧的 root 之后就看不到宿主机的 proc 了。rootfs 不为空时先把它挂载到当前目录上作为容器的根文件系统
+func setUpMount(rootfs *Mount, mounts []Mount) error {
+	// 把整个挂载树的传播类型改为私有：systemd 默认把 / 设为 shared，不修改的话容器中的挂载和卸载会传播到宿主机，
+	// pivot_root 也要求新旧 root 所在的挂载都不是 shared
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("将挂载传播类型设置为私有失败: %v", err)
+	}
 	// 获取当前工作目录
 	pwd, err := os.Getwd()
 	if err != nil {
-		logrus.Errorf("获取当前工作目录失败: %v", err)
-		return
+		return fmt.Errorf("获取当前工作目录失败: %v", err)
 	}
 	logrus.Infof("当前工作目录: %s", pwd)
-	// 执行 pivot_root 切换根文件系统
-	pivotRoot(pwd)
-	// 设置默认挂载参数：
-	// MS_NOEXEC：不允许执行二进制
-	// MS_NOSUID：不允许 set-user-ID 或 set-group-ID
-	// MS_NODEV：不允许访问设备文件
-	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
-
-	// 挂载 proc 文件系统到 /proc 目录
-	// /proc 提供了内核和进程相关的虚拟信息，容器中 ps/top 等命令依赖它
-	if err := syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), ""); err != nil {
-		logrus.Errorf("挂载 /proc 失败: %v", err)
-		return
-	}
-	// 挂载 tmpfs 到 /dev 目录
-	if err := syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
-		logrus.Errorf("挂载 /dev 失败: %v", err)
-		return
+	if rootfs != nil {
+		if err := mountRootfs(rootfs); err != nil {
+			return fmt.Errorf("挂载容器的根文件系统失败: %v", err)
+		}
+		if err := reenter(pwd); err != nil {
+			return err
+		}
+	}
+	if err := bindRoot(pwd); err != nil {
+		return err
 	}
+	for _, m := range mounts {
+		// 挂载点相对于容器的根目录，也就是当前目录
+		target := filepath.Join(".", m.Destination)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("创建挂载点 %s 失败: %v", m.Destination, err)
+		}
+		if err := syscall.Mount(m.Source, target, m.Type, m.Flags, m.Data); err != nil {
+			return fmt.Errorf("挂载 %s 失败: %v", m.Destination, err)
+		}
+	}
+	// 执行 pivot_root 切换根文件系统
+	return pivotRoot()
 }
@@ -0,0 +1,69 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"syscall"
+)
+
+// InitConfigVersion 父进程通过管道发给 init 进程的配置的格式版本，格式有不兼容的修改时加一
+// init 进程与父进程是同一个程序，版本不一致说明二进制文件在容器启动过程中被替换了
+const InitConfigVersion = 1
+
+// InitConfig 父进程通过管道发给容器 init 进程（以及 exec 进入容器的进程）的配置
+// 以 JSON 编码，命令的每个参数单独保存，参数中可以包含空格、引号或者是空字符串
+type InitConfig struct {
+	Version  int      `json:"version"`            // 格式版本，必须等于 InitConfigVersion
+	Args     []string `json:"args"`               // 要执行的命令及参数
+	Env      []string `json:"env"`                // 命令的全部环境变量，不继承 init 进程自己的环境变量
+	Cwd      string   `json:"cwd,omitempty"`      // 工作目录，为空时为 /
+	User     string   `json:"user,omitempty"`     // 运行用户，格式为 user[:group]，为空时为 root
+	Hostname string   `json:"hostname,omitempty"` // 容器的主机名，为空时不修改，exec 时为空
+	Mounts   []Mount  `json:"mounts,omitempty"`   // 在容器的根目录下依次挂载的文件系统，exec 时为空
+	Rootfs   *Mount   `json:"rootfs,omitempty"`   // 挂载到挂载点上的根文件系统，只在 rootless 模式下使用，为空时父进程已经挂载好了
+	// 是否为容器创建新的 cgroup 命名空间，exec 时为 false
+	CgroupNamespace bool `json:"cgroupNamespace,omitempty"`
+	// 容器时间命名空间中的时钟偏移量，为空时不创建时间命名空间，exec 时为空
+	TimeOffsets *TimeOffsets `json:"timeOffsets,omitempty"`
+}
+
+// Mount 描述 init 进程在容器中挂载的一个文件系统
+type Mount struct {
+	Source      string  `json:"source"`         // 挂载源，例如 proc
+	Destination string  `json:"destination"`    // 容器中的挂载点，不存在时自动创建
+	Type        string  `json:"type"`           // 文件系统类型，例如 proc、tmpfs
+	Flags       uintptr `json:"flags"`          // mount 系统调用的标志
+	Data        string  `json:"data,omitempty"` // 文件系统的选项，例如 mode=755
+}
+
+// DefaultMounts 容器中默认挂载的文件系统：ps/top 等命令依赖的 /proc，以及 /dev
+func DefaultMounts() []Mount {
+	return []Mount{
+		// MS_NOEXEC：不允许执行二进制；MS_NOSUID：不允许 set-user-ID 或 set-group-ID；MS_NODEV：不允许访问设备文件
+		{Source: "proc", Destination: "/proc", Type: "proc", Flags: syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV},
+		{Source: "tmpfs", Destination: "/dev", Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_STRICTATIME, Data: "mode=755"},
+	}
+}
+
+// WriteInitConfig 把配置写入管道，Version 由这里填写
+func WriteInitConfig(w io.Writer, config *InitConfig) error {
+	copied := *config
+	copied.Version = InitConfigVersion
+	return json.NewEncoder(w).Encode(&copied)
+}
+
+// ReadInitConfig 从管道中读取父进程发来的配置，检查格式版本和命令
+func ReadInitConfig(r io.Reader) (*InitConfig, error) {
+	var config InitConfig
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return nil, fmt.Errorf("解析父进程发来的配置失败: %v", err)
+	}
+	if config.Version != InitConfigVersion {
+		return nil, fmt.Errorf("父进程发来的配置版本为 %d，当前只支持版本 %d", config.Version, InitConfigVersion)
+	}
+	if len(config.Args) == 0 {
+		return nil, fmt.Errorf("父进程没有发来要执行的命令")
+	}
+	return &config, nil
+}
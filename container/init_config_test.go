@@ -0,0 +1,74 @@
+package container
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInitConfigRoundTrip(t *testing.T) {
+	config := &InitConfig{
+		Args:     []string{"/bin/sh", "-c", `echo "hello world"`, ""},
+		Env:      []string{"PATH=/bin", "GREETING=a b=c"},
+		Cwd:      "/app dir",
+		User:     "app:wheel",
+		Hostname: "1234567890",
+		Mounts:   DefaultMounts(),
+	}
+	var buf bytes.Buffer
+	if err := WriteInitConfig(&buf, config); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadInitConfig(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *config
+	want.Version = InitConfigVersion
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("ReadInitConfig = %+v, 期望 %+v", got, &want)
+	}
+
+	for _, bad := range []string{
+		`{"version":2,"args":["sh"]}`,
+		`{"args":["sh"]}`,
+		`{"version":1,"args":[]}`,
+		"sh -c ls",
+	} {
+		if _, err := ReadInitConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadInitConfig(%q) 期望报错", bad)
+		}
+	}
+}
+
+func TestInitPipesWaitExec(t *testing.T) {
+	cases := []struct {
+		status  string
+		wantErr string
+	}{
+		{status: "ready\n"},
+		{status: "ready\nerror: 执行用户命令失败: exec format error\n", wantErr: "exec format error"},
+		{status: "error: 查找命令 foo 失败\n", wantErr: "查找命令 foo 失败"},
+		{status: "", wantErr: "没有完成初始化"},
+		{status: "hello\n", wantErr: "未知的状态"},
+	}
+	for _, c := range cases {
+		pipes, err := NewInitPipes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 模拟 init 进程：写入状态后关闭状态管道的写端
+		statusWrite := pipes.childFiles[1]
+		statusWrite.WriteString(c.status)
+		pipes.CloseChildFiles()
+		err = pipes.WaitExec()
+		pipes.Close()
+		if c.wantErr == "" && err != nil {
+			t.Errorf("状态 %q: WaitExec 返回错误 %v", c.status, err)
+		}
+		if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Errorf("状态 %q: WaitExec 返回 %v，期望包含 %q 的错误", c.status, err, c.wantErr)
+		}
+	}
+}
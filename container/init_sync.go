@@ -0,0 +1,97 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// init 进程通过状态管道向父进程报告的消息，每条占一行
+// 用户命令执行成功时（exec'd）init 进程不再发送消息，状态管道设置了 close-on-exec，随 exec 关闭，父进程读到 EOF
+const (
+	InitStatusReady       = "ready"   // 初始化完成，即将执行用户命令
+	InitStatusErrorPrefix = "error: " // 初始化或执行用户命令失败，后面是错误信息
+)
+
+// InitPipes 父进程与容器 init 进程之间的双向同步通道
+// 父进程通过配置管道发送 InitConfig，init 进程通过状态管道报告 ready、用户命令已执行或者失败的原因
+type InitPipes struct {
+	configWrite *os.File   // 配置管道的写端，父进程使用
+	statusRead  *os.File   // 状态管道的读端，父进程使用
+	childFiles  []*os.File // 交给 init 进程的一端，依次作为它的 fd3 和 fd4
+}
+
+// NewInitPipes 创建配置管道和状态管道
+func NewInitPipes() (*InitPipes, error) {
+	configRead, configWrite, err := NewPipe()
+	if err != nil {
+		return nil, err
+	}
+	statusRead, statusWrite, err := NewPipe()
+	if err != nil {
+		configRead.Close()
+		configWrite.Close()
+		return nil, err
+	}
+	return &InitPipes{
+		configWrite: configWrite,
+		statusRead:  statusRead,
+		childFiles:  []*os.File{configRead, statusWrite},
+	}, nil
+}
+
+// CloseChildFiles 在 init 进程启动之后关闭父进程中交给它的一端，否则父进程读状态管道时收不到 EOF
+func (p *InitPipes) CloseChildFiles() {
+	for _, f := range p.childFiles {
+		f.Close()
+	}
+}
+
+// SendConfig 把配置发送给 init 进程并关闭配置管道
+func (p *InitPipes) SendConfig(config *InitConfig) error {
+	defer p.configWrite.Close()
+	return WriteInitConfig(p.configWrite, config)
+}
+
+// WaitExec 等待 init 进程执行用户命令，init 进程报告 ready 之后状态管道被关闭说明用户命令已经开始执行
+// init 进程报告错误或者没有报告 ready 就退出时返回错误
+func (p *InitPipes) WaitExec() error {
+	defer p.statusRead.Close()
+	ready := false
+	scanner := bufio.NewScanner(p.statusRead)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == InitStatusReady:
+			ready = true
+		case strings.HasPrefix(line, InitStatusErrorPrefix):
+			return fmt.Errorf("容器初始化失败: %s", strings.TrimPrefix(line, InitStatusErrorPrefix))
+		default:
+			return fmt.Errorf("容器 init 进程报告了未知的状态 %q", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("读取容器 init 进程的状态失败: %v", err)
+	}
+	if !ready {
+		return fmt.Errorf("容器 init 进程没有完成初始化就退出了")
+	}
+	return nil
+}
+
+// Close 关闭父进程持有的所有管道，用于启动失败后的清理
+func (p *InitPipes) Close() {
+	p.CloseChildFiles()
+	p.configWrite.Close()
+	p.statusRead.Close()
+}
+
+// reportInitStatus init 进程向父进程报告状态，status 为 nil 时（exec 进入容器的进程）不报告
+func reportInitStatus(status *os.File, message string) {
+	if status == nil {
+		return
+	}
+	// 每条消息占一行，错误信息中的换行替换成空格
+	fmt.Fprintln(status, strings.ReplaceAll(message, "\n", " "))
+}
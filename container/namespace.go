@@ -0,0 +1,118 @@
+package container
+
+import (
+	"MiniDocker/cgroup/subsystems"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --cgroupns 的取值
+const (
+	CgroupNamespaceHost    = "host"    // 与宿主机共用 cgroup 命名空间，容器中的 /proc/self/cgroup 显示宿主机上的完整路径
+	CgroupNamespacePrivate = "private" // 容器使用自己的 cgroup 命名空间，容器的 cgroup 显示为根 /
+)
+
+// cgroupMountPoint 容器中 cgroup 文件系统的挂载点
+const cgroupMountPoint = "/sys/fs/cgroup"
+
+// timensOffsetsFile 写入新的时间命名空间中时钟偏移量的文件，见 time_namespaces(7)
+const timensOffsetsFile = "/proc/self/timens_offsets"
+
+// TimeOffsets 容器时间命名空间中各个时钟相对宿主机的偏移量，只影响 CLOCK_MONOTONIC 和 CLOCK_BOOTTIME，
+// CLOCK_REALTIME 不受时间命名空间影响
+type TimeOffsets struct {
+	Monotonic time.Duration `json:"monotonic,omitempty"` // CLOCK_MONOTONIC 的偏移量
+	Boottime  time.Duration `json:"boottime,omitempty"`  // CLOCK_BOOTTIME 的偏移量，也就是容器中看到的开机时长（uptime）的偏移量
+}
+
+func init() {
+	// 容器的 init 进程在主线程上 unshare 时间命名空间、写入 /proc/self/timens_offsets 并 exec 用户命令，
+	// 这三步都只对调用它的线程生效，所以把 main goroutine 固定在主线程上（/proc/self 指向的就是主线程）
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		runtime.LockOSThread()
+	}
+}
+
+// CheckCgroupNamespace 检查 --cgroupns 的取值，为空时使用 host
+func CheckCgroupNamespace(mode string) (string, error) {
+	switch mode {
+	case "":
+		return CgroupNamespaceHost, nil
+	case CgroupNamespaceHost, CgroupNamespacePrivate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("--cgroupns 只能是 %s 或 %s", CgroupNamespacePrivate, CgroupNamespaceHost)
+}
+
+// CgroupMounts 容器使用自己的 cgroup 命名空间时在 /sys/fs/cgroup 挂载的 cgroup 文件系统，以只读方式挂载，
+// 容器中只能看到自己的 cgroup，不能修改资源限制
+// cgroup v2 只需要挂载 cgroup2；cgroup v1 先挂载 tmpfs，再按宿主机上的层级逐个挂载，挂载选项与宿主机一致（例如 cpu,cpuacct）
+func CgroupMounts() ([]Mount, error) {
+	const flags = syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV
+	if subsystems.IsCgroup2UnifiedMode() {
+		return []Mount{{Source: "cgroup2", Destination: cgroupMountPoint, Type: "cgroup2", Flags: flags}}, nil
+	}
+	hierarchies, err := subsystems.CgroupHierarchies()
+	if err != nil {
+		return nil, fmt.Errorf("读取宿主机的 cgroup 层级失败: %v", err)
+	}
+	mounts := []Mount{{Source: "tmpfs", Destination: cgroupMountPoint, Type: "tmpfs", Flags: syscall.MS_NOSUID | syscall.MS_NOEXEC | syscall.MS_NODEV, Data: "mode=755"}}
+	for _, h := range hierarchies {
+		// ro/rw 由 flags 决定，其余的超级块选项原样保留，同一个层级的挂载选项不一致时内核会拒绝挂载
+		var options []string
+		for _, opt := range strings.Split(h.Options, ",") {
+			if opt != "rw" && opt != "ro" {
+				options = append(options, opt)
+			}
+		}
+		mounts = append(mounts, Mount{
+			Source:      h.FsType,
+			Destination: filepath.Join(cgroupMountPoint, filepath.Base(h.Mountpoint)),
+			Type:        h.FsType,
+			Flags:       flags,
+			Data:        strings.Join(options, ","),
+		})
+	}
+	return mounts, nil
+}
+
+// unshareCgroupNamespace 为 init 进程创建新的 cgroup 命名空间
+// 命名空间的根是创建时所在的 cgroup，所以不能在 clone 时创建：那时 init 进程还在父进程的 cgroup 中。
+// 父进程把 init 进程加入容器的 cgroup 之后才会发来配置，这时再 unshare，容器的 cgroup 就是命名空间的根
+func unshareCgroupNamespace() error {
+	if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+		return fmt.Errorf("创建 cgroup 命名空间失败: %v", err)
+	}
+	return nil
+}
+
+// unshareTimeNamespace 创建新的时间命名空间并设置时钟偏移量
+// 时钟偏移量只能在命名空间中还没有进程时设置，所以不能在 clone 时创建（clone 也不支持 CLONE_NEWTIME 标志）。
+// unshare 之后当前进程还在原来的时间命名空间中，exec 用户命令时才进入新的命名空间
+func unshareTimeNamespace(offsets *TimeOffsets) error {
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("创建时间命名空间失败: %v", err)
+	}
+	content := formatTimeOffset("monotonic", offsets.Monotonic) + formatTimeOffset("boottime", offsets.Boottime)
+	if err := os.WriteFile(timensOffsetsFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("设置时间命名空间的时钟偏移量失败: %v", err)
+	}
+	return nil
+}
+
+// formatTimeOffset 按 timens_offsets 的格式输出一个时钟的偏移量：时钟名 秒 纳秒，负的偏移量只有秒为负数
+func formatTimeOffset(clock string, offset time.Duration) string {
+	secs := int64(offset / time.Second)
+	nsecs := int64(offset % time.Second)
+	if nsecs < 0 {
+		secs--
+		nsecs += int64(time.Second)
+	}
+	return fmt.Sprintf("%s %d %d\n", clock, secs, nsecs)
+}
@@ -0,0 +1,34 @@
+package container
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatTimeOffset(t *testing.T) {
+	cases := []struct {
+		offset time.Duration
+		want   string
+	}{
+		{0, "monotonic 0 0\n"},
+		{240 * time.Hour, "monotonic 864000 0\n"},
+		{1500 * time.Millisecond, "monotonic 1 500000000\n"},
+		{-1500 * time.Millisecond, "monotonic -2 500000000\n"},
+	}
+	for _, c := range cases {
+		if got := formatTimeOffset("monotonic", c.offset); got != c.want {
+			t.Errorf("formatTimeOffset(%v) = %q，期望 %q", c.offset, got, c.want)
+		}
+	}
+}
+
+func TestCheckCgroupNamespace(t *testing.T) {
+	for mode, want := range map[string]string{"": CgroupNamespaceHost, "host": CgroupNamespaceHost, "private": CgroupNamespacePrivate} {
+		if got, err := CheckCgroupNamespace(mode); err != nil || got != want {
+			t.Errorf("CheckCgroupNamespace(%q) = %q, %v，期望 %q", mode, got, err, want)
+		}
+	}
+	if _, err := CheckCgroupNamespace("none"); err == nil {
+		t.Error("CheckCgroupNamespace(none) 期望报错")
+	}
+}
@@ -0,0 +1,221 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// rootless 模式下 overlayfs 使用 user.overlay.* 扩展属性记录不透明目录等信息，
+// 普通用户没有权限设置 trusted.* 扩展属性，挂载时需要加上 userxattr 选项
+const (
+	rootlessOpaqueXattr   = "user.overlay.opaque"
+	rootlessOverlayOption = "userxattr"
+)
+
+// Rootless 当前进程不是 root 时以 rootless 模式运行：容器运行在只映射了当前用户的用户命名空间中，
+// 容器的根文件系统和数据卷由 init 进程在容器的 mount 命名空间中挂载，不使用 cgroup，也不能接入 bridge 网络
+func Rootless() bool {
+	return os.Geteuid() != 0
+}
+
+// RootlessUserNamespace rootless 模式下容器的用户命名空间，容器中的 root 映射为当前用户，其他 uid/gid 都没有映射。
+// 普通用户只能映射自己，镜像中属于其他用户的文件在容器中也属于 root
+func RootlessUserNamespace() *UserNamespace {
+	return &UserNamespace{
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+}
+
+// overlayOpaqueXattr 当前模式下 overlayfs 标记不透明目录使用的扩展属性
+func overlayOpaqueXattr() string {
+	if Rootless() {
+		return rootlessOpaqueXattr
+	}
+	return opaqueXattr
+}
+
+// RootfsMount rootless 模式下容器根文件系统的挂载配置，由 init 进程挂载到容器的挂载点上。
+// 不是 rootless 模式时根文件系统已经由父进程挂载好了，返回 nil
+func RootfsMount(imageName string, containerName string) (*Mount, error) {
+	if !Rootless() {
+		return nil, nil
+	}
+	lowerDirs, err := CreateReadOnlyLayer(imageName)
+	if err != nil {
+		return nil, err
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,%s",
+		strings.Join(lowerDirs, ":"), UpperDir(containerName), workDir(containerName), rootlessOverlayOption)
+	return &Mount{Source: "overlay", Destination: "/", Type: "overlay", Data: options}, nil
+}
+
+// VolumeMounts rootless 模式下数据卷的挂载配置，由 init 进程在容器中 bind mount。
+// 不是 rootless 模式时数据卷已经由父进程挂载好了，返回 nil
+func VolumeMounts(volume string) []Mount {
+	if !Rootless() {
+		return nil
+	}
+	var mounts []Mount
+	for _, mp := range VolumeMountPoints(volume) {
+		mounts = append(mounts, Mount{
+			Source:      mp.Source,
+			Destination: mp.Destination,
+			Type:        "bind",
+			Flags:       syscall.MS_BIND | syscall.MS_REC,
+		})
+	}
+	return mounts
+}
+
+// mountRootfs 在当前目录（容器的挂载点）上挂载 rootless 模式的根文件系统
+// 内核不允许在用户命名空间中挂载 overlayfs 时依次尝试 fuse-overlayfs 和把各层复制到一个目录中
+func mountRootfs(m *Mount) error {
+	err := syscall.Mount(m.Source, ".", m.Type, m.Flags, m.Data)
+	if err == nil {
+		return nil
+	}
+	logrus.Warnf("在用户命名空间中挂载 overlayfs 失败: %v，尝试使用 fuse-overlayfs", err)
+	options := strings.TrimSuffix(m.Data, ","+rootlessOverlayOption)
+	if path, lookErr := exec.LookPath("fuse-overlayfs"); lookErr == nil {
+		output, fuseErr := exec.Command(path, "-o", options, ".").CombinedOutput()
+		if fuseErr == nil {
+			return nil
+		}
+		logrus.Warnf("fuse-overlayfs 挂载失败: %v: %s", fuseErr, strings.TrimSpace(string(output)))
+	}
+	logrus.Warnf("没有可用的 overlay 文件系统，把镜像的各层复制到容器的写层中，容器的修改无法 commit")
+	return copyRootfs(options)
+}
+
+// copyRootfs 把 overlay 挂载参数中的各个只读层从下往上依次复制到写层的 merged 目录中，然后 bind mount 到当前目录
+func copyRootfs(options string) error {
+	var lowerDirs []string
+	var upperDir string
+	for _, opt := range strings.Split(options, ",") {
+		if strings.HasPrefix(opt, "lowerdir=") {
+			lowerDirs = strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":")
+		} else if strings.HasPrefix(opt, "upperdir=") {
+			upperDir = strings.TrimPrefix(opt, "upperdir=")
+		}
+	}
+	if len(lowerDirs) == 0 || upperDir == "" {
+		return fmt.Errorf("根文件系统的挂载参数错误: %s", options)
+	}
+	merged := filepath.Join(filepath.Dir(upperDir), mergedDirName)
+	if err := os.MkdirAll(merged, 0755); err != nil {
+		return err
+	}
+	for i := len(lowerDirs) - 1; i >= 0; i-- {
+		if err := copyLayer(lowerDirs[i], merged); err != nil {
+			return fmt.Errorf("复制只读层 %s 失败: %v", lowerDirs[i], err)
+		}
+	}
+	if err := syscall.Mount(merged, ".", "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("挂载 %s 失败: %v", merged, err)
+	}
+	return nil
+}
+
+// copyLayer 把一个 overlayfs 格式的只读层合并到 dst 目录中
+// whiteout 删除 dst 中对应的文件，不透明目录先清空 dst 中对应的目录，设备文件在 rootless 模式下无法创建，直接跳过
+func copyLayer(src string, dst string) error {
+	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		stat, _ := fi.Sys().(*syscall.Stat_t)
+		switch {
+		case fi.Mode()&os.ModeCharDevice != 0 && stat != nil && stat.Rdev == 0:
+			return os.RemoveAll(target)
+		case fi.Mode()&(os.ModeDevice|os.ModeCharDevice|os.ModeSocket) != 0:
+			return nil
+		}
+		// 下层的同名文件被覆盖，只有目录合并内容
+		if existing, err := os.Lstat(target); err == nil && !(existing.IsDir() && fi.IsDir() && !isOpaqueDir(file)) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+		switch {
+		case fi.IsDir():
+			if err := os.Mkdir(target, fi.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return err
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case fi.Mode()&os.ModeNamedPipe != 0:
+			if err := unix.Mkfifo(target, uint32(fi.Mode().Perm())); err != nil {
+				return err
+			}
+		default:
+			if err := copyRegularFile(file, target, fi.Mode()); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+}
+
+// copyRegularFile 复制普通文件的内容
+func copyRegularFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeAll 删除目录，rootless 模式下先给所有子目录加上当前用户的读写权限
+// overlayfs 在 work 目录中创建的目录权限为 000，普通用户没有 CAP_DAC_OVERRIDE，不加权限无法删除其中的内容
+func removeAll(dir string) error {
+	if Rootless() {
+		makeRemovable(dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+// makeRemovable 递归地给目录加上当前用户的读写和执行权限
+func makeRemovable(dir string) {
+	fi, err := os.Lstat(dir)
+	if err != nil || !fi.IsDir() {
+		return
+	}
+	if fi.Mode().Perm()&0700 != 0700 {
+		os.Chmod(dir, fi.Mode().Perm()|0700)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			makeRemovable(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
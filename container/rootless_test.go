@@ -0,0 +1,57 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyLayer(t *testing.T) {
+	lower := t.TempDir()
+	upper := t.TempDir()
+	merged := t.TempDir()
+	write := func(dir, name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(lower, "etc/hostname", "lower")
+	write(lower, "etc/removed", "lower")
+	write(lower, "bin/sh", "sh")
+	write(upper, "etc/hostname", "upper")
+	write(upper, "etc/added", "upper")
+	if err := os.Mkdir(filepath.Join(upper, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sh", filepath.Join(upper, "bin", "bash")); err != nil {
+		t.Fatal(err)
+	}
+	// 上层用 0/0 字符设备表示删除了下层的文件
+	if err := syscall.Mknod(filepath.Join(upper, "etc", "removed"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("无法创建 whiteout 文件: %v", err)
+	}
+
+	for _, layer := range []string{lower, upper} {
+		if err := copyLayer(layer, merged); err != nil {
+			t.Fatalf("copyLayer(%s) 失败: %v", layer, err)
+		}
+	}
+
+	for name, want := range map[string]string{"etc/hostname": "upper", "etc/added": "upper", "bin/sh": "sh"} {
+		got, err := os.ReadFile(filepath.Join(merged, name))
+		if err != nil || string(got) != want {
+			t.Errorf("%s 的内容为 %q (%v)，期望 %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(merged, "etc", "removed")); !os.IsNotExist(err) {
+		t.Errorf("etc/removed 应该被上层的 whiteout 删除: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(merged, "bin", "bash")); err != nil || link != "sh" {
+		t.Errorf("bin/bash 应该是指向 sh 的符号链接: %q, %v", link, err)
+	}
+}
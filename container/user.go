@@ -0,0 +1,192 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 容器中的用户数据库，在 pivot_root 之后读取，所以是容器内的路径
+const (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+// ExecUser 容器中运行用户命令的用户
+type ExecUser struct {
+	Uid    int
+	Gid    int
+	Groups []int  // 附加组
+	Home   string // 家目录，用于设置 HOME 环境变量
+}
+
+// passwdEntry /etc/passwd 中的一行
+type passwdEntry struct {
+	name string
+	uid  int
+	gid  int
+	home string
+}
+
+// groupEntry /etc/group 中的一行
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// LookupUser 按 docker 的规则解析用户，spec 的格式为 user[:group]，user 和 group 都可以是名字或数字 ID
+// 数字形式的用户不要求在 /etc/passwd 中存在，这时主组为 0，家目录为 /
+func LookupUser(spec string) (*ExecUser, error) {
+	passwd, err := os.Open(passwdPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	group, err := os.Open(groupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var passwdReader, groupReader io.Reader = strings.NewReader(""), strings.NewReader("")
+	if passwd != nil {
+		defer passwd.Close()
+		passwdReader = passwd
+	}
+	if group != nil {
+		defer group.Close()
+		groupReader = group
+	}
+	return lookupUser(spec, passwdReader, groupReader)
+}
+
+// lookupUser 根据给定的 passwd 和 group 文件内容解析用户
+func lookupUser(spec string, passwd io.Reader, group io.Reader) (*ExecUser, error) {
+	users, err := parsePasswd(passwd)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %v", passwdPath, err)
+	}
+	groups, err := parseGroup(group)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %v", groupPath, err)
+	}
+
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	user := &ExecUser{Home: "/"}
+	name := ""
+	if uid, err := strconv.Atoi(userSpec); err == nil {
+		user.Uid = uid
+		for _, u := range users {
+			if u.uid == uid {
+				name, user.Gid, user.Home = u.name, u.gid, u.home
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, u := range users {
+			if u.name == userSpec {
+				name, user.Uid, user.Gid, user.Home = u.name, u.uid, u.gid, u.home
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("用户 %s 在 %s 中不存在", userSpec, passwdPath)
+		}
+	}
+
+	if hasGroup {
+		if gid, err := strconv.Atoi(groupSpec); err == nil {
+			user.Gid = gid
+		} else {
+			found := false
+			for _, g := range groups {
+				if g.name == groupSpec {
+					user.Gid = g.gid
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("用户组 %s 在 %s 中不存在", groupSpec, groupPath)
+			}
+		}
+	} else if name != "" {
+		// 只指定用户时，附加组为 /etc/group 中包含该用户的组
+		for _, g := range groups {
+			for _, member := range g.members {
+				if member == name && g.gid != user.Gid {
+					user.Groups = append(user.Groups, g.gid)
+				}
+			}
+		}
+	}
+	return user, nil
+}
+
+// parsePasswd 解析 /etc/passwd，格式为 name:password:uid:gid:gecos:home:shell，无法解析的行直接跳过
+func parsePasswd(r io.Reader) ([]passwdEntry, error) {
+	var users []passwdEntry
+	err := scanColonFile(r, func(fields []string) {
+		if len(fields) < 6 {
+			return
+		}
+		uid, err1 := strconv.Atoi(fields[2])
+		gid, err2 := strconv.Atoi(fields[3])
+		if err1 != nil || err2 != nil {
+			return
+		}
+		users = append(users, passwdEntry{name: fields[0], uid: uid, gid: gid, home: fields[5]})
+	})
+	return users, err
+}
+
+// parseGroup 解析 /etc/group，格式为 name:password:gid:member1,member2，无法解析的行直接跳过
+func parseGroup(r io.Reader) ([]groupEntry, error) {
+	var groups []groupEntry
+	err := scanColonFile(r, func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return
+		}
+		g := groupEntry{name: fields[0], gid: gid}
+		if len(fields) > 3 && fields[3] != "" {
+			g.members = strings.Split(fields[3], ",")
+		}
+		groups = append(groups, g)
+	})
+	return groups, err
+}
+
+// scanColonFile 逐行读取以冒号分隔的文件，跳过空行和注释
+func scanColonFile(r io.Reader, fn func(fields []string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(strings.Split(line, ":"))
+	}
+	return scanner.Err()
+}
+
+// SetUser 把当前进程切换为指定的用户，先设置附加组和组，最后设置用户
+func (u *ExecUser) SetUser() error {
+	if err := syscall.Setgroups(u.Groups); err != nil {
+		return fmt.Errorf("设置附加组失败: %v", err)
+	}
+	if err := syscall.Setgid(u.Gid); err != nil {
+		return fmt.Errorf("设置 gid %d 失败: %v", u.Gid, err)
+	}
+	if err := syscall.Setuid(u.Uid); err != nil {
+		return fmt.Errorf("设置 uid %d 失败: %v", u.Uid, err)
+	}
+	return nil
+}
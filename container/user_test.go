@@ -0,0 +1,53 @@
+package container
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+# 注释
+nobody:x:65534:65534:nobody:/nonexistent:/usr/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+`
+
+const testGroup = `root:x:0:
+wheel:x:10:root,app
+docker:x:999:app
+nogroup:x:65534:
+app:x:1000:
+`
+
+func TestLookupUser(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    ExecUser
+		wantErr bool
+	}{
+		{spec: "root", want: ExecUser{Uid: 0, Gid: 0, Groups: []int{10}, Home: "/root"}},
+		{spec: "app", want: ExecUser{Uid: 1000, Gid: 1000, Groups: []int{10, 999}, Home: "/home/app"}},
+		{spec: "app:docker", want: ExecUser{Uid: 1000, Gid: 999, Home: "/home/app"}},
+		{spec: "65534", want: ExecUser{Uid: 65534, Gid: 65534, Home: "/nonexistent"}},
+		{spec: "1234:5678", want: ExecUser{Uid: 1234, Gid: 5678, Home: "/"}}, // 不在 /etc/passwd 中的数字 ID
+		{spec: "nobody:nogroup", want: ExecUser{Uid: 65534, Gid: 65534, Home: "/nonexistent"}},
+		{spec: "missing", wantErr: true},
+		{spec: "app:missing", wantErr: true},
+	}
+	for _, c := range cases {
+		user, err := lookupUser(c.spec, strings.NewReader(testPasswd), strings.NewReader(testGroup))
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("lookupUser(%q) 期望报错", c.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookupUser(%q) 失败: %v", c.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(*user, c.want) {
+			t.Errorf("lookupUser(%q) = %+v, 期望 %+v", c.spec, *user, c.want)
+		}
+	}
+}
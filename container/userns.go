@@ -0,0 +1,230 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 宿主机上记录从属 uid/gid 范围的文件，格式为 user:start:count
+var (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+)
+
+// RemapRoot 启用用户命名空间时，镜像只读层按 uid/gid 映射复制一份的存放目录，
+// 每种映射单独一个子目录，名字为容器 root 在宿主机上的 uid.gid
+var RemapRoot = "/var/lib/MiniDocker/remap"
+
+// overflowID 没有映射的 uid/gid 在另一侧显示为 nobody
+const overflowID = 65534
+
+// UserNamespace 容器的用户命名空间配置，容器中的 uid/gid 按映射对应到宿主机上的 uid/gid
+// 容器中的 root 在宿主机上只是一个普通用户
+type UserNamespace struct {
+	UidMappings []syscall.SysProcIDMap `json:"uidMappings"`
+	GidMappings []syscall.SysProcIDMap `json:"gidMappings"`
+}
+
+// LookupRemapUser 按 --userns-remap 的参数从 /etc/subuid 和 /etc/subgid 中读取映射，spec 的格式为 user[:group]，
+// 没有指定 group 时与 user 相同。用户有多个范围时按顺序拼接，容器中的 id 从 0 开始连续分配
+func LookupRemapUser(spec string) (*UserNamespace, error) {
+	user, group, ok := strings.Cut(spec, ":")
+	if !ok {
+		group = user
+	}
+	if user == "" || group == "" {
+		return nil, fmt.Errorf("--userns-remap 的格式错误，应为 user[:group]: %q", spec)
+	}
+	uidMappings, err := readSubIDFile(subuidPath, user)
+	if err != nil {
+		return nil, err
+	}
+	gidMappings, err := readSubIDFile(subgidPath, group)
+	if err != nil {
+		return nil, err
+	}
+	return &UserNamespace{UidMappings: uidMappings, GidMappings: gidMappings}, nil
+}
+
+// readSubIDFile 读取 /etc/subuid 或 /etc/subgid 中 name 的全部范围
+func readSubIDFile(file string, name string) ([]syscall.SysProcIDMap, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 失败: %v", file, err)
+	}
+	defer f.Close()
+	mappings, err := parseSubIDs(f, name)
+	if err != nil {
+		return nil, fmt.Errorf("解析 %s 失败: %v", file, err)
+	}
+	if len(mappings) == 0 {
+		return nil, fmt.Errorf("%s 中没有 %s 的从属 id 范围", file, name)
+	}
+	return mappings, nil
+}
+
+// parseSubIDs 解析 subuid/subgid 格式的内容，返回 name 的全部范围对应的映射
+func parseSubIDs(r io.Reader, name string) ([]syscall.SysProcIDMap, error) {
+	var mappings []syscall.SysProcIDMap
+	containerID := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("格式错误的行 %q", line)
+		}
+		if fields[0] != name {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || start < 0 || count <= 0 {
+			return nil, fmt.Errorf("格式错误的行 %q", line)
+		}
+		mappings = append(mappings, syscall.SysProcIDMap{ContainerID: containerID, HostID: start, Size: count})
+		containerID += count
+	}
+	return mappings, scanner.Err()
+}
+
+// RootUID 容器中的 root 在宿主机上的 uid
+func (u *UserNamespace) RootUID() int {
+	return toHost(u.UidMappings, 0)
+}
+
+// RootGID 容器中的 root 组在宿主机上的 gid
+func (u *UserNamespace) RootGID() int {
+	return toHost(u.GidMappings, 0)
+}
+
+// toHost 把容器中的 id 换算成宿主机上的 id，没有映射的 id 换算成 nobody
+func toHost(mappings []syscall.SysProcIDMap, id int) int {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return overflowID
+}
+
+// toContainer 把宿主机上的 id 换算成容器中的 id，没有映射的 id 换算成 nobody
+func toContainer(mappings []syscall.SysProcIDMap, id int) int {
+	for _, m := range mappings {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return overflowID
+}
+
+// remapDir 只读层 dir 按映射复制后的目录
+func (u *UserNamespace) remapDir(dir string) string {
+	return filepath.Join(RemapRoot, fmt.Sprintf("%d.%d", u.RootUID(), u.RootGID()), filepath.Clean(dir))
+}
+
+// originalLowerDir 把按映射复制的只读层目录换算成原来的目录，其他目录原样返回
+func originalLowerDir(dir string) string {
+	rel, err := filepath.Rel(RemapRoot, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return dir
+	}
+	_, original, ok := strings.Cut(rel, string(filepath.Separator))
+	if !ok {
+		return dir
+	}
+	return filepath.Join("/", original)
+}
+
+// RemapLowerDirs 把镜像的只读层复制一份并按映射修改文件的属主，返回复制后的目录
+// 这样容器中看到的镜像文件属于容器中的 root 等用户，而不是没有映射的 nobody。
+// 复制好的目录在同一种映射的容器之间共用，已经存在时直接使用
+func (u *UserNamespace) RemapLowerDirs(lowerDirs []string) ([]string, error) {
+	remapped := make([]string, 0, len(lowerDirs))
+	for _, dir := range lowerDirs {
+		target := u.remapDir(dir)
+		if exist, _ := PathExists(target); !exist {
+			logrus.Infof("按用户命名空间的映射复制只读层 %s", dir)
+			if err := u.copyRemapped(dir, target); err != nil {
+				return nil, fmt.Errorf("复制只读层 %s 失败: %v", dir, err)
+			}
+		}
+		remapped = append(remapped, target)
+	}
+	return remapped, nil
+}
+
+// copyRemapped 复制 src 目录到 target 并修改属主，先复制到临时目录，全部完成后再改名，避免留下不完整的目录
+func (u *UserNamespace) copyRemapped(src string, target string) error {
+	tmp := target + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	// cp -a 保留权限、时间、设备文件（overlayfs 的 whiteout）和扩展属性（不透明目录）
+	if output, err := exec.Command("cp", "-a", src, tmp).CombinedOutput(); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	err := filepath.Walk(tmp, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		return u.chownToHost(file, fi, int(stat.Uid), int(stat.Gid))
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+// chownToHost 把容器中属于 uid/gid 的文件改为对应的宿主机 uid/gid
+// chown 会清除 setuid/setgid 位，之后按原来的权限恢复
+func (u *UserNamespace) chownToHost(file string, fi os.FileInfo, uid int, gid int) error {
+	if err := os.Lchown(file, toHost(u.UidMappings, uid), toHost(u.GidMappings, gid)); err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(file, fi.Mode())
+}
+
+// MkdirAllOwned 与 os.MkdirAll 相同，新建的目录属于容器中的 root，u 为 nil 时不修改属主
+func (u *UserNamespace) MkdirAllOwned(dir string, perm os.FileMode) error {
+	if u == nil {
+		return os.MkdirAll(dir, perm)
+	}
+	var created []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		created = append(created, d)
+	}
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := os.Chown(d, u.RootUID(), u.RootGID()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package container
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseSubIDs(t *testing.T) {
+	content := `# 注释
+dockremap:100000:65536
+other:200000:1000
+
+dockremap:300000:10
+`
+	got, err := parseSubIDs(strings.NewReader(content), "dockremap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []syscall.SysProcIDMap{
+		{ContainerID: 0, HostID: 100000, Size: 65536},
+		{ContainerID: 65536, HostID: 300000, Size: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSubIDs = %+v, 期望 %+v", got, want)
+	}
+
+	if got, err := parseSubIDs(strings.NewReader(content), "nobody"); err != nil || len(got) != 0 {
+		t.Errorf("parseSubIDs(nobody) = %+v, %v，期望没有映射", got, err)
+	}
+	for _, bad := range []string{"dockremap:100000", "dockremap:abc:10", "dockremap:100000:0"} {
+		if _, err := parseSubIDs(strings.NewReader(bad), "dockremap"); err == nil {
+			t.Errorf("parseSubIDs(%q) 期望报错", bad)
+		}
+	}
+}
+
+func TestUserNamespaceIDMapping(t *testing.T) {
+	userns := &UserNamespace{
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: 100000, Size: 1000},
+			{ContainerID: 1000, HostID: 300000, Size: 10},
+		},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	}
+	if userns.RootUID() != 100000 || userns.RootGID() != 200000 {
+		t.Errorf("root 映射为 %d:%d，期望 100000:200000", userns.RootUID(), userns.RootGID())
+	}
+	cases := []struct {
+		container, host int
+	}{
+		{0, 100000},
+		{999, 100999},
+		{1000, 300000},
+		{1009, 300009},
+	}
+	for _, c := range cases {
+		if got := toHost(userns.UidMappings, c.container); got != c.host {
+			t.Errorf("toHost(%d) = %d，期望 %d", c.container, got, c.host)
+		}
+		if got := toContainer(userns.UidMappings, c.host); got != c.container {
+			t.Errorf("toContainer(%d) = %d，期望 %d", c.host, got, c.container)
+		}
+	}
+	// 没有映射的 id 在另一侧显示为 nobody
+	if got := toHost(userns.UidMappings, 1010); got != overflowID {
+		t.Errorf("toHost(1010) = %d，期望 %d", got, overflowID)
+	}
+	if got := toContainer(userns.UidMappings, 0); got != overflowID {
+		t.Errorf("toContainer(0) = %d，期望 %d", got, overflowID)
+	}
+}
+
+func TestOriginalLowerDir(t *testing.T) {
+	userns := &UserNamespace{
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}
+	dir := "/var/lib/MiniDocker/layers/sha256/abc"
+	remapped := userns.remapDir(dir)
+	if want := filepath.Join(RemapRoot, "100000.100000", dir); remapped != want {
+		t.Errorf("remapDir = %s，期望 %s", remapped, want)
+	}
+	if got := originalLowerDir(remapped); got != dir {
+		t.Errorf("originalLowerDir(%s) = %s，期望 %s", remapped, got, dir)
+	}
+	if got := originalLowerDir(dir); got != dir {
+		t.Errorf("originalLowerDir(%s) = %s，期望原样返回", dir, got)
+	}
+}
@@ -1,6 +1,8 @@
 package container
 
 import (
+	"MiniDocker/image"
+	"bufio"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
@@ -11,22 +13,49 @@ import (
 
 // NewWorkSpace 创建容器的工作空间，包括只读层、写层、挂载点以及用户指定的挂载目录。
 // rootURL 是容器工作空间的根目录，mountURL 是容器最终挂载点（容器运行时根目录）。
-func NewWorkSpace(volume string, imageName string, containerName string) {
-	// 解压 busybox 镜像作为只读层
-	CreateReadOnlyLayer(imageName)
+// userns 不为 nil 时容器运行在用户命名空间中，只读层使用按映射修改了属主的副本，
+// 写层的根目录和新建的数据卷目录属于容器中的 root。
+// 任何一步失败都返回错误，已经创建的目录和挂载由调用者通过 DeleteWorkSpace 清理
+func NewWorkSpace(volume string, imageName string, containerName string, userns *UserNamespace) error {
+	if volume != "" && VolumeMountPoints(volume) == nil {
+		return fmt.Errorf("数据卷 %s 格式错误，正确格式为 /host/path:/container/path", volume)
+	}
+	// 准备镜像的只读层，分层镜像有多个只读层
+	lowerDirs, err := CreateReadOnlyLayer(imageName)
+	if err != nil {
+		return fmt.Errorf("准备镜像 %s 的只读层失败: %v", imageName, err)
+	}
+	// rootless 模式下只映射了当前用户，镜像层本来就属于当前用户，不需要复制
+	if userns != nil && !Rootless() {
+		if lowerDirs, err = userns.RemapLowerDirs(lowerDirs); err != nil {
+			return fmt.Errorf("准备镜像 %s 的只读层失败: %v", imageName, err)
+		}
+	}
 	// 创建写层目录，包括 upper 和 work 目录（OverlayFS 结构要求）
-	CreateWriteLayer(containerName)
+	if err := CreateWriteLayer(containerName); err != nil {
+		return err
+	}
+	// 容器根目录的属主来自 upper 目录，需要在挂载之前修改
+	if err := userns.MkdirAllOwned(UpperDir(containerName), 0755); err != nil {
+		return fmt.Errorf("创建写层目录失败: %v", err)
+	}
+	if Rootless() {
+		// 普通用户不能在宿主机上挂载，只创建目录，根文件系统和数据卷由 init 进程在容器的 mount 命名空间中挂载，
+		// 挂载配置见 RootfsMount 和 VolumeMounts
+		return createRootlessWorkSpace(volume, containerName)
+	}
 	// 挂载 OverlayFS
-	CreateMountPoint(containerName, imageName)
+	if err := CreateMountPoint(containerName, lowerDirs); err != nil {
+		return err
+	}
 	if volume != "" {
 		volumeURLs := volumeUrlExtract(volume)
-		if len(volumeURLs) == 2 && volumeURLs[0] != "" && volumeURLs[1] != "" {
-			MountVolume(volumeURLs, containerName)
-			logrus.Infof("挂载宿主机目录 %s", volumeURLs)
-		} else {
-			logrus.Infof("宿主机目录格式错误，正确格式为 /host/path:/container/path")
+		if err := MountVolume(volumeURLs, containerName, userns); err != nil {
+			return err
 		}
+		logrus.Infof("挂载宿主机目录 %s", volumeURLs)
 	}
+	return nil
 }
 
 // volumeUrlExtract 解析用户传入的挂载路径字符串，格式为 /宿主机路径:/容器路径
@@ -36,114 +65,204 @@ func volumeUrlExtract(volume string) []string {
 	return volumeURLs
 }
 
-// CreateReadOnlyLayer 创建只读层：解压 busybox.tar 到指定目录。
-func CreateReadOnlyLayer(imageName string) error {
-	unTarFolderUrl := RootURL + "/" + imageName + "/"
-	imageUrl := RootURL + "/" + imageName + ".tar"
-	exist, err := PathExists(unTarFolderUrl)
-	if err != nil {
-		logrus.Errorf("判断目录 %s 是否存在失败: %v", unTarFolderUrl, err)
-	}
-
-	needExtract := true
-	if exist {
-		// 检查目录是否为空
-		entries, err := os.ReadDir(unTarFolderUrl)
-		if err != nil {
-			logrus.Errorf("读取目录 %s 内容失败: %v", unTarFolderUrl, err)
-		} else if len(entries) > 0 {
-			// 目录非空，说明已经解压过
-			needExtract = false
-		}
+// VolumeMountPoints 将 -v 参数解析为挂载信息，没有数据卷或格式错误时返回 nil
+func VolumeMountPoints(volume string) []*MountPoint {
+	if volume == "" {
+		return nil
+	}
+	volumeURLs := volumeUrlExtract(volume)
+	if len(volumeURLs) != 2 || volumeURLs[0] == "" || volumeURLs[1] == "" {
+		return nil
 	}
+	return []*MountPoint{{Type: "bind", Source: volumeURLs[0], Destination: volumeURLs[1]}}
+}
 
-	if needExtract {
-		if err := os.MkdirAll(unTarFolderUrl, 0777); err != nil {
-			logrus.Errorf("创建目录 %s 失败: %v", unTarFolderUrl, err)
-			return err
+// CreateReadOnlyLayer 创建只读层，返回容器 overlay 使用的 lowerdir，最上面的层排在最前面
+// imageName 是镜像引用，先通过本地镜像索引解析：分层镜像的每一层已经解压在层存储中，直接使用；
+// 单个 tar 包的镜像解压到它的镜像目录中作为唯一的只读层。
+// 还没有登记的镜像按旧的约定使用 RootURL 下与镜像名同名的 tar 包，只支持不带仓库地址、标签和摘要的镜像名
+func CreateReadOnlyLayer(imageName string) ([]string, error) {
+	img, err := image.Get(imageName)
+	if err == nil {
+		if len(img.Layers) == 0 {
+			if err := extractImage(img.Tarball, img.RootDir); err != nil {
+				return nil, err
+			}
+			return []string{img.RootDir}, nil
 		}
-		if _, err := exec.Command("tar", "-xvf", imageUrl, "-C", unTarFolderUrl).CombinedOutput(); err != nil {
-			logrus.Errorf("解压目录 %s 失败: %v", unTarFolderUrl, err)
-			return err
+		for _, layer := range img.Layers {
+			if !image.LayerExists(layer) {
+				return nil, fmt.Errorf("镜像 %s 的镜像层 %s 不存在，请重新导入镜像", imageName, layer)
+			}
 		}
-		logrus.Infof("镜像 %s 解压完成", imageUrl)
-	} else {
-		logrus.Infof("只读层 %s 已存在且非空，跳过解压", unTarFolderUrl)
+		return img.LowerDirs(), nil
 	}
 
-	// 如果 busybox 目录已经存在，直接返回
-	// 这里可以添加一些日志或提示信息
-	logrus.Infof("只读层 %s 已存在，跳过解压", unTarFolderUrl)
+	ref, parseErr := image.ParseReference(imageName)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	if ref.Domain != "" || ref.Digest != "" || ref.Tag != image.DefaultTag || strings.Contains(ref.Path, "/") {
+		return nil, err
+	}
+	unTarFolderUrl := RootURL + "/" + ref.Path + "/"
+	imageUrl := RootURL + "/" + ref.Path + ".tar"
+	if exist, _ := PathExists(imageUrl); !exist {
+		if exist, _ := PathExists(unTarFolderUrl); !exist {
+			return nil, fmt.Errorf("镜像 %s 不存在，也没有找到镜像文件 %s", imageName, imageUrl)
+		}
+	}
+	if err := extractImage(imageUrl, unTarFolderUrl); err != nil {
+		return nil, err
+	}
+	// 把镜像登记到本地镜像索引中，这样 images 命令可以列出它
+	registerImage(ref.Name(), imageUrl, unTarFolderUrl)
+	return []string{unTarFolderUrl}, nil
+}
+
+// extractImage 将单个 tar 包的镜像解压到 dir 目录，目录非空时说明已经解压过，直接跳过
+func extractImage(imageUrl string, dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		logrus.Infof("只读层 %s 已存在且非空，跳过解压", dir)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("创建目录 %s 失败: %v", dir, err)
+	}
+	if err := UnpackLayer(imageUrl, dir); err != nil {
+		return fmt.Errorf("解压镜像 %s 失败: %v", imageUrl, err)
+	}
+	logrus.Infof("镜像 %s 解压完成", imageUrl)
 	return nil
 }
 
+// UnpackLayer 将镜像层（可能经过 gzip 压缩的 tar 包）解压到 dir 目录，whiteout 文件会转换成 overlayfs 的格式
+func UnpackLayer(layerPath string, dir string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return Untar(f, dir)
+}
+
+// registerImage 如果镜像还没有登记到本地镜像索引中，就登记它
+// 直接放在 RootURL 下的镜像 tar 包第一次运行时会走到这里
+func registerImage(imageName string, imageUrl string, rootDir string) {
+	if img, err := image.Get(imageName); err == nil && filepath.Clean(img.RootDir) == filepath.Clean(rootDir) {
+		return
+	}
+	if exist, _ := PathExists(imageUrl); !exist {
+		logrus.Warnf("镜像文件 %s 不存在，无法登记镜像 %s", imageUrl, imageName)
+		return
+	}
+	img, err := image.Register(imageName, imageUrl, rootDir, "")
+	if err != nil {
+		logrus.Warnf("登记镜像 %s 失败: %v", imageName, err)
+		return
+	}
+	logrus.Infof("镜像 %s 已登记，ID: %s", img.Reference(), img.ShortID())
+}
+
 // CreateWriteLayer 创建写层目录，包括 overlay 所需的 upper 和 work 子目录。
-func CreateWriteLayer(containerName string) {
+func CreateWriteLayer(containerName string) error {
 	writeURL := fmt.Sprintf(WriteLayerURL, containerName)
 	if err := os.MkdirAll(writeURL, 0777); err != nil && !os.IsExist(err) {
-		logrus.Errorf("创建写层目录 %s 失败: %v", writeURL, err)
+		return fmt.Errorf("创建写层目录 %s 失败: %v", writeURL, err)
+	}
+	return nil
+}
+
+// UpperDir 返回容器 overlay 的 upper 目录，容器对文件系统的修改都记录在这里
+func UpperDir(containerName string) string {
+	return filepath.Join(fmt.Sprintf(WriteLayerURL, containerName), "upper")
+}
+
+// mergedDirName rootless 模式下没有可用的 overlay 文件系统时，镜像各层复制到写层目录中的这个子目录作为容器的根文件系统
+const mergedDirName = "merged"
+
+// IsCopiedRootfs 判断容器的根文件系统是否是复制出来的，这时容器的修改没有记录在 upper 目录中
+func IsCopiedRootfs(containerName string) bool {
+	exist, _ := PathExists(filepath.Join(fmt.Sprintf(WriteLayerURL, containerName), mergedDirName))
+	return exist
+}
+
+// workDir 返回容器 overlay 的 work 目录
+func workDir(containerName string) string {
+	return filepath.Join(fmt.Sprintf(WriteLayerURL, containerName), "work")
+}
+
+// createRootlessWorkSpace 创建 rootless 模式下 init 进程挂载所需的目录：overlay 的 work 目录、挂载点和数据卷的宿主机目录
+func createRootlessWorkSpace(volume string, containerName string) error {
+	dirs := []string{workDir(containerName), fmt.Sprintf(MntURL, containerName)}
+	for _, mp := range VolumeMountPoints(volume) {
+		dirs = append(dirs, mp.Source)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("创建目录 %s 失败: %v", dir, err)
+		}
 	}
+	return nil
 }
 
 // CreateMountPoint 创建挂载点，并将 OverlayFS 挂载到该目录。
-func CreateMountPoint(containerName string, imageName string) bool {
+// lowerDirs 为镜像的只读层，最上面的层排在最前面，挂载时拼接为 lowerdir=l3:l2:l1
+func CreateMountPoint(containerName string, lowerDirs []string) error {
 	// 构造挂载相关路径
-	lowerDir := filepath.Join(RootURL, imageName)
-	upperDir := filepath.Join(RootURL, "writeLayer", containerName, "upper")
-	workDir := filepath.Join(RootURL, "writeLayer", containerName, "work")
+	lowerDir := strings.Join(lowerDirs, ":")
+	upperDir := UpperDir(containerName)
+	work := workDir(containerName)
 
 	// 这里使用Sprintf格式化挂载点路径
 	mountPoint := fmt.Sprintf(MntURL, containerName)
 
 	// 创建需要的目录
-	dirs := []string{lowerDir, upperDir, workDir, mountPoint}
+	dirs := append([]string{upperDir, work, mountPoint}, lowerDirs...)
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0777); err != nil {
-			logrus.Errorf("创建目录 %s 失败: %v", dir, err)
-			return false
+			return fmt.Errorf("创建目录 %s 失败: %v", dir, err)
 		}
 	}
 
 	// 构造overlay挂载参数并执行mount命令
-	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, workDir)
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lowerDir, upperDir, work)
+	// 内核限制挂载参数不能超过一页，镜像层过多时无法挂载
+	if len(options) >= os.Getpagesize() {
+		return fmt.Errorf("镜像层过多，overlay 挂载参数长度 %d 超过了内核限制 %d", len(options), os.Getpagesize())
+	}
 
 	// 日志输出挂载命令，确保路径正确
 	logrus.Infof("执行挂载命令: mount -t overlay overlay -o %s %s", options, mountPoint)
 
-	cmd := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, mountPoint)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("挂载 OverlayFS 失败: %v", err)
-		return false
+	output, err := exec.Command("mount", "-t", "overlay", "overlay", "-o", options, mountPoint).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("挂载 OverlayFS 失败: %v: %s", err, strings.TrimSpace(string(output)))
 	}
-
-	return true
+	return nil
 }
 
 // MountVolume 将宿主机目录挂载到容器文件系统的指定路径下
 // volumeURLs[0] 为宿主机路径，volumeURLs[1] 为容器内部路径（相对 mountURL）
-func MountVolume(volumeURLs []string, containerName string) error {
+// userns 不为 nil 时新建的目录属于容器中的 root，已经存在的宿主机目录保持原来的属主
+func MountVolume(volumeURLs []string, containerName string, userns *UserNamespace) error {
 	parentURL := volumeURLs[0]
-	if err := os.MkdirAll(parentURL, 0777); err != nil {
-		logrus.Infof("创建宿主机目录 %s 失败: %v", parentURL, err)
+	if err := userns.MkdirAllOwned(parentURL, 0777); err != nil {
+		return fmt.Errorf("创建宿主机目录 %s 失败: %v", parentURL, err)
 	}
 
 	containerURL := volumeURLs[1]
 	mntURL := fmt.Sprintf(MntURL, containerName)
 	containerVolumeURL := filepath.Join(mntURL, containerURL)
 
-	if err := os.MkdirAll(containerVolumeURL, 0777); err != nil {
-		logrus.Infof("创建容器挂载点目录 %s 失败: %v", containerVolumeURL, err)
+	if err := userns.MkdirAllOwned(containerVolumeURL, 0777); err != nil {
+		return fmt.Errorf("创建容器挂载点目录 %s 失败: %v", containerVolumeURL, err)
 	}
 
 	// 使用 bind mount 将宿主机目录挂载到容器目录
-	cmd := exec.Command("mount", "--bind", parentURL, containerVolumeURL)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		logrus.Errorf("bind mount 失败: %v", err)
-		return err
+	output, err := exec.Command("mount", "--bind", parentURL, containerVolumeURL).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("挂载数据卷 %s 失败: %v: %s", parentURL, err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
@@ -165,6 +284,14 @@ func PathExists(path string) (bool, error) {
 // - volume：卷配置字符串，如果非空则表示容器挂载了卷
 // - containerName：容器名称
 func DeleteWorkSpace(volume string, containerName string) {
+	if Rootless() {
+		// 挂载都在容器的 mount 命名空间中，容器退出后自动卸载，只需要删除目录
+		if err := removeAll(fmt.Sprintf(MntURL, containerName)); err != nil {
+			logrus.Errorf("删除挂载点目录失败: %v", err)
+		}
+		DeleteWriteLayer(containerName)
+		return
+	}
 	if volume != "" {
 		// 如果挂载了卷，解析卷路径
 		volumeURLs := volumeUrlExtract(volume)
@@ -215,21 +342,23 @@ func DeleteMountPointWithVolume(volumeURLs []string, containerName string) error
 	mntURL := fmt.Sprintf(MntURL, containerName)
 	containerUrl := filepath.Join(mntURL, volumeURLs[1])
 	if exist, _ := PathExists(containerUrl); !exist {
+		// 数据卷还没有挂载（例如挂载数据卷时出错），只卸载容器的根文件系统
 		logrus.Warnf("挂载点 %s 不存在，跳过卸载", containerUrl)
-		return nil
+		return DeleteMountPoint(containerName)
 	}
-	// 先卸载容器内部卷的挂载路径
-	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
-		logrus.Errorf("卸载容器内部卷 %s 失败: %v", containerUrl, err)
-		return err
+	// 先卸载容器内部卷的挂载路径，失败时继续卸载容器的根文件系统，不让 overlay 挂载一直留在宿主机上
+	var errs []string
+	if output, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
+		logrus.Errorf("卸载容器内部卷 %s 失败: %v, %s", containerUrl, err, strings.TrimSpace(string(output)))
+		errs = append(errs, fmt.Sprintf("卸载容器内部卷 %s 失败: %v", containerUrl, err))
 	}
-	if _, err := exec.Command("umount", mntURL).CombinedOutput(); err != nil {
-		logrus.Errorf("卸载挂载点 %s 失败: %v", mntURL, err)
-		return err
+	// DeleteMountPoint 使用 lazy umount，会连同还没有卸载的数据卷一起从挂载树上摘下，
+	// 之后删除挂载点目录不会删到宿主机上数据卷中的文件
+	if err := DeleteMountPoint(containerName); err != nil {
+		errs = append(errs, fmt.Sprintf("卸载容器 %s 的根文件系统失败: %v", containerName, err))
 	}
-	// 删除挂载点目录
-	if err := os.RemoveAll(mntURL); err != nil {
-		logrus.Infof("删除挂载点目录 %s 失败: %v", mntURL, err)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
 	}
 	return nil
 }
@@ -240,9 +369,41 @@ func DeleteMountPointWithVolume(volumeURLs []string, containerName string) error
 func DeleteWriteLayer(containerName string) {
 	writeURL := fmt.Sprintf(WriteLayerURL, containerName)
 	// 强制删除写层目录
-	if err := os.RemoveAll(writeURL); err != nil {
+	if err := removeAll(writeURL); err != nil {
 		logrus.Errorf("删除写层目录 %s 失败: %v", writeURL, err)
 	} else {
 		logrus.Infof("成功删除写层目录 %s", writeURL)
 	}
 }
+
+// OverlayLowerDirs 返回宿主机上所有 overlay 挂载正在使用的 lowerdir 目录
+// 通过解析 /proc/self/mountinfo 中 overlay 挂载的 lowerdir 选项得到，按用户命名空间映射复制的只读层换算成原来的目录
+func OverlayLowerDirs() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lowerDirs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 格式: ID 父ID 设备号 root 挂载点 挂载选项 [可选字段...] - 文件系统类型 挂载源 超级块选项
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) != 2 {
+			continue
+		}
+		after := strings.Fields(fields[1])
+		if len(after) < 3 || after[0] != "overlay" {
+			continue
+		}
+		for _, opt := range strings.Split(after[2], ",") {
+			if strings.HasPrefix(opt, "lowerdir=") {
+				for _, dir := range strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":") {
+					lowerDirs = append(lowerDirs, originalLowerDir(filepath.Clean(dir)))
+				}
+			}
+		}
+	}
+	return lowerDirs, scanner.Err()
+}
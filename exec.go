@@ -1,35 +1,39 @@
 package main
 
 import (
+	"MiniDocker/container"
 	_ "MiniDocker/nsenter" // 引入 nsenter 包，自动执行其中的 C 代码
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
 	"os/exec"
-	"strings"
 	"syscall"
 )
 
-// 定义环境变量名称
-const ENV_EXEC_PID = "MiniDocker_pid" // 要进入的目标容器进程 PID
-const ENV_EXEC_CMD = "MiniDocker_cmd" // 要在容器中执行的命令
+// ENV_EXEC_PID 要进入的目标容器进程 PID，设置了它的进程由 nsenter 中的 C 代码在启动时放进容器
+const ENV_EXEC_PID = "MiniDocker_pid"
 
-// ExecContainer 用于在指定容器内执行命令
-func ExecContainer(containerName string, comArray []string) {
-	// 通过容器名查找对应的 PID
-	pid, err := GetContainerPidByName(containerName)
+// ExecContainer 用于在指定容器内执行命令，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+// 命令的参数和容器的环境变量、工作目录、用户一起通过管道以 JSON 格式传给进入容器的进程
+func ExecContainer(containerRef string, comArray []string) {
+	// 通过容器名或 ID 查找对应的 PID
+	info, err := resolveContainer(containerRef)
 	if err != nil {
-		logrus.Errorf("ExecContainer getContainerPidByName %s 发生错误 %v", containerName, err)
+		logrus.Errorf("ExecContainer 查找容器 %s 发生错误 %v", containerRef, err)
 		return
 	}
+	if info.Status != container.RUNNING {
+		logrus.Errorf("容器 %s 没有在运行", info.Name)
+		return
+	}
+	containerName := info.Name
+	pid := info.Pid
 
-	// 将用户输入的命令数组转成空格分隔的字符串，比如 ["ls", "-l"] -> "ls -l"
-	cmdStr := strings.Join(comArray, " ")
 	logrus.Infof("容器的 PID: %s", pid)
-	logrus.Infof("要执行的命令: %s", cmdStr)
+	logrus.Infof("要执行的命令: %q", comArray)
 
 	// 构建容器根文件系统的完整路径
-	containerRootfs := fmt.Sprintf("/root/mnt/%s", containerName)
+	containerRootfs := fmt.Sprintf(container.MntURL, containerName)
 	logrus.Infof("容器根文件系统路径: %s", containerRootfs)
 
 	// 验证容器根文件系统路径是否存在
@@ -38,28 +42,28 @@ func ExecContainer(containerName string, comArray []string) {
 		return
 	}
 
+	containerEnv, err := getEnvsByPid(pid)
+	if err != nil {
+		logrus.Errorf("获取容器环境变量失败: %v", err)
+		return
+	}
+	readPipe, writePipe, err := container.NewPipe()
+	if err != nil {
+		logrus.Errorf("管道创建失败: %v", err)
+		return
+	}
+
 	// 创建一个新的命令：再次执行自己（/proc/self/exe），并传递参数 "exec"
 	cmd := exec.Command("/proc/self/exe", "exec")
 	// 将当前进程的标准输入输出错误传递给新进程，保持一致
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-
-	os.Setenv(ENV_EXEC_PID, pid)    // 设置环境变量，供 nsenter 中的 enter_namespace 使用
-	os.Setenv(ENV_EXEC_CMD, cmdStr) // 设置环境变量，供 nsenter 中的 enter_namespace 使用
-
-	containerEnv, err := getEnvsByPid(pid)
-	if err != nil {
-		logrus.Errorf("获取容器环境变量失败: %v", err)
-		return
-	}
+	cmd.ExtraFiles = []*os.File{readPipe}
 
 	// 设置环境变量，供 nsenter 中的 enter_namespace 使用
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("%s=%s", ENV_EXEC_PID, pid),
-		fmt.Sprintf("%s=%s", ENV_EXEC_CMD, cmdStr),
-		fmt.Sprintf("MiniDocker_env=%s", containerEnv),
-		fmt.Sprintf("MiniDocker_rootfs=%s", containerRootfs),
 	)
 
 	// 重要: 设置正确的 TTY 参数
@@ -67,9 +71,30 @@ func ExecContainer(containerName string, comArray []string) {
 		Cloneflags: syscall.CLONE_NEWNS, // 新的挂载命名空间
 		Setsid:     true,                // 创建新会话
 	}
+	if container.Rootless() {
+		// 普通用户在当前用户命名空间中没有权限创建 mount 命名空间，nsenter 随后会进入容器的 mount 命名空间，不需要新建
+		cmd.SysProcAttr.Cloneflags = 0
+	}
 
-	// 启动新进程，进入容器的 namespace 并执行命令
-	if err := cmd.Run(); err != nil {
+	// 启动新进程，进入容器的 namespace 后从管道中读取要执行的命令
+	if err := cmd.Start(); err != nil {
+		readPipe.Close()
+		writePipe.Close()
+		logrus.Errorf("执行容器 %s 发生错误 %v", containerName, err)
+		return
+	}
+	readPipe.Close()
+	err = container.WriteInitConfig(writePipe, &container.InitConfig{
+		Args: comArray,
+		Env:  containerEnv,
+		Cwd:  info.WorkingDir,
+		User: info.User,
+	})
+	writePipe.Close()
+	if err != nil {
+		logrus.Errorf("发送命令失败: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
 		logrus.Errorf("执行容器 %s 发生错误 %v", containerName, err)
 	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"MiniDocker/cgroup"
+	"MiniDocker/container"
+	"MiniDocker/network"
+	"github.com/sirupsen/logrus"
+	"os"
+	"syscall"
+	"time"
+)
+
+// exitCodeFromState 根据进程的退出状态计算退出码
+// 与 shell 的约定一致：正常退出时为退出码，被信号杀死时为 128+信号值（如被 SIGKILL 杀死为 137）
+func exitCodeFromState(state *os.ProcessState) int {
+	if state == nil {
+		return -1
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// recordContainerExit 在容器 init 进程退出后记录退出码、退出时间以及是否被 OOM 杀死
+// 必须在删除容器 cgroup 之前调用，OOM 事件的计数保存在容器的 memory cgroup 中
+func recordContainerExit(containerName string, state *os.ProcessState, cgroupManager *cgroup.CgroupManager) {
+	info, err := getContainerInfoByName(containerName)
+	if err != nil {
+		logrus.Errorf("获取容器 %s 信息失败，无法记录退出状态: %v", containerName, err)
+		return
+	}
+	info.Status = container.EXIT
+	info.Pid = ""
+	info.ExitCode = exitCodeFromState(state)
+	info.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	// rootless 模式下容器不使用 cgroup，没有 OOM 事件可读；没有记录 cgroup 路径的容器也无法读取
+	if !container.Rootless() && cgroupManager != nil {
+		if oomKills, err := cgroupManager.OOMKills(); err != nil {
+			logrus.Warnf("读取容器 %s 的 OOM 事件失败: %v", containerName, err)
+		} else {
+			info.OOMKilled = oomKills > 0
+		}
+	}
+	// 释放容器的 IP 地址，删除端口映射的 iptables 规则，终止 slirp4netns（网络命名空间已经随容器销毁，它不会自己退出）
+	if err := network.Disconnect(info); err != nil {
+		logrus.Warnf("断开容器 %s 的网络失败: %v", containerName, err)
+	}
+	if err := updateContainerInfo(info); err != nil {
+		logrus.Errorf("记录容器 %s 退出状态失败: %v", containerName, err)
+		return
+	}
+	if info.OOMKilled {
+		logrus.Warnf("容器 %s 超出内存限制被 OOM killer 杀死，退出码 %d", containerName, info.ExitCode)
+	} else {
+		logrus.Infof("容器 %s 已退出，退出码 %d", containerName, info.ExitCode)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"os/exec"
+	"testing"
+)
+
+func TestExitCodeFromState(t *testing.T) {
+	cases := []struct {
+		script string
+		want   int
+	}{
+		{script: "exit 0", want: 0},
+		{script: "exit 3", want: 3},
+		{script: "kill -TERM $$", want: 143}, // 被信号杀死时为 128+信号值
+		{script: "kill -KILL $$", want: 137},
+	}
+	for _, c := range cases {
+		cmd := exec.Command("sh", "-c", c.script)
+		cmd.Run()
+		if got := exitCodeFromState(cmd.ProcessState); got != c.want {
+			t.Errorf("exitCodeFromState(%q) = %d, 期望 %d", c.script, got, c.want)
+		}
+	}
+	if got := exitCodeFromState(nil); got != -1 {
+		t.Errorf("exitCodeFromState(nil) = %d, 期望 -1", got)
+	}
+}
+
+func TestFormatStatus(t *testing.T) {
+	cases := []struct {
+		info container.Info
+		want string
+	}{
+		{info: container.Info{Status: container.RUNNING}, want: "running"},
+		{info: container.Info{Status: container.STOPPED, ExitCode: 1}, want: "stopped"},
+		{info: container.Info{Status: container.EXIT, ExitCode: 0}, want: "exit (0)"},
+		{info: container.Info{Status: container.EXIT, ExitCode: 143}, want: "exit (143)"},
+		{info: container.Info{Status: container.EXIT, ExitCode: 137, OOMKilled: true}, want: "exit (137, OOMKilled)"},
+	}
+	for _, c := range cases {
+		if got := formatStatus(&c.info); got != c.want {
+			t.Errorf("formatStatus(%+v) = %q, 期望 %q", c.info, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// exportExcludes 导出容器文件系统时只保留目录本身、跳过其中内容的目录，它们在容器中都是单独挂载的
+var exportExcludes = []string{"proc", "sys", "dev"}
+
+// exportContainer 将容器的根文件系统打包成 tar 包，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+// output 为空时写到标准输出。容器挂载的数据卷不属于容器的文件系统，同样跳过
+func exportContainer(containerRef string, output string) error {
+	info, err := resolveContainer(containerRef)
+	if err != nil {
+		return fmt.Errorf("获取容器信息失败: %v", err)
+	}
+	// 容器退出后挂载点就被卸载并删除了，只能导出正在运行的容器
+	if info.Status != container.RUNNING {
+		return fmt.Errorf("容器 %s 没有在运行，它的文件系统已经卸载", info.Name)
+	}
+	rootfs := fmt.Sprintf(container.MntURL, info.Name)
+	if container.Rootless() {
+		// rootless 模式下根文件系统挂载在容器的 mount 命名空间中，宿主机上的挂载点是空目录，通过 init 进程的根目录访问
+		rootfs = fmt.Sprintf("/proc/%s/root/.", info.Pid)
+	}
+	if _, err := os.Stat(rootfs); err != nil {
+		return fmt.Errorf("读取容器 %s 的根文件系统失败: %v", info.Name, err)
+	}
+	excludes := append([]string{}, exportExcludes...)
+	for _, mount := range info.Mounts {
+		excludes = append(excludes, filepath.Clean("/"+mount.Destination))
+	}
+
+	if output == "" {
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("不能把 tar 包写到终端，请通过 -o 指定文件或重定向标准输出")
+		}
+		if err := container.TarWithUserNamespace(rootfs, os.Stdout, info.UserNamespace, excludes...); err != nil {
+			return fmt.Errorf("导出容器 %s 失败: %v", info.Name, err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("创建文件 %s 失败: %v", output, err)
+	}
+	err = container.TarWithUserNamespace(rootfs, f, info.UserNamespace, excludes...)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return fmt.Errorf("导出容器 %s 失败: %v", info.Name, err)
+	}
+	logrus.Infof("容器 %s 的文件系统已导出到 %s", info.Name, output)
+	return nil
+}
@@ -0,0 +1,107 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// layerStorePath 镜像层的存储位置
+// 每一层按解压后的摘要（diff_id）解压到单独的目录中，例如 layers/sha256/<hex>，多个镜像共用相同的层
+var layerStorePath = "/var/lib/MiniDocker/layers/"
+
+// LayerDir 返回镜像层解压后的目录
+func LayerDir(diffID string) string {
+	return path.Join(layerStorePath, strings.Replace(diffID, ":", "/", 1))
+}
+
+// LayerExists 判断镜像层是否已经解压到层存储中
+func LayerExists(diffID string) bool {
+	_, err := os.Stat(LayerDir(diffID))
+	return err == nil
+}
+
+// CreateLayer 把镜像层解压到层存储中，已经存在的层直接跳过
+// unpack 负责把镜像层的内容解压到给定的目录，先解压到临时目录再重命名，避免留下解压了一半的层
+func CreateLayer(diffID string, unpack func(dir string) error) error {
+	if LayerExists(diffID) {
+		return nil
+	}
+	layerDir := LayerDir(diffID)
+	parentDir, name := path.Split(layerDir)
+	if err := os.MkdirAll(parentDir, 0755); err != nil {
+		return fmt.Errorf("创建层存储目录 %s 失败: %v", parentDir, err)
+	}
+	tmpDir, err := ioutil.TempDir(parentDir, name+".tmp-")
+	if err != nil {
+		return fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	// 镜像层的根目录权限以解压出来的内容为准，默认与普通目录一致
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	if err := unpack(tmpDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("解压镜像层 %s 失败: %v", diffID, err)
+	}
+	if err := os.Rename(tmpDir, layerDir); err != nil {
+		os.RemoveAll(tmpDir)
+		// 其他进程可能同时解压了同一层
+		if LayerExists(diffID) {
+			return nil
+		}
+		return fmt.Errorf("保存镜像层 %s 失败: %v", diffID, err)
+	}
+	return nil
+}
+
+// LayerTarball 返回镜像层 tar 包在层存储中的路径，与解压目录同名，例如 layers/sha256/<hex>.tar
+// 保留原始的 tar 包是为了导出镜像时得到与 diff_id 一致的内容
+func LayerTarball(diffID string) string {
+	return LayerDir(diffID) + ".tar"
+}
+
+// SaveLayerTarball 把镜像层的 tar 包保存到层存储中，已经保存过的层直接跳过
+func SaveLayerTarball(diffID string, r io.Reader) error {
+	tarball := LayerTarball(diffID)
+	if _, err := os.Stat(tarball); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(tarball), 0755); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(path.Dir(tarball), path.Base(tarball)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), tarball)
+}
+
+// LayerStored 判断镜像层是否已经解压到层存储中，并且保留了原始的 tar 包
+func LayerStored(diffID string) bool {
+	if !LayerExists(diffID) {
+		return false
+	}
+	_, err := os.Stat(LayerTarball(diffID))
+	return err == nil
+}
+
+// removeLayer 从层存储中删除镜像层
+func removeLayer(diffID string) error {
+	if err := os.Remove(LayerTarball(diffID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(LayerDir(diffID))
+}
@@ -0,0 +1,443 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// OCI 镜像规范以及 docker 镜像格式中使用的 mediaType
+const (
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig          = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip       = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// OCI 镜像布局中用于记录镜像名的注解
+const (
+	AnnotationRefName        = "org.opencontainers.image.ref.name"
+	AnnotationContainerdName = "io.containerd.image.name"
+)
+
+// Descriptor 描述 OCI 镜像布局中的一个内容（manifest、config 或镜像层）
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform 描述镜像适用的平台
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Index 对应 OCI 镜像布局中的 index.json，也用于多平台镜像的 manifest 列表
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest 描述一个镜像由哪个 config 和哪些镜像层组成
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ConfigFile 镜像的 config，rootfs.diff_ids 按从下到上的顺序记录每一层解压后的摘要
+type ConfigFile struct {
+	Created      string          `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig 镜像中记录的容器默认配置，字段名与 docker 保持一致
+// 容器启动时执行 Entrypoint + Cmd，run 命令中给出的命令会替换 Cmd
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`         // 运行用户，格式为 user[:group]，可以是名字或数字 ID
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"` // 容器监听的端口，例如 "80/tcp"
+	Env          []string            `json:"Env,omitempty"`          // 环境变量，格式为 KEY=value
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`   // 入口程序
+	Cmd          []string            `json:"Cmd,omitempty"`          // 默认命令，有 Entrypoint 时作为它的参数
+	WorkingDir   string              `json:"WorkingDir,omitempty"`   // 工作目录
+}
+
+// History 镜像的构建历史，每一项对应一次 commit 或构建步骤
+type History struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Author     string `json:"author,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"` // 该步骤没有产生新的镜像层
+}
+
+// RootFS 镜像的根文件系统由哪些镜像层组成
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// dockerArchiveManifest 对应 docker save 生成的 manifest.json 中的一项
+type dockerArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Source 是从 OCI 镜像布局或 docker save 归档中读出的一个待导入的镜像
+// 所有文件的摘要都已经校验过
+type Source struct {
+	Names        []string       // 镜像名，可能只有标签（如 "latest"），由调用者补全
+	ConfigPath   string         // config 文件路径
+	ConfigDigest string         // config 文件的摘要，也是导入后的镜像 ID
+	RepoDigest   string         // manifest 的摘要，docker save 归档中没有 manifest，为空
+	Config       *ConfigFile    // 解析后的 config
+	Layers       []*LayerSource // 镜像层，从下到上排列
+}
+
+// LayerSource 是待导入镜像中的一层
+type LayerSource struct {
+	BlobPath string // 镜像层文件路径
+	DiffID   string // 镜像层解压后的摘要
+	Size     int64  // 镜像层文件大小
+}
+
+// ReadArchiveDir 读取已经解开的镜像目录，自动识别 OCI 镜像布局（index.json）和 docker save 归档（manifest.json）
+func ReadArchiveDir(dir string) ([]*Source, error) {
+	if _, err := os.Stat(path.Join(dir, "index.json")); err == nil {
+		return ReadOCILayout(dir)
+	}
+	if _, err := os.Stat(path.Join(dir, "manifest.json")); err == nil {
+		return ReadDockerArchive(dir)
+	}
+	return nil, fmt.Errorf("%s 既不是 OCI 镜像布局也不是 docker save 归档，缺少 index.json 或 manifest.json", dir)
+}
+
+// ReadOCILayout 读取 OCI 镜像布局目录，校验 index.json 引用的 manifest、config 和镜像层的摘要
+func ReadOCILayout(dir string) ([]*Source, error) {
+	var index Index
+	if err := readJSONFile(path.Join(dir, "index.json"), &index); err != nil {
+		return nil, fmt.Errorf("读取 index.json 失败: %v", err)
+	}
+	var sources []*Source
+	for _, desc := range index.Manifests {
+		src, err := readOCIManifest(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		src.Names = ociRefNames(desc.Annotations)
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("index.json 中没有镜像")
+	}
+	return sources, nil
+}
+
+// readOCIManifest 读取 desc 指向的 manifest，多平台镜像时选择与当前平台匹配的 manifest
+func readOCIManifest(dir string, desc Descriptor) (*Source, error) {
+	content, err := readBlob(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	switch desc.MediaType {
+	case MediaTypeOCIIndex, MediaTypeDockerManifestList:
+		var index Index
+		if err := json.Unmarshal(content, &index); err != nil {
+			return nil, fmt.Errorf("解析 manifest 列表 %s 失败: %v", desc.Digest, err)
+		}
+		for _, m := range index.Manifests {
+			if m.Platform == nil || (m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH) {
+				return readOCIManifest(dir, m)
+			}
+		}
+		return nil, fmt.Errorf("manifest 列表 %s 中没有 %s/%s 平台的镜像", desc.Digest, runtime.GOOS, runtime.GOARCH)
+	case MediaTypeOCIManifest, MediaTypeDockerManifest, "":
+	default:
+		return nil, fmt.Errorf("不支持的 manifest 类型 %s", desc.MediaType)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("解析 manifest %s 失败: %v", desc.Digest, err)
+	}
+	configPath, err := BlobPath(dir, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyDigest(configPath, manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	src := &Source{ConfigPath: configPath, ConfigDigest: manifest.Config.Digest, RepoDigest: desc.Digest}
+	if src.Config, err = readConfigFile(configPath); err != nil {
+		return nil, err
+	}
+	if len(manifest.Layers) != len(src.Config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("manifest %s 有 %d 层，但 config 中记录了 %d 层", desc.Digest, len(manifest.Layers), len(src.Config.RootFS.DiffIDs))
+	}
+	for i, layer := range manifest.Layers {
+		layerPath, err := BlobPath(dir, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		diffID := src.Config.RootFS.DiffIDs[i]
+		// pull 时已经在层存储中的层不会下载，BlobPath 为空表示不需要再导入
+		if _, err := os.Stat(layerPath); os.IsNotExist(err) && LayerStored(diffID) {
+			src.Layers = append(src.Layers, &LayerSource{DiffID: diffID, Size: layer.Size})
+			continue
+		}
+		if err := VerifyDigest(layerPath, layer.Digest); err != nil {
+			return nil, err
+		}
+		// 层存储以 diff_id 为索引，还没有解压过的层需要确认解压后的内容与 config 一致
+		if !LayerExists(diffID) {
+			if actual, err := DiffID(layerPath); err != nil {
+				return nil, err
+			} else if actual != diffID {
+				return nil, fmt.Errorf("镜像层 %s 解压后的摘要为 %s，与 config 中记录的 %s 不一致", layer.Digest, actual, diffID)
+			}
+		}
+		src.Layers = append(src.Layers, &LayerSource{
+			BlobPath: layerPath,
+			DiffID:   diffID,
+			Size:     layer.Size,
+		})
+	}
+	return src, nil
+}
+
+// ociRefNames 从 index.json 的注解中取出镜像名
+// containerd 和新版 docker 会在 io.containerd.image.name 中记录完整的镜像名，ref.name 中通常只有标签
+func ociRefNames(annotations map[string]string) []string {
+	if name := annotations[AnnotationContainerdName]; name != "" {
+		return []string{name}
+	}
+	if name := annotations[AnnotationRefName]; name != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// ReadDockerArchive 读取 docker save 生成的归档目录
+// docker save 中的镜像层是未压缩的 tar 包，文件的摘要就是 config 中记录的 diff_id
+func ReadDockerArchive(dir string) ([]*Source, error) {
+	var manifests []dockerArchiveManifest
+	if err := readJSONFile(path.Join(dir, "manifest.json"), &manifests); err != nil {
+		return nil, fmt.Errorf("读取 manifest.json 失败: %v", err)
+	}
+	var sources []*Source
+	for _, m := range manifests {
+		configPath, err := archivePath(dir, m.Config)
+		if err != nil {
+			return nil, err
+		}
+		configDigest, err := digestFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		src := &Source{Names: m.RepoTags, ConfigPath: configPath, ConfigDigest: configDigest}
+		if src.Config, err = readConfigFile(configPath); err != nil {
+			return nil, err
+		}
+		if len(m.Layers) != len(src.Config.RootFS.DiffIDs) {
+			return nil, fmt.Errorf("镜像 %v 有 %d 层，但 config 中记录了 %d 层", m.RepoTags, len(m.Layers), len(src.Config.RootFS.DiffIDs))
+		}
+		for i, layer := range m.Layers {
+			layerPath, err := archivePath(dir, layer)
+			if err != nil {
+				return nil, err
+			}
+			diffID := src.Config.RootFS.DiffIDs[i]
+			if actual, err := DiffID(layerPath); err != nil {
+				return nil, err
+			} else if actual != diffID {
+				return nil, fmt.Errorf("镜像层 %s 的摘要为 %s，与 config 中记录的 %s 不一致", layer, actual, diffID)
+			}
+			stat, err := os.Stat(layerPath)
+			if err != nil {
+				return nil, err
+			}
+			src.Layers = append(src.Layers, &LayerSource{BlobPath: layerPath, DiffID: diffID, Size: stat.Size()})
+		}
+		sources = append(sources, src)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("manifest.json 中没有镜像")
+	}
+	return sources, nil
+}
+
+// VerifyDigest 校验文件内容的 sha256 摘要是否与 digest 一致
+func VerifyDigest(file string, digest string) error {
+	actual, err := digestFile(file)
+	if err != nil {
+		return err
+	}
+	if actual != digest {
+		return fmt.Errorf("%s 的摘要为 %s，期望 %s，文件可能已损坏", file, actual, digest)
+	}
+	return nil
+}
+
+// DiffID 计算镜像层解压后的 sha256 摘要，gzip 压缩的镜像层会先解压
+func DiffID(layerPath string) (string, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	reader, err := DecompressStream(f)
+	if err != nil {
+		return "", fmt.Errorf("解压镜像层 %s 失败: %v", layerPath, err)
+	}
+	defer reader.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", fmt.Errorf("读取镜像层 %s 失败: %v", layerPath, err)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// DecompressStream 根据文件头判断数据是否经过压缩，返回解压后的数据流
+// 支持 gzip 和 zstd，zstd 通过系统中的 zstd 命令解压
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(4)
+	if err == nil && bytes.Equal(magic, zstdMagic) {
+		return zstdDecompress(buf)
+	}
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+// zstdMagic zstd 压缩数据的文件头
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdDecompress 启动 zstd 命令解压数据流，vendor 中没有 zstd 的 Go 实现
+func zstdDecompress(r io.Reader) (io.ReadCloser, error) {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		return nil, fmt.Errorf("解压 zstd 压缩的数据需要先安装 zstd 命令: %v", err)
+	}
+	cmd := exec.Command(zstdPath, "-d", "-c", "-q")
+	cmd.Stdin = r
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("启动 zstd 失败: %v", err)
+	}
+	return &cmdReader{stdout: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+// cmdReader 读取命令的标准输出，读到末尾时检查命令是否执行成功
+type cmdReader struct {
+	stdout io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	waited bool
+}
+
+func (c *cmdReader) Read(p []byte) (int, error) {
+	n, err := c.stdout.Read(p)
+	if err == io.EOF && !c.waited {
+		c.waited = true
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			return n, fmt.Errorf("%s 执行失败: %v: %s", path.Base(c.cmd.Path), waitErr, strings.TrimSpace(c.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+// Close 提前关闭时终止命令，避免留下僵尸进程
+func (c *cmdReader) Close() error {
+	if c.waited {
+		return nil
+	}
+	c.waited = true
+	c.stdout.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+// BlobPath 返回 OCI 镜像布局中 digest 对应的文件路径，例如 blobs/sha256/<hex>
+// digest 可能来自镜像仓库或归档，必须是合法的 sha256 摘要，避免拼出镜像布局之外的路径
+func BlobPath(dir string, digest string) (string, error) {
+	algorithm, hexPart, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || !sha256Regexp.MatchString(hexPart) {
+		return "", fmt.Errorf("不支持的摘要 %q，目前只支持 sha256", digest)
+	}
+	return path.Join(dir, "blobs", algorithm, hexPart), nil
+}
+
+// readBlob 读取 OCI 镜像布局中的 blob 并校验摘要
+func readBlob(dir string, digest string) ([]byte, error) {
+	file, err := BlobPath(dir, digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyDigest(file, digest); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(file)
+}
+
+// archivePath 返回归档中相对路径对应的文件路径，拒绝指向归档目录之外的路径
+func archivePath(dir string, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("归档中的文件名为空")
+	}
+	return filepath.Join(dir, filepath.Clean("/"+name)), nil
+}
+
+// readConfigFile 读取并解析镜像的 config
+func readConfigFile(configPath string) (*ConfigFile, error) {
+	var config ConfigFile
+	if err := readJSONFile(configPath, &config); err != nil {
+		return nil, fmt.Errorf("读取镜像 config 失败: %v", err)
+	}
+	return &config, nil
+}
+
+// readJSONFile 读取 JSON 文件并解析到 v 中
+func readJSONFile(file string, v interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,221 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+// sha256Digest 计算内容的 sha256 摘要
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// tarLayer 生成只包含一个文件的 tar 包
+func tarLayer(t *testing.T, name string, content string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipBytes 对内容进行 gzip 压缩
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeBlob 将内容写入 OCI 镜像布局的 blobs 目录，返回对应的描述符
+func writeBlob(t *testing.T, dir string, mediaType string, content []byte) Descriptor {
+	digest := sha256Digest(content)
+	file, _ := BlobPath(dir, digest)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Descriptor{MediaType: mediaType, Digest: digest, Size: int64(len(content))}
+}
+
+// writeJSONBlob 将 v 序列化后写入 blobs 目录
+func writeJSONBlob(t *testing.T, dir string, mediaType string, v interface{}) Descriptor {
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeBlob(t, dir, mediaType, content)
+}
+
+// fakeOCILayout 在临时目录中生成一个两层的 OCI 镜像布局，第一层经过 gzip 压缩
+func fakeOCILayout(t *testing.T) (string, []string, []Descriptor) {
+	dir := t.TempDir()
+	layer1 := tarLayer(t, "bin/sh", "shell")
+	layer2 := tarLayer(t, "etc/hostname", "mini")
+	diffIDs := []string{sha256Digest(layer1), sha256Digest(layer2)}
+	layers := []Descriptor{
+		writeBlob(t, dir, MediaTypeOCILayerGzip, gzipBytes(t, layer1)),
+		writeBlob(t, dir, MediaTypeOCILayer, layer2),
+	}
+	config := writeJSONBlob(t, dir, MediaTypeOCIConfig, ConfigFile{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       RootFS{Type: "layers", DiffIDs: diffIDs},
+	})
+	manifest := writeJSONBlob(t, dir, MediaTypeOCIManifest, Manifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Config: config, Layers: layers})
+	manifest.Annotations = map[string]string{AnnotationRefName: "1.36"}
+	index, _ := json.Marshal(Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}})
+	if err := ioutil.WriteFile(path.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, diffIDs, layers
+}
+
+func TestReadOCILayout(t *testing.T) {
+	dir, diffIDs, _ := fakeOCILayout(t)
+	sources, err := ReadArchiveDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 {
+		t.Fatalf("读出了 %d 个镜像，期望 1 个", len(sources))
+	}
+	src := sources[0]
+	if len(src.Names) != 1 || src.Names[0] != "1.36" {
+		t.Errorf("镜像名 = %v, 期望 [1.36]", src.Names)
+	}
+	if len(src.Layers) != 2 {
+		t.Fatalf("镜像有 %d 层，期望 2 层", len(src.Layers))
+	}
+	for i, layer := range src.Layers {
+		if layer.DiffID != diffIDs[i] {
+			t.Errorf("第 %d 层 diff_id = %s, 期望 %s", i, layer.DiffID, diffIDs[i])
+		}
+	}
+}
+
+func TestReadOCILayoutCorruptBlob(t *testing.T) {
+	dir, _, layers := fakeOCILayout(t)
+	file, _ := BlobPath(dir, layers[1].Digest)
+	if err := ioutil.WriteFile(file, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadOCILayout(dir); err == nil {
+		t.Error("镜像层损坏时应当报错")
+	}
+}
+
+func TestReadDockerArchive(t *testing.T) {
+	dir := t.TempDir()
+	layer := tarLayer(t, "bin/sh", "shell")
+	if err := os.MkdirAll(path.Join(dir, "abc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "abc", "layer.tar"), layer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(ConfigFile{RootFS: RootFS{Type: "layers", DiffIDs: []string{sha256Digest(layer)}}})
+	if err := ioutil.WriteFile(path.Join(dir, "config.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := json.Marshal([]dockerArchiveManifest{{Config: "config.json", RepoTags: []string{"busybox:latest"}, Layers: []string{"abc/layer.tar"}}})
+	if err := ioutil.WriteFile(path.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := ReadArchiveDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources[0].ConfigDigest != sha256Digest(config) || sources[0].Names[0] != "busybox:latest" {
+		t.Errorf("读出的镜像信息错误: %+v", sources[0])
+	}
+}
+
+func TestCreateLayer(t *testing.T) {
+	old := layerStorePath
+	layerStorePath = t.TempDir()
+	t.Cleanup(func() { layerStorePath = old })
+
+	diffID := sha256Digest([]byte("layer"))
+	calls := 0
+	unpack := func(dir string) error {
+		calls++
+		return ioutil.WriteFile(path.Join(dir, "file"), []byte("layer"), 0644)
+	}
+	for i := 0; i < 2; i++ {
+		if err := CreateLayer(diffID, unpack); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("同一层解压了 %d 次，期望只解压一次", calls)
+	}
+	if _, err := os.Stat(path.Join(LayerDir(diffID), "file")); err != nil {
+		t.Errorf("镜像层没有解压到层存储中: %v", err)
+	}
+}
+
+func TestDecompressStreamZstd(t *testing.T) {
+	zstdPath, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("没有安装 zstd 命令")
+	}
+	layer := tarLayer(t, "bin/sh", "shell")
+	cmd := exec.Command(zstdPath, "-c", "-q")
+	cmd.Stdin = bytes.NewReader(layer)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range map[string][]byte{"zstd": compressed, "gzip": gzipBytes(t, layer), "tar": layer} {
+		stream, err := DecompressStream(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		decompressed, err := ioutil.ReadAll(stream)
+		stream.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(decompressed, layer) {
+			t.Errorf("%s: 解压后的内容与原始内容不一致", name)
+		}
+	}
+
+	// 数据损坏时读取应当报错
+	corrupted := append(append([]byte{}, compressed[:len(compressed)/2]...), 0, 1, 2, 3)
+	stream, err := DecompressStream(bytes.NewReader(corrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if _, err := ioutil.ReadAll(stream); err == nil {
+		t.Error("zstd 数据损坏时应当报错")
+	}
+}
@@ -0,0 +1,149 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegistry 镜像名中没有仓库地址时使用的镜像仓库
+const DefaultRegistry = "docker.io"
+
+// 镜像名中最多允许的字符数，与 docker 的限制一致
+const maxNameLength = 255
+
+var (
+	// domainRegexp 镜像仓库地址，例如 localhost:5000、registry.example.com
+	domainRegexp = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	// pathComponentRegexp 仓库路径中以 / 分隔的每一段，只允许小写字母、数字和分隔符
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	// tagRegexp 镜像标签
+	tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	// digestRegexp 内容摘要，例如 sha256:<64 位十六进制>
+	digestRegexp = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	// sha256Regexp sha256 摘要的十六进制部分
+	sha256Regexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// Reference 解析后的镜像引用，格式为 [registry/]repository[:tag][@digest]
+// docker.io 上的镜像会去掉仓库地址和 library/ 前缀，保存为 busybox 这样的简写形式
+type Reference struct {
+	Domain string // 镜像仓库地址，例如 localhost:5000，docker.io 上的镜像为空
+	Path   string // 镜像在仓库中的路径，例如 busybox、ns/app
+	Tag    string // 镜像标签，没有标签也没有摘要时为 latest，只有摘要时为空
+	Digest string // 镜像摘要，例如 sha256:9a0b...，没有时为空
+}
+
+// ParseReference 解析镜像引用，例如 busybox、busybox:1.36、localhost:5000/ns/app:v2、app@sha256:...
+// 第一段包含 . 或 :，或者是 localhost 时，才被当作镜像仓库地址
+func ParseReference(ref string) (*Reference, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("镜像名不能为空")
+	}
+	r := &Reference{}
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.Digest = name[:i], name[i+1:]
+		if err := validateDigest(r.Digest); err != nil {
+			return nil, fmt.Errorf("镜像名 %s 不合法: %v", ref, err)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 && !strings.Contains(name[i+1:], "/") {
+		name, r.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(r.Tag) {
+			return nil, fmt.Errorf("镜像名 %s 不合法: 标签 %q 只能包含字母、数字、_、. 和 -，且不能以 . 或 - 开头", ref, r.Tag)
+		}
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+
+	r.Path = name
+	if i := strings.Index(name, "/"); i >= 0 {
+		if first := name[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			r.Domain, r.Path = first, name[i+1:]
+			if !domainRegexp.MatchString(r.Domain) {
+				return nil, fmt.Errorf("镜像名 %s 不合法: 镜像仓库地址 %q 格式错误", ref, r.Domain)
+			}
+		}
+	}
+	if r.Path == "" {
+		return nil, fmt.Errorf("镜像名 %s 不合法: 缺少仓库名", ref)
+	}
+	for _, component := range strings.Split(r.Path, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return nil, fmt.Errorf("镜像名 %s 不合法: 仓库名只能包含小写字母、数字和分隔符 . _ -", ref)
+		}
+	}
+	if len(r.Domain)+len(r.Path)+1 > maxNameLength {
+		return nil, fmt.Errorf("镜像名 %s 不合法: 长度超过 %d 个字符", ref, maxNameLength)
+	}
+
+	// docker.io 上的镜像统一成简写形式，docker.io/library/busybox 与 busybox 是同一个镜像
+	if r.Domain == DefaultRegistry || r.Domain == "index.docker.io" {
+		r.Domain = ""
+	}
+	if r.Domain == "" && strings.HasPrefix(r.Path, "library/") && strings.Count(r.Path, "/") == 1 {
+		r.Path = strings.TrimPrefix(r.Path, "library/")
+	}
+	return r, nil
+}
+
+// validateDigest 检查摘要的格式，sha256 摘要必须是 64 位小写十六进制
+func validateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("摘要 %q 格式错误", digest)
+	}
+	if algorithm, hexPart, _ := strings.Cut(digest, ":"); algorithm == "sha256" && !sha256Regexp.MatchString(hexPart) {
+		return fmt.Errorf("sha256 摘要 %q 必须是 64 位十六进制", digest)
+	}
+	return nil
+}
+
+// Name 返回不带标签和摘要的镜像名，也是镜像索引中使用的名字
+func (r *Reference) Name() string {
+	if r.Domain == "" {
+		return r.Path
+	}
+	return r.Domain + "/" + r.Path
+}
+
+// String 返回完整的镜像引用
+func (r *Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Registry 返回镜像所在的镜像仓库地址，没有指定时为 docker.io
+func (r *Reference) Registry() string {
+	if r.Domain == "" {
+		return DefaultRegistry
+	}
+	return r.Domain
+}
+
+// Repository 返回镜像在镜像仓库中的完整路径，docker.io 上只有一段的镜像名需要加上 library/ 前缀
+func (r *Reference) Repository() string {
+	if r.Domain == "" && !strings.Contains(r.Path, "/") {
+		return "library/" + r.Path
+	}
+	return r.Path
+}
+
+// parseTagRef 解析用于登记镜像的名字，返回镜像名和标签，登记时不能带摘要
+func parseTagRef(ref string) (string, string, error) {
+	r, err := ParseReference(ref)
+	if err != nil {
+		return "", "", err
+	}
+	if r.Digest != "" {
+		return "", "", fmt.Errorf("镜像名 %s 不能带摘要，摘要由镜像内容决定", ref)
+	}
+	return r.Name(), r.Tag, nil
+}
@@ -0,0 +1,58 @@
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	cases := []struct {
+		ref  string
+		want Reference
+	}{
+		{"busybox", Reference{Path: "busybox", Tag: "latest"}},
+		{"busybox:1.36", Reference{Path: "busybox", Tag: "1.36"}},
+		{"docker.io/library/busybox:1.36", Reference{Path: "busybox", Tag: "1.36"}},
+		{"ns/app", Reference{Path: "ns/app", Tag: "latest"}},
+		{"localhost/app", Reference{Domain: "localhost", Path: "app", Tag: "latest"}},
+		{"localhost:5000/ns/app:v2", Reference{Domain: "localhost:5000", Path: "ns/app", Tag: "v2"}},
+		{"registry.example.com/library/app", Reference{Domain: "registry.example.com", Path: "library/app", Tag: "latest"}},
+		{"app@" + digest, Reference{Path: "app", Digest: digest}},
+		{"app:v1@" + digest, Reference{Path: "app", Tag: "v1", Digest: digest}},
+	}
+	for _, c := range cases {
+		r, err := ParseReference(c.ref)
+		if err != nil {
+			t.Errorf("ParseReference(%q) 失败: %v", c.ref, err)
+			continue
+		}
+		if *r != c.want {
+			t.Errorf("ParseReference(%q) = %+v, 期望 %+v", c.ref, *r, c.want)
+		}
+	}
+
+	for _, ref := range []string{"", "Busybox", "busybox:", "busybox:-1", "app@sha256:abc", "app@sha256:" + strings.Repeat("AB", 32), "ns//app", "-app", "bad_host:5000/app"} {
+		if _, err := ParseReference(ref); err == nil {
+			t.Errorf("ParseReference(%q) 期望报错", ref)
+		}
+	}
+}
+
+func TestReferenceRepository(t *testing.T) {
+	cases := map[string][2]string{
+		"busybox":                  {"docker.io", "library/busybox"},
+		"ns/app":                   {"docker.io", "ns/app"},
+		"localhost:5000/app:v1":    {"localhost:5000", "app"},
+		"quay.io/coreos/etcd:v3.5": {"quay.io", "coreos/etcd"},
+	}
+	for ref, want := range cases {
+		r, err := ParseReference(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Registry() != want[0] || r.Repository() != want[1] {
+			t.Errorf("%s: Registry() = %s, Repository() = %s, 期望 %s, %s", ref, r.Registry(), r.Repository(), want[0], want[1])
+		}
+	}
+}
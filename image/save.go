@@ -0,0 +1,253 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// ociLayoutFile OCI 镜像布局根目录下标明版本的文件
+const ociLayoutFile = `{"imageLayoutVersion":"1.0.0"}`
+
+// Save 把镜像写成 OCI 镜像布局的 tar 包
+// 镜像层以未压缩的 tar 包保存，摘要与 config 中的 diff_id 相同；config 保持原样，摘要就是镜像 ID。
+// dockerManifest 为 true 时同时写入 docker save 格式的 manifest.json，旧版本的 docker 也可以 load
+func Save(images []*Image, w io.Writer, dockerManifest bool) error {
+	dir, err := ioutil.TempDir("", "MiniDocker-save-")
+	if err != nil {
+		return fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := WriteLayout(dir, images, dockerManifest); err != nil {
+		return err
+	}
+	return writeDirTar(dir, w)
+}
+
+// WriteLayout 把镜像写成 dir 目录下的 OCI 镜像布局，返回写入的 index.json，每个镜像对应其中的一个 manifest
+func WriteLayout(dir string, images []*Image, dockerManifest bool) (*Index, error) {
+	index := &Index{SchemaVersion: 2, MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{}}
+	var manifests []dockerArchiveManifest
+	for _, img := range images {
+		manifest, err := writeImageBlobs(dir, img)
+		if err != nil {
+			return nil, fmt.Errorf("导出镜像 %s 失败: %v", img.Reference(), err)
+		}
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			return nil, err
+		}
+		desc, err := writeBlobBytes(dir, content)
+		if err != nil {
+			return nil, err
+		}
+		desc.MediaType = MediaTypeOCIManifest
+		desc.Annotations = map[string]string{
+			AnnotationContainerdName: img.Reference(),
+			AnnotationRefName:        img.Tag,
+		}
+		index.Manifests = append(index.Manifests, desc)
+
+		entry := dockerArchiveManifest{Config: blobName(manifest.Config.Digest), RepoTags: []string{img.Reference()}}
+		for _, layer := range manifest.Layers {
+			entry.Layers = append(entry.Layers, blobName(layer.Digest))
+		}
+		manifests = append(manifests, entry)
+	}
+
+	if err := writeJSONFile(path.Join(dir, "index.json"), index); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "oci-layout"), []byte(ociLayoutFile), 0644); err != nil {
+		return nil, err
+	}
+	if dockerManifest {
+		if err := writeJSONFile(path.Join(dir, "manifest.json"), manifests); err != nil {
+			return nil, err
+		}
+	}
+	return index, nil
+}
+
+// writeImageBlobs 把镜像的 config 和各层写入 OCI 镜像布局的 blobs 目录，返回镜像的 manifest
+// 单个 tar 包的镜像没有 config，按它的 tar 包生成只有一层的 config
+func writeImageBlobs(dir string, img *Image) (*Manifest, error) {
+	manifest := &Manifest{SchemaVersion: 2, MediaType: MediaTypeOCIManifest, Layers: []Descriptor{}}
+	var config []byte
+	if len(img.Layers) == 0 {
+		layer, err := writeLayerBlob(dir, img.Tarball, "")
+		if err != nil {
+			return nil, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+		config, err = json.Marshal(&ConfigFile{
+			Created:      time.Now().UTC().Format(time.RFC3339Nano),
+			Architecture: runtime.GOARCH,
+			OS:           runtime.GOOS,
+			RootFS:       RootFS{Type: "layers", DiffIDs: []string{layer.Digest}},
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, diffID := range img.Layers {
+			tarball := LayerTarball(diffID)
+			if _, err := os.Stat(tarball); err != nil {
+				return nil, fmt.Errorf("镜像层 %s 缺少原始的 tar 包，请重新导入镜像: %v", diffID, err)
+			}
+			layer, err := writeLayerBlob(dir, tarball, diffID)
+			if err != nil {
+				return nil, err
+			}
+			manifest.Layers = append(manifest.Layers, layer)
+		}
+		var err error
+		if config, err = ioutil.ReadFile(img.ConfigPath); err != nil {
+			return nil, fmt.Errorf("读取镜像 config 失败: %v", err)
+		}
+	}
+
+	desc, err := writeBlobBytes(dir, config)
+	if err != nil {
+		return nil, err
+	}
+	if len(img.Layers) > 0 && desc.Digest != img.ID {
+		return nil, fmt.Errorf("镜像 config 的摘要为 %s，与镜像 ID %s 不一致，文件可能已损坏", desc.Digest, img.ID)
+	}
+	desc.MediaType = MediaTypeOCIConfig
+	manifest.Config = desc
+	return manifest, nil
+}
+
+// writeLayerBlob 把镜像层解压后写入 blobs 目录，返回它的描述符
+// diffID 不为空时校验解压后的摘要，已经写入过的层直接跳过
+func writeLayerBlob(dir string, tarball string, diffID string) (Descriptor, error) {
+	if diffID != "" {
+		if file, err := BlobPath(dir, diffID); err == nil {
+			if stat, err := os.Stat(file); err == nil {
+				return Descriptor{MediaType: MediaTypeOCILayer, Digest: diffID, Size: stat.Size()}, nil
+			}
+		}
+	}
+	f, err := os.Open(tarball)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer f.Close()
+	stream, err := DecompressStream(f)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("解压镜像层 %s 失败: %v", tarball, err)
+	}
+	defer stream.Close()
+	desc, err := writeBlobStream(dir, stream)
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("写入镜像层 %s 失败: %v", tarball, err)
+	}
+	if diffID != "" && desc.Digest != diffID {
+		return Descriptor{}, fmt.Errorf("镜像层 %s 解压后的摘要为 %s，文件可能已损坏", diffID, desc.Digest)
+	}
+	desc.MediaType = MediaTypeOCILayer
+	return desc, nil
+}
+
+// writeBlobStream 把数据写入 blobs 目录，文件名为数据的 sha256 摘要
+func writeBlobStream(dir string, r io.Reader) (Descriptor, error) {
+	blobDir := path.Join(dir, "blobs", "sha256")
+	if err := os.MkdirAll(blobDir, 0755); err != nil {
+		return Descriptor{}, err
+	}
+	tmpFile, err := ioutil.TempFile(blobDir, ".tmp-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(tmpFile.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpFile, h), r)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Descriptor{}, err
+	}
+	hexPart := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmpFile.Name(), path.Join(blobDir, hexPart)); err != nil {
+		return Descriptor{}, err
+	}
+	return Descriptor{Digest: "sha256:" + hexPart, Size: size}, nil
+}
+
+// writeBlobBytes 把内容写入 blobs 目录
+func writeBlobBytes(dir string, content []byte) (Descriptor, error) {
+	sum := sha256.Sum256(content)
+	desc := Descriptor{Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	file, err := BlobPath(dir, desc.Digest)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, ioutil.WriteFile(file, content, 0644)
+}
+
+// blobName 返回 blob 在镜像布局中的相对路径，例如 blobs/sha256/<hex>
+func blobName(digest string) string {
+	file, _ := BlobPath("", digest)
+	return file
+}
+
+// writeJSONFile 把 v 序列化后写入文件
+func writeJSONFile(file string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// writeDirTar 把目录中的文件打包成 tar 流，目录中只有普通文件和目录
+// 文件的属主和时间都是固定的，同样的镜像打出来的包完全一致
+func writeDirTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		hdr := &tar.Header{Name: rel, Mode: 0644, Typeflag: tar.TypeReg, Size: fi.Size(), ModTime: time.Unix(0, 0)}
+		if fi.IsDir() {
+			hdr.Name += "/"
+			hdr.Mode = 0755
+			hdr.Typeflag = tar.TypeDir
+			hdr.Size = 0
+			return tw.WriteHeader(hdr)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
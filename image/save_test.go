@@ -0,0 +1,126 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// untarBytes 把 Save 生成的 tar 包解开到临时目录
+func untarBytes(t *testing.T, content []byte) string {
+	dir := t.TempDir()
+	tr := tar.NewReader(bytes.NewReader(content))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return dir
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := path.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSaveRoundTrip(t *testing.T) {
+	useTempStore(t)
+	old := layerStorePath
+	layerStorePath = t.TempDir()
+	t.Cleanup(func() { layerStorePath = old })
+
+	// 第一层以 gzip 压缩的形式保存，导出时应当解压成与 diff_id 一致的 tar 包
+	layers := [][]byte{tarLayer(t, "bin/sh", "shell"), tarLayer(t, "etc/hostname", "mini")}
+	stored := [][]byte{gzipBytes(t, layers[0]), layers[1]}
+	var diffIDs []string
+	for i, layer := range layers {
+		diffID := sha256Digest(layer)
+		if err := CreateLayer(diffID, func(string) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		if err := SaveLayerTarball(diffID, bytes.NewReader(stored[i])); err != nil {
+			t.Fatal(err)
+		}
+		diffIDs = append(diffIDs, diffID)
+	}
+	config, _ := json.Marshal(ConfigFile{OS: "linux", RootFS: RootFS{Type: "layers", DiffIDs: diffIDs}})
+	img, err := RegisterConfig([]string{"busybox:1.36"}, config, diffIDs, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dockerManifest := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := Save([]*Image{img}, &buf, dockerManifest); err != nil {
+			t.Fatal(err)
+		}
+		dir := untarBytes(t, buf.Bytes())
+		if _, err := os.Stat(path.Join(dir, "oci-layout")); err != nil {
+			t.Errorf("缺少 oci-layout 文件: %v", err)
+		}
+		if dockerManifest {
+			// 去掉 index.json 后按 docker save 归档读取
+			if err := os.Remove(path.Join(dir, "index.json")); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := os.Stat(path.Join(dir, "manifest.json")); !os.IsNotExist(err) {
+			t.Error("oci 格式不应当包含 manifest.json")
+		}
+
+		sources, err := ReadArchiveDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sources) != 1 {
+			t.Fatalf("读出了 %d 个镜像，期望 1 个", len(sources))
+		}
+		src := sources[0]
+		if src.ConfigDigest != img.ID {
+			t.Errorf("config 摘要 = %s, 期望镜像 ID %s", src.ConfigDigest, img.ID)
+		}
+		if len(src.Names) != 1 || src.Names[0] != "busybox:1.36" {
+			t.Errorf("镜像名 = %v, 期望 [busybox:1.36]", src.Names)
+		}
+		for i, layer := range src.Layers {
+			if layer.DiffID != diffIDs[i] {
+				t.Errorf("第 %d 层 diff_id = %s, 期望 %s", i, layer.DiffID, diffIDs[i])
+			}
+		}
+	}
+}
+
+func TestSaveMissingLayerTarball(t *testing.T) {
+	useTempStore(t)
+	old := layerStorePath
+	layerStorePath = t.TempDir()
+	t.Cleanup(func() { layerStorePath = old })
+
+	diffID := sha256Digest([]byte("layer"))
+	if err := CreateLayer(diffID, func(string) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	img, err := RegisterConfig([]string{"app"}, []byte("{}"), []string{diffID}, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Save([]*Image{img}, ioutil.Discard, false); err == nil {
+		t.Error("镜像层缺少 tar 包时应当报错")
+	}
+}
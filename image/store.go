@@ -0,0 +1,482 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultTag 未指定标签时使用的默认标签
+const DefaultTag = "latest"
+
+// defaultStorePath 镜像索引的默认存储位置
+const defaultStorePath = "/var/lib/MiniDocker/image/"
+
+// Image 描述本地的一个镜像
+// 同一个镜像可以有多个标签，每个标签在索引中单独记录一份
+type Image struct {
+	ID      string `json:"id"`               // 镜像 ID，镜像内容的 sha256 摘要，例如 sha256:9a0b...
+	Name    string `json:"name"`             // 镜像名，例如 busybox
+	Tag     string `json:"tag"`              // 镜像标签，例如 latest
+	Size    int64  `json:"size"`             // 镜像 tar 包的大小（字节）
+	Created string `json:"created"`          // 镜像创建时间
+	Parent  string `json:"parent,omitempty"` // 父镜像 ID，由 commit 生成的镜像会记录它基于的镜像
+	Tarball string `json:"tarball"`          // 镜像 tar 包的路径，通过 load 导入的分层镜像为空
+	RootDir string `json:"rootDir"`          // 镜像解压后的目录，作为容器 overlay 的 lowerdir，分层镜像为空
+	// 分层镜像的各层 diff_id，从下到上排列，每一层解压在层存储中
+	Layers []string `json:"layers,omitempty"`
+	// 分层镜像的 config 文件在镜像目录中的路径
+	ConfigPath string `json:"configPath,omitempty"`
+	// 镜像 manifest 的摘要，从镜像仓库拉取或从 OCI 镜像布局导入的镜像才有，可以通过 name@digest 引用
+	RepoDigest string `json:"repoDigest,omitempty"`
+}
+
+// LowerDirs 返回镜像作为容器 overlay lowerdir 时使用的目录，最上面的层排在最前面
+func (img *Image) LowerDirs() []string {
+	if len(img.Layers) == 0 {
+		return []string{img.RootDir}
+	}
+	dirs := make([]string, 0, len(img.Layers))
+	for i := len(img.Layers) - 1; i >= 0; i-- {
+		dirs = append(dirs, LayerDir(img.Layers[i]))
+	}
+	return dirs
+}
+
+// Reference 返回 "name:tag" 格式的镜像名
+func (img *Image) Reference() string {
+	return img.Name + ":" + img.Tag
+}
+
+// ShortID 返回去掉 sha256: 前缀后的前 12 位 ID，用于列表展示
+func (img *Image) ShortID() string {
+	id := strings.TrimPrefix(img.ID, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Store 本地镜像索引，记录 "name:tag" 到镜像的映射，保存在 StorePath 下的 repositories.json 中
+type Store struct {
+	StorePath string            // 索引所在目录
+	Images    map[string]*Image // name:tag 到镜像的映射
+}
+
+// 默认的镜像索引实例
+var imageStore = &Store{
+	StorePath: defaultStorePath,
+	Images:    map[string]*Image{},
+}
+
+// SetRoot 把镜像索引和镜像层的存储位置换到 dir 下的 image 和 layers 目录中，rootless 模式下使用
+func SetRoot(dir string) {
+	imageStore.StorePath = path.Join(dir, "image")
+	layerStorePath = path.Join(dir, "layers")
+}
+
+// indexPath 返回索引文件的路径
+func (s *Store) indexPath() string {
+	return path.Join(s.StorePath, "repositories.json")
+}
+
+// load 从索引文件加载镜像信息，文件不存在时为空索引
+func (s *Store) load() error {
+	s.Images = map[string]*Image{}
+	content, err := ioutil.ReadFile(s.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(content) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(content, &s.Images); err != nil {
+		return fmt.Errorf("解析镜像索引失败: %v", err)
+	}
+	return nil
+}
+
+// dump 将镜像信息写回索引文件，先写临时文件再重命名，避免写到一半时索引损坏
+func (s *Store) dump() error {
+	if err := os.MkdirAll(s.StorePath, 0755); err != nil {
+		return err
+	}
+	content, err := json.Marshal(s.Images)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.indexPath())
+}
+
+// withLock 在文件锁的保护下加载索引并执行 fn，多个 MiniDocker 进程（如多个 shim）可能同时修改索引
+// modify 为 true 时 fn 执行成功后会把索引写回文件
+func (s *Store) withLock(modify bool, fn func() error) error {
+	if err := os.MkdirAll(s.StorePath, 0755); err != nil {
+		return fmt.Errorf("创建镜像目录 %s 失败: %v", s.StorePath, err)
+	}
+	lockFile, err := os.OpenFile(path.Join(s.StorePath, ".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("打开镜像索引锁失败: %v", err)
+	}
+	defer lockFile.Close()
+	if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("锁定镜像索引失败: %v", err)
+	}
+	defer syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	if modify {
+		return s.dump()
+	}
+	return nil
+}
+
+// ParseNameTag 将 "name:tag" 拆分为镜像名和标签，没有标签时使用 latest
+// 只有最后一个 / 之后的冒号才表示标签，例如 "localhost:5000/app" 的标签为 latest。
+// 合法的镜像引用按 ParseReference 统一成简写形式，其他字符串（如镜像 ID）按冒号拆分
+func ParseNameTag(ref string) (string, string) {
+	if r, err := ParseReference(ref); err == nil {
+		if r.Tag == "" {
+			return r.Name(), DefaultTag
+		}
+		return r.Name(), r.Tag
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i+1:], "/") {
+		return ref, DefaultTag
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// Register 将镜像 tar 包及其解压目录登记到镜像索引中，返回登记后的镜像
+// 镜像 ID 由 tar 包内容计算得出，parent 为父镜像 ID，没有父镜像时为空。
+// rootDir 可以还没有解压，第一次运行该镜像时再解压
+func Register(ref string, tarball string, rootDir string, parent string) (*Image, error) {
+	id, err := digestFile(tarball)
+	if err != nil {
+		return nil, fmt.Errorf("计算镜像 %s 的摘要失败: %v", tarball, err)
+	}
+	stat, err := os.Stat(tarball)
+	if err != nil {
+		return nil, err
+	}
+	name, tag, err := parseTagRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{
+		ID:      id,
+		Name:    name,
+		Tag:     tag,
+		Size:    stat.Size(),
+		Created: time.Now().Format("2006-01-02 15:04:05"),
+		Parent:  parent,
+		Tarball: tarball,
+		RootDir: rootDir,
+	}
+	err = imageStore.withLock(true, func() error {
+		imageStore.Images[img.Reference()] = img
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// RegisterSource 将从 OCI 镜像布局或 docker save 归档中读出的镜像登记到镜像索引中
+// 镜像层需要事先通过 CreateLayer 解压到层存储中，镜像 ID 为 config 的摘要
+func RegisterSource(refs []string, src *Source) (*Image, error) {
+	config, err := ioutil.ReadFile(src.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取镜像 config 失败: %v", err)
+	}
+	var size int64
+	var layers []string
+	for _, layer := range src.Layers {
+		size += layer.Size
+		layers = append(layers, layer.DiffID)
+	}
+	return registerConfig(refs, config, layers, size, "", src.RepoDigest)
+}
+
+// RegisterConfig 登记一个分层镜像，config 是镜像 config 文件的原始内容，会保存到镜像目录下，
+// 镜像 ID 为它的摘要。layers 为镜像各层的 diff_id，从下到上排列，需要事先解压到层存储中，
+// size 为镜像的大小，parent 为父镜像 ID，没有父镜像时为空
+func RegisterConfig(refs []string, config []byte, layers []string, size int64, parent string) (*Image, error) {
+	return registerConfig(refs, config, layers, size, parent, "")
+}
+
+// registerConfig 登记分层镜像，repoDigest 为镜像 manifest 的摘要，没有时为空
+func registerConfig(refs []string, config []byte, layers []string, size int64, parent string, repoDigest string) (*Image, error) {
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("镜像没有名字")
+	}
+	for _, ref := range refs {
+		if _, _, err := parseTagRef(ref); err != nil {
+			return nil, err
+		}
+	}
+	for _, layer := range layers {
+		if !LayerExists(layer) {
+			return nil, fmt.Errorf("镜像层 %s 还没有解压", layer)
+		}
+	}
+	sum := sha256.Sum256(config)
+	id := "sha256:" + hex.EncodeToString(sum[:])
+	configPath := path.Join(imageStore.StorePath, "configs", "sha256", hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(path.Dir(configPath), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(configPath, config, 0644); err != nil {
+		return nil, fmt.Errorf("保存镜像 config 失败: %v", err)
+	}
+
+	var img *Image
+	err := imageStore.withLock(true, func() error {
+		for _, ref := range refs {
+			name, tag, _ := parseTagRef(ref)
+			img = &Image{
+				ID:         id,
+				Name:       name,
+				Tag:        tag,
+				Size:       size,
+				Created:    time.Now().Format("2006-01-02 15:04:05"),
+				Parent:     parent,
+				Layers:     layers,
+				ConfigPath: configPath,
+				RepoDigest: repoDigest,
+			}
+			imageStore.Images[img.Reference()] = img
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// Config 读取分层镜像的 config，单个 tar 包的镜像没有 config，返回空的 config
+func (img *Image) Config() (*ConfigFile, error) {
+	if img.ConfigPath == "" {
+		return &ConfigFile{Architecture: runtime.GOARCH, OS: runtime.GOOS, RootFS: RootFS{Type: "layers"}}, nil
+	}
+	return readConfigFile(img.ConfigPath)
+}
+
+// Get 根据 "name:tag"、镜像 ID 或唯一的 ID 前缀查找镜像
+func Get(ref string) (*Image, error) {
+	var img *Image
+	err := imageStore.withLock(false, func() error {
+		var err error
+		img, err = imageStore.lookup(ref)
+		return err
+	})
+	return img, err
+}
+
+// List 返回所有镜像，按镜像名和标签排序
+func List() ([]*Image, error) {
+	var images []*Image
+	err := imageStore.withLock(false, func() error {
+		for _, img := range imageStore.Images {
+			images = append(images, img)
+		}
+		return nil
+	})
+	sort.Slice(images, func(i, j int) bool { return images[i].Reference() < images[j].Reference() })
+	return images, err
+}
+
+// Remove 删除镜像的一个标签，inUse 用于检查镜像是否还在被容器使用
+// 当镜像的文件不再被其他标签引用时，同时删除镜像的 tar 包和解压目录
+func Remove(ref string, inUse func(img *Image) error) (*Image, error) {
+	var removed *Image
+	err := imageStore.withLock(true, func() error {
+		img, err := imageStore.lookup(ref)
+		if err != nil {
+			return err
+		}
+		// 通过 ID 删除时必须只有一个标签引用它，否则不知道该删除哪一个
+		name, tag := ParseNameTag(ref)
+		if _, byTag := imageStore.Images[name+":"+tag]; !byTag {
+			if tags := imageStore.tagsOf(img.ID); len(tags) > 1 {
+				return fmt.Errorf("镜像 %s 被多个标签引用: %s，请通过镜像名删除", ref, strings.Join(tags, ", "))
+			}
+		}
+		// 镜像还被其他标签引用时只删除标签
+		shared := false
+		for other, otherImg := range imageStore.Images {
+			if other != img.Reference() && otherImg.ID == img.ID && otherImg.RootDir == img.RootDir {
+				shared = true
+			}
+		}
+		if !shared && inUse != nil {
+			if err := inUse(img); err != nil {
+				return err
+			}
+		}
+		delete(imageStore.Images, img.Reference())
+		if !shared {
+			if err := imageStore.removeImageFiles(img); err != nil {
+				return err
+			}
+		}
+		removed = img
+		return nil
+	})
+	return removed, err
+}
+
+// removeImageFiles 删除镜像的文件，分层镜像只删除不再被其他镜像使用的镜像层，调用者需要持有锁
+func (s *Store) removeImageFiles(img *Image) error {
+	if len(img.Layers) == 0 {
+		if err := os.RemoveAll(img.RootDir); err != nil {
+			return fmt.Errorf("删除镜像目录 %s 失败: %v", img.RootDir, err)
+		}
+		if err := os.Remove(img.Tarball); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除镜像文件 %s 失败: %v", img.Tarball, err)
+		}
+		return nil
+	}
+	used := map[string]bool{}
+	for _, other := range s.Images {
+		for _, layer := range other.Layers {
+			used[layer] = true
+		}
+	}
+	for _, layer := range img.Layers {
+		if used[layer] {
+			continue
+		}
+		if err := removeLayer(layer); err != nil {
+			return fmt.Errorf("删除镜像层 %s 失败: %v", layer, err)
+		}
+	}
+	if err := os.Remove(img.ConfigPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("删除镜像 config 失败: %v", err)
+	}
+	return nil
+}
+
+// Tag 给镜像添加新的标签 target，source 可以是 "name:tag"、镜像 ID 或唯一的 ID 前缀
+// target 已经指向其他镜像时改为指向 source 对应的镜像
+func Tag(source string, target string) (*Image, error) {
+	name, tag, err := parseTagRef(target)
+	if err != nil {
+		return nil, err
+	}
+	var tagged *Image
+	err = imageStore.withLock(true, func() error {
+		img, err := imageStore.lookup(source)
+		if err != nil {
+			return err
+		}
+		copied := *img
+		copied.Name, copied.Tag = name, tag
+		copied.Layers = append([]string(nil), img.Layers...)
+		imageStore.Images[copied.Reference()] = &copied
+		tagged = &copied
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tagged, nil
+}
+
+// lookup 依次按 "name:tag"、"name@digest"、完整 ID、唯一的 ID 前缀查找镜像，调用者需要持有锁
+// 带摘要的镜像引用要求镜像名一致且镜像 ID 或 manifest 的摘要等于该摘要，同时带标签时标签也要一致
+func (s *Store) lookup(ref string) (*Image, error) {
+	if r, err := ParseReference(ref); err == nil {
+		if r.Digest == "" {
+			if img, ok := s.Images[r.Name()+":"+r.Tag]; ok {
+				return img, nil
+			}
+		} else {
+			var match *Image
+			for _, img := range s.Images {
+				if img.Name != r.Name() || (img.ID != r.Digest && img.RepoDigest != r.Digest) || (r.Tag != "" && img.Tag != r.Tag) {
+					continue
+				}
+				if match == nil || img.Reference() < match.Reference() {
+					match = img
+				}
+			}
+			if match == nil {
+				return nil, fmt.Errorf("镜像 %s 不存在", ref)
+			}
+			return match, nil
+		}
+	}
+	id := strings.TrimPrefix(ref, "sha256:")
+	if id == "" {
+		return nil, fmt.Errorf("镜像名不能为空")
+	}
+	var match *Image
+	for _, img := range s.Images {
+		if !strings.HasPrefix(strings.TrimPrefix(img.ID, "sha256:"), id) {
+			continue
+		}
+		if match != nil && match.ID != img.ID {
+			return nil, fmt.Errorf("ID 前缀 %s 匹配到多个镜像，请指定更长的前缀", ref)
+		}
+		// 同一个 ID 的多个标签取名字最小的一个，保证结果稳定
+		if match == nil || img.Reference() < match.Reference() {
+			match = img
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("镜像 %s 不存在", ref)
+	}
+	return match, nil
+}
+
+// tagsOf 返回引用了指定镜像 ID 的所有标签
+func (s *Store) tagsOf(id string) []string {
+	var tags []string
+	for ref, img := range s.Images {
+		if img.ID == id {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// digestFile 计算文件内容的 sha256 摘要，返回 "sha256:<hex>" 格式的字符串
+func digestFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,157 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// useTempStore 让镜像索引使用临时目录，并在测试结束后恢复
+func useTempStore(t *testing.T) string {
+	dir := t.TempDir()
+	old := imageStore.StorePath
+	imageStore.StorePath = path.Join(dir, "index")
+	t.Cleanup(func() { imageStore.StorePath = old })
+	return dir
+}
+
+// fakeImage 在 dir 下创建一个镜像 tar 包和解压目录
+func fakeImage(t *testing.T, dir string, name string, content string) (string, string) {
+	tarball := path.Join(dir, name+".tar")
+	if err := ioutil.WriteFile(tarball, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootDir := path.Join(dir, name)
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return tarball, rootDir
+}
+
+func TestParseNameTag(t *testing.T) {
+	cases := map[string][2]string{
+		"busybox":               {"busybox", "latest"},
+		"busybox:1.36":          {"busybox", "1.36"},
+		"localhost:5000/app":    {"localhost:5000/app", "latest"},
+		"localhost:5000/app:v2": {"localhost:5000/app", "v2"},
+	}
+	for ref, want := range cases {
+		if name, tag := ParseNameTag(ref); name != want[0] || tag != want[1] {
+			t.Errorf("ParseNameTag(%q) = %s, %s, 期望 %s, %s", ref, name, tag, want[0], want[1])
+		}
+	}
+}
+
+func TestRegisterAndGet(t *testing.T) {
+	dir := useTempStore(t)
+	tarball, rootDir := fakeImage(t, dir, "busybox", "busybox layer")
+	img, err := Register("busybox", tarball, rootDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Tag != DefaultTag || img.Size != int64(len("busybox layer")) {
+		t.Errorf("登记的镜像信息错误: %+v", img)
+	}
+
+	for _, ref := range []string{"busybox", "busybox:latest", img.ID, img.ShortID()[:6]} {
+		got, err := Get(ref)
+		if err != nil {
+			t.Errorf("Get(%q) 失败: %v", ref, err)
+			continue
+		}
+		if got.ID != img.ID {
+			t.Errorf("Get(%q) = %s, 期望 %s", ref, got.ID, img.ID)
+		}
+	}
+	if _, err := Get("alpine"); err == nil {
+		t.Error("查找不存在的镜像应当报错")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir := useTempStore(t)
+	tarball, rootDir := fakeImage(t, dir, "busybox", "busybox layer")
+	img, err := Register("busybox:1.36", tarball, rootDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Register("busybox:stable", tarball, rootDir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个标签引用同一个镜像时不能通过 ID 删除
+	if _, err := Remove(img.ShortID(), nil); err == nil {
+		t.Error("通过 ID 删除被多个标签引用的镜像应当报错")
+	}
+	// 删除其中一个标签时保留镜像文件
+	if _, err := Remove("busybox:1.36", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootDir); err != nil {
+		t.Errorf("镜像目录不应被删除: %v", err)
+	}
+	// 镜像被使用时拒绝删除
+	inUse := func(img *Image) error { return fmt.Errorf("镜像正在被使用") }
+	if _, err := Remove("busybox:stable", inUse); err == nil {
+		t.Error("删除正在被使用的镜像应当报错")
+	}
+	if _, err := Get("busybox:stable"); err != nil {
+		t.Errorf("拒绝删除后镜像应当还在: %v", err)
+	}
+	// 删除最后一个标签时删除镜像文件
+	if _, err := Remove("busybox:stable", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootDir); !os.IsNotExist(err) {
+		t.Error("镜像目录没有被删除")
+	}
+	if _, err := os.Stat(tarball); !os.IsNotExist(err) {
+		t.Error("镜像文件没有被删除")
+	}
+	if images, _ := List(); len(images) != 0 {
+		t.Errorf("镜像索引应当为空，实际为 %v", images)
+	}
+}
+
+func TestTagAndDigestLookup(t *testing.T) {
+	dir := useTempStore(t)
+	tarball, rootDir := fakeImage(t, dir, "busybox", "busybox layer")
+	img, err := Register("docker.io/library/busybox:1.36", tarball, rootDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Reference() != "busybox:1.36" {
+		t.Errorf("镜像名应当统一成简写形式，实际为 %s", img.Reference())
+	}
+
+	tagged, err := Tag("busybox:1.36", "localhost:5000/tools/busybox:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged.ID != img.ID || tagged.Name != "localhost:5000/tools/busybox" || tagged.Tag != "v1" {
+		t.Errorf("添加的标签错误: %+v", tagged)
+	}
+	for _, ref := range []string{"localhost:5000/tools/busybox:v1", "busybox@" + img.ID, "busybox:1.36@" + img.ID} {
+		if got, err := Get(ref); err != nil || got.ID != img.ID {
+			t.Errorf("Get(%q) = %v, %v", ref, got, err)
+		}
+	}
+	if _, err := Get("alpine@" + img.ID); err == nil {
+		t.Error("镜像名与摘要不匹配时应当报错")
+	}
+	for _, target := range []string{"Busybox:v1", "busybox@" + img.ID, "busybox:-v1"} {
+		if _, err := Tag("busybox:1.36", target); err == nil {
+			t.Errorf("Tag(%q) 应当报错", target)
+		}
+	}
+
+	// 删除新标签时镜像文件被原来的标签引用，不能删除
+	if _, err := Remove("localhost:5000/tools/busybox:v1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(rootDir); err != nil {
+		t.Errorf("镜像目录不应被删除: %v", err)
+	}
+}
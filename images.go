@@ -0,0 +1,99 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"MiniDocker/image"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// listImages 列出本地的所有镜像，all 为 false 时不列出 build 缓存的中间镜像
+func listImages(all bool) error {
+	images, err := image.List()
+	if err != nil {
+		return fmt.Errorf("读取镜像索引失败: %v", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE\n")
+	for _, img := range images {
+		if img.Name == buildCacheRepository && !all {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			img.Name,
+			img.Tag,
+			img.ShortID(),
+			img.Created,
+			formatBytes(uint64(img.Size)),
+		)
+	}
+	return w.Flush()
+}
+
+// removeImages 删除本地镜像，imageRefs 可以是 "name:tag"、镜像 ID 或唯一的 ID 前缀
+func removeImages(imageRefs []string) error {
+	for _, ref := range imageRefs {
+		img, err := image.Remove(ref, checkImageInUse)
+		if err != nil {
+			return fmt.Errorf("删除镜像 %s 失败: %v", ref, err)
+		}
+		logrus.Infof("已删除镜像 %s (%s)", img.Reference(), img.ShortID())
+	}
+	return nil
+}
+
+// tagImage 给镜像添加新的标签，source 可以是 "name:tag"、镜像 ID 或唯一的 ID 前缀
+func tagImage(source string, target string) error {
+	img, err := image.Tag(source, target)
+	if err != nil {
+		return fmt.Errorf("给镜像 %s 添加标签失败: %v", source, err)
+	}
+	logrus.Infof("已添加标签 %s (%s)", img.Reference(), img.ShortID())
+	return nil
+}
+
+// checkImageInUse 检查镜像是否还在被容器使用，被使用时返回错误
+// 依次检查记录了该镜像的容器（包括已经退出但还没有 rm 的容器）以及正在使用镜像目录或镜像层作为 lowerdir 的 overlay 挂载
+func checkImageInUse(img *image.Image) error {
+	infos, err := getAllContainerInfos()
+	if err != nil {
+		return fmt.Errorf("读取容器信息失败: %v", err)
+	}
+	for _, info := range infos {
+		if info.ImageID == img.ID || (info.ImageID == "" && referencesImage(info.Image, img)) {
+			return fmt.Errorf("镜像正在被容器 %s (%s) 使用，请先删除该容器", info.Name, info.Id)
+		}
+	}
+
+	lowerDirs, err := container.OverlayLowerDirs()
+	if err != nil {
+		return fmt.Errorf("读取挂载信息失败: %v", err)
+	}
+	mounted := map[string]bool{}
+	for _, dir := range lowerDirs {
+		mounted[dir] = true
+	}
+	for _, dir := range img.LowerDirs() {
+		if mounted[filepath.Clean(dir)] {
+			return fmt.Errorf("镜像目录 %s 正在被 overlay 挂载作为 lowerdir 使用", dir)
+		}
+	}
+	return nil
+}
+
+// referencesImage 判断镜像引用是否指向镜像 img，用于没有记录镜像 ID 的旧容器
+// 两边都按 image.ParseReference 规范化后比较：busybox、busybox:latest 和 docker.io/library/busybox:latest 是同一个镜像，
+// busybox:1.36 则不是 busybox:latest；带摘要时与 image.Get 一致，要求镜像 ID 或 manifest 的摘要相同，同时带标签时标签也要相同
+func referencesImage(ref string, img *image.Image) bool {
+	r, err := image.ParseReference(ref)
+	if err != nil || r.Name() != img.Name {
+		return false
+	}
+	if r.Digest == "" {
+		return r.Tag == img.Tag
+	}
+	return (img.ID == r.Digest || img.RepoDigest == r.Digest) && (r.Tag == "" || r.Tag == img.Tag)
+}
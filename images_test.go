@@ -0,0 +1,32 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"strings"
+	"testing"
+)
+
+func TestReferencesImage(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("9a", 32)
+	img := &image.Image{ID: digest, Name: "busybox", Tag: "latest"}
+	cases := []struct {
+		ref  string
+		want bool
+	}{
+		{ref: "busybox", want: true}, // 没有标签时为 latest
+		{ref: "busybox:latest", want: true},
+		{ref: "docker.io/library/busybox:latest", want: true},
+		{ref: "busybox@" + digest, want: true},
+		{ref: "busybox:latest@" + digest, want: true},
+		{ref: "busybox:1.36", want: false}, // 同名不同标签
+		{ref: "busybox:1.36@" + digest, want: false},
+		{ref: "localhost:5000/busybox", want: false},
+		{ref: "library/busybox/extra", want: false},
+		{ref: "BusyBox", want: false}, // 不合法的镜像名
+	}
+	for _, c := range cases {
+		if got := referencesImage(c.ref, img); got != c.want {
+			t.Errorf("referencesImage(%q) = %v, 期望 %v", c.ref, got, c.want)
+		}
+	}
+}
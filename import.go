@@ -0,0 +1,66 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"time"
+)
+
+// importImage 把容器文件系统的 tar 包（可以经过 gzip 或 zstd 压缩）导入为只有一层的镜像
+// input 为 "-" 时从标准输入读取，changes 为对镜像配置的修改，格式与 commit 的 --change 相同
+func importImage(input string, ref string, message string, changes []string) error {
+	if input == "-" {
+		tmpFile, err := ioutil.TempFile("", "MiniDocker-import-")
+		if err != nil {
+			return fmt.Errorf("创建临时文件失败: %v", err)
+		}
+		defer os.Remove(tmpFile.Name())
+		_, err = io.Copy(tmpFile, os.Stdin)
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("从标准输入读取归档失败: %v", err)
+		}
+		input = tmpFile.Name()
+	}
+	stat, err := os.Stat(input)
+	if err != nil {
+		return fmt.Errorf("读取 %s 失败: %v", input, err)
+	}
+
+	config := &image.ConfigFile{Architecture: runtime.GOARCH, OS: runtime.GOOS}
+	for _, change := range changes {
+		if err := applyConfigChange(&config.Config, change); err != nil {
+			return err
+		}
+	}
+	diffID, err := image.DiffID(input)
+	if err != nil {
+		return err
+	}
+	if err := storeLayerFile(diffID, input); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	config.Created = now
+	config.RootFS = image.RootFS{Type: "layers", DiffIDs: []string{diffID}}
+	config.History = []image.History{{Created: now, CreatedBy: "MiniDocker import", Comment: message}}
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	img, err := image.RegisterConfig([]string{ref}, content, []string{diffID}, stat.Size(), "")
+	if err != nil {
+		return fmt.Errorf("登记镜像 %s 失败: %v", ref, err)
+	}
+	logrus.Infof("已导入镜像 %s (%s)", img.Reference(), img.ShortID())
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+)
+
+// inspectTemplateFuncs --format 模板中可以使用的函数
+var inspectTemplateFuncs = template.FuncMap{
+	// json 将任意字段序列化为 JSON，例如 {{json .Resource}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// inspectContainers 输出容器的详细信息，包括运行参数、资源限制、网络、挂载和退出状态
+// format 为空时以 JSON 数组输出所有容器的信息，否则对每个容器执行 Go 模板，
+// 例如 --format '{{.Status}} {{.ExitCode}}'
+func inspectContainers(containerNames []string, format string) error {
+	var tmpl *template.Template
+	if format != "" {
+		var err error
+		if tmpl, err = template.New("inspect").Funcs(inspectTemplateFuncs).Parse(format); err != nil {
+			return fmt.Errorf("解析模板 %q 失败: %v", format, err)
+		}
+	}
+
+	infos := make([]*container.Info, 0, len(containerNames))
+	for _, name := range containerNames {
+		info, err := resolveContainer(name)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+
+	if tmpl == nil {
+		infoJson, err := json.MarshalIndent(infos, "", "    ")
+		if err != nil {
+			return fmt.Errorf("容器信息序列化失败: %v", err)
+		}
+		fmt.Fprintln(os.Stdout, string(infoJson))
+		return nil
+	}
+	for _, info := range infos {
+		if err := tmpl.Execute(os.Stdout, info); err != nil {
+			return fmt.Errorf("执行模板失败: %v", err)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+	return nil
+}
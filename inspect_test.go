@@ -0,0 +1,95 @@
+package main
+
+import (
+	"MiniDocker/cgroup/subsystems"
+	"MiniDocker/container"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// captureStdout 执行 f 并返回它写到标准输出的内容
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	out, readErr := ioutil.ReadAll(r)
+	r.Close()
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(out), err
+}
+
+func TestInspectRunConfig(t *testing.T) {
+	setInfoLocation(t)
+	cfg := &runConfig{
+		CommandArray:  []string{"sh", "-c", "echo hello"},
+		Volume:        "/tmp/data:/data",
+		Resource:      &subsystems.ResourceConfig{MemoryLimit: 100 << 20, CpuShare: 512, PidsLimit: 64},
+		ContainerID:   "1234567890",
+		ContainerName: "web",
+		ImageName:     "busybox:latest",
+		EnvSlice:      []string{"FOO=bar"},
+		WorkingDir:    "/data",
+		User:          "1000:1000",
+		PortMapping:   []string{"8080:80"},
+		UserNamespace: &container.UserNamespace{
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		},
+		CgroupNamespace: container.CgroupNamespacePrivate,
+		TimeOffsets:     &container.TimeOffsets{Boottime: time.Hour},
+	}
+	recorded, err := recordContainerInfo(4321, cfg, "MiniDocker/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不带 --format 时输出的 JSON 与启动时记录的容器信息一致
+	out, err := captureStdout(t, func() error { return inspectContainers([]string{"web"}, "") })
+	if err != nil {
+		t.Fatalf("inspect 失败: %v", err)
+	}
+	var infos []*container.Info
+	if err := json.Unmarshal([]byte(out), &infos); err != nil {
+		t.Fatalf("解析 inspect 的输出失败: %v\n%s", err, out)
+	}
+	if len(infos) != 1 || !reflect.DeepEqual(infos[0], recorded) {
+		t.Fatalf("inspect 输出 %s，期望 %+v", out, recorded)
+	}
+	info := infos[0]
+	if !reflect.DeepEqual(info.Args, cfg.CommandArray) || info.Image != cfg.ImageName || !reflect.DeepEqual(info.Env, cfg.EnvSlice) ||
+		info.WorkingDir != cfg.WorkingDir || info.User != cfg.User || !reflect.DeepEqual(info.PortMapping, cfg.PortMapping) ||
+		!reflect.DeepEqual(info.Resource, cfg.Resource) || !reflect.DeepEqual(info.UserNamespace, cfg.UserNamespace) ||
+		info.CgroupNamespace != cfg.CgroupNamespace || !reflect.DeepEqual(info.TimeOffsets, cfg.TimeOffsets) {
+		t.Errorf("inspect 输出的运行参数 %+v 与 run 的参数 %+v 不一致", info, cfg)
+	}
+
+	// --format 使用 Go 模板
+	cases := map[string]string{
+		"{{.Status}} {{.Pid}}":      "running 4321\n",
+		"{{json .Resource}}":        `{"memoryLimit":104857600,"cpuShare":512,"pidsLimit":64}` + "\n",
+		"{{index .Args 2}}":         "echo hello\n",
+		"{{.TimeOffsets.Boottime}}": "1h0m0s\n",
+	}
+	for format, want := range cases {
+		out, err := captureStdout(t, func() error { return inspectContainers([]string{"web"}, format) })
+		if err != nil || out != want {
+			t.Errorf("inspect --format %q 输出 %q (%v)，期望 %q", format, out, err, want)
+		}
+	}
+	if _, err := captureStdout(t, func() error { return inspectContainers([]string{"web"}, "{{.Status") }); err == nil {
+		t.Error("模板格式错误时期望报错")
+	}
+}
@@ -4,36 +4,17 @@ import (
 	"MiniDocker/container"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"io/ioutil"
 	"os"
 	"text/tabwriter"
 )
 
 // ListContainers 列出当前所有容器及其状态
 func ListContainers() {
-	// 容器信息根目录
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
-	dirURL = dirURL[:len(dirURL)-1]
-
-	// 读取该目录下的所有子目录（每个容器一个目录）
-	files, err := ioutil.ReadDir(dirURL)
+	containers, err := getAllContainerInfos()
 	if err != nil {
-		logrus.Errorf("读取目录失败: %v", err)
+		logrus.Errorf("读取容器信息失败: %v", err)
 		return
 	}
-
-	var containers []*container.Info
-	// 遍历每个子目录，解析容器信息
-	for _, file := range files {
-		// 根据配置文件名获取容器信息
-		tmpContainer, err := getContainerInfo(file)
-		if err != nil {
-			logrus.Errorf("获取容器信息失败: %v", err)
-			continue
-		}
-		// 解析容器信息
-		containers = append(containers, tmpContainer)
-	}
 	// 使用表格格式打印容器信息
 	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
 	fmt.Fprint(w, "ID\tNAME\tPID\tSTATUS\tCOMMAND\tCREATE\n")
@@ -42,7 +23,7 @@ func ListContainers() {
 			c.Id,
 			c.Name,
 			c.Pid,
-			c.Status,
+			formatStatus(c),
 			c.Command,
 			c.CreatedTime,
 		)
@@ -52,3 +33,14 @@ func ListContainers() {
 		return
 	}
 }
+
+// formatStatus 生成 ps 中显示的容器状态，已退出的容器附带退出码以及是否被 OOM 杀死，例如 "exit (137, OOMKilled)"
+func formatStatus(c *container.Info) string {
+	if c.Status != container.EXIT {
+		return c.Status
+	}
+	if c.OOMKilled {
+		return fmt.Sprintf("%s (%d, OOMKilled)", c.Status, c.ExitCode)
+	}
+	return fmt.Sprintf("%s (%d)", c.Status, c.ExitCode)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"archive/tar"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadImages 从 OCI 镜像布局或 docker save 归档中导入镜像
+// input 可以是 OCI 镜像布局目录，也可以是它们打包后的 tar 包（支持 gzip 压缩）。
+// 每个镜像层按 diff_id 只解压一次到层存储中，并保留原始的 tar 包供 save 使用，name 用于补全归档中只有标签或没有名字的镜像
+func loadImages(input string, name string) error {
+	stat, err := os.Stat(input)
+	if err != nil {
+		return fmt.Errorf("读取 %s 失败: %v", input, err)
+	}
+	dir := input
+	if !stat.IsDir() {
+		tmpDir, err := ioutil.TempDir("", "MiniDocker-load-")
+		if err != nil {
+			return fmt.Errorf("创建临时目录失败: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		if err := extractArchive(input, tmpDir); err != nil {
+			return fmt.Errorf("解开归档 %s 失败: %v", input, err)
+		}
+		dir = tmpDir
+	}
+
+	sources, err := image.ReadArchiveDir(dir)
+	if err != nil {
+		return err
+	}
+	return registerSources(sources, name)
+}
+
+// registerSources 把读出的镜像的各层保存到层存储中，并登记到本地镜像索引
+// BlobPath 为空的层已经在层存储中，不需要再导入
+func registerSources(sources []*image.Source, name string) error {
+	for _, src := range sources {
+		refs, err := loadRefNames(src.Names, name)
+		if err != nil {
+			return fmt.Errorf("导入镜像 %s 失败: %v", src.ConfigDigest, err)
+		}
+		for _, layer := range src.Layers {
+			if layer.BlobPath == "" {
+				continue
+			}
+			if err := storeLayerFile(layer.DiffID, layer.BlobPath); err != nil {
+				return err
+			}
+		}
+		img, err := image.RegisterSource(refs, src)
+		if err != nil {
+			return fmt.Errorf("登记镜像 %s 失败: %v", strings.Join(refs, ", "), err)
+		}
+		logrus.Infof("已导入镜像 %s (%s)，共 %d 层", strings.Join(refs, ", "), img.ShortID(), len(img.Layers))
+	}
+	return nil
+}
+
+// loadRefNames 补全归档中记录的镜像名
+// OCI 镜像布局的 ref.name 注解通常只有标签（如 "latest"），需要与 name 拼接成完整的镜像名
+func loadRefNames(names []string, name string) ([]string, error) {
+	if len(names) == 0 {
+		if name == "" {
+			return nil, fmt.Errorf("归档中没有记录镜像名，请通过 --name 指定")
+		}
+		return []string{name}, nil
+	}
+	var refs []string
+	for _, n := range names {
+		if name != "" && !strings.ContainsAny(n, ":/") {
+			n = name + ":" + n
+		}
+		refs = append(refs, n)
+	}
+	return refs, nil
+}
+
+// extractArchive 将归档解开到 dir 目录，只允许普通文件、目录和指向归档内部的符号链接
+// docker save 的旧格式中，相同的镜像层会通过符号链接引用
+func extractArchive(archive string, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := image.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	tr := tar.NewReader(stream)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linkTarget := filepath.Join(filepath.Dir(target), hdr.Linkname)
+			if filepath.IsAbs(hdr.Linkname) || !strings.HasPrefix(linkTarget, filepath.Clean(dir)+string(filepath.Separator)) {
+				return fmt.Errorf("归档中的符号链接 %s -> %s 指向归档之外", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			logrus.Warnf("跳过归档中不支持的文件 %s", hdr.Name)
+		}
+	}
+}
@@ -8,10 +8,15 @@ import (
 	"os"
 )
 
-// logContainer 查看指定容器的日志
-func logContainer(containerName string) {
+// logContainer 查看指定容器的日志，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+func logContainer(containerRef string) {
+	info, err := resolveContainer(containerRef)
+	if err != nil {
+		logrus.Errorf("获取容器信息失败: %v", err)
+		return
+	}
 	// 拼接容器日志文件路径
-	logFilePath := fmt.Sprintf(container.DefaultInfoLocation, containerName)
+	logFilePath := fmt.Sprintf(container.DefaultInfoLocation, info.Name)
 	logFileLocation := logFilePath + container.ContainerLogFile
 	// 打开日志文件
 	file, err := os.Open(logFileLocation)
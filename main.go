@@ -20,19 +20,35 @@ func main() {
 		Commands: []*cli.Command{
 			initCommand,    // 初始化容器（由容器进程自动调用）
 			runCommand,     // 创建并运行容器（用户调用）
+			shimCommand,    // 看护后台运行的容器（由 run 命令自动调用）
 			commitCommand,  // 提交容器（用户调用）
+			buildCommand,   // 根据 Dockerfile 构建镜像（用户调用）
+			builderCommand, // 管理 build 的缓存（用户调用）
 			listCommand,    // 列出容器（用户调用）
 			logCommand,     // 查看容器日志（用户调用）
 			execCommand,    // 在容器中执行命令（用户调用）
 			stopCommand,    // 停止容器（用户调用）
 			removeCommand,  // 删除容器（用户调用）
+			updateCommand,  // 修改容器资源限制（用户调用）
+			statsCommand,   // 查看容器资源使用情况（用户调用）
+			inspectCommand, // 查看容器详细信息（用户调用）
+			imagesCommand,  // 列出本地镜像（用户调用）
+			rmiCommand,     // 删除本地镜像（用户调用）
+			tagCommand,     // 给镜像添加标签（用户调用）
+			loadCommand,    // 导入 OCI 镜像或 docker save 归档（用户调用）
+			saveCommand,    // 导出镜像为 OCI 镜像布局或 docker save 归档（用户调用）
+			pullCommand,    // 从镜像仓库拉取镜像（用户调用）
+			pushCommand,    // 推送镜像到镜像仓库（用户调用）
+			exportCommand,  // 导出容器文件系统（用户调用）
+			importCommand,  // 导入容器文件系统为镜像（用户调用）
 			networkCommand, // 网络相关命令（用户调用）
 		},
 		// 在执行命令前统一设置日志格式和输出目标
 		Before: func(c *cli.Context) error {
 			logrus.SetFormatter(&logrus.TextFormatter{}) // 设置为文本日志格式
 			logrus.SetOutput(os.Stdout)                  // 输出日志到标准输出
-			return nil
+			// 以普通用户运行时把状态和镜像换到用户目录下
+			return setupRootless()
 		},
 	}
 
@@ -4,20 +4,59 @@ import (
 	"MiniDocker/cgroup/subsystems"
 	"MiniDocker/container"
 	"MiniDocker/network"
+	"MiniDocker/registry"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"os"
-	"os/exec"
 	"strings"
 )
 
+// resourceFlags 资源限制相关的参数，run 命令和 update 命令共用
+var resourceFlags = []cli.Flag{
+	// -m 参数：用于设置容器的内存限制
+	&cli.StringFlag{
+		Name:  "m",
+		Usage: "设置容器的内存限制，支持 b/k/m/g 以及 Ki/Mi/Gi 单位，例如: -m 512m",
+	},
+	// -cpushare 参数：用于设置容器的 CPU 限制
+	&cli.StringFlag{
+		Name:  "cpushare",
+		Usage: "设置容器的 CPU 限制，例如: -cpushare 512",
+	},
+	// -cpuset 参数：用于设置容器的 CPU 核心限制
+	&cli.StringFlag{
+		Name:  "cpuset",
+		Usage: "设置容器的 CPU 核心限制，例如: -cpuset 0,1",
+	},
+	// --cpus 参数：用于设置容器最多可以使用的 CPU 个数
+	&cli.StringFlag{
+		Name:  "cpus",
+		Usage: "设置容器最多可以使用的 CPU 个数，例如: --cpus 1.5",
+	},
+	// --pids-limit 参数：用于限制容器内的进程数量
+	&cli.Int64Flag{
+		Name:  "pids-limit",
+		Usage: "设置容器内的最大进程数，-1 表示不限制，例如: --pids-limit 100",
+	},
+	// --device-read-bps 参数：用于限制容器读取块设备的速率
+	&cli.StringSliceFlag{
+		Name:  "device-read-bps",
+		Usage: "限制从块设备读取的速率，例如: --device-read-bps /dev/sda:1mb",
+	},
+	// --device-write-bps 参数：用于限制容器写入块设备的速率
+	&cli.StringSliceFlag{
+		Name:  "device-write-bps",
+		Usage: "限制向块设备写入的速率，例如: --device-write-bps /dev/sda:1mb",
+	},
+}
+
 // runCommand 命令定义：用于创建并运行一个容器
 // 使用示例：MiniDocker run -ti /bin/bash
 var runCommand = &cli.Command{
 	Name:  "run", // 命令名称为 run
 	Usage: `创建一个容器，并启用 namespace 和 cgroups 资源限制，例如: MiniDocker run -ti [镜像名] [命令]`,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// -ti 参数：表示是否启用 tty 和交互模式
 		&cli.BoolFlag{
 			Name:  "ti",
@@ -28,21 +67,6 @@ var runCommand = &cli.Command{
 			Name:  "d",
 			Usage: "后台运行容器",
 		},
-		// -m 参数：用于设置容器的内存限制
-		&cli.StringFlag{
-			Name:  "m",
-			Usage: "设置容器的内存限制，例如: -m 512m",
-		},
-		// -cpushare 参数：用于设置容器的 CPU 限制
-		&cli.StringFlag{
-			Name:  "cpushare",
-			Usage: "设置容器的 CPU 限制，例如: -cpushare 512",
-		},
-		// -cpuset 参数：用于设置容器的 CPU 核心限制
-		&cli.StringFlag{
-			Name:  "cpuset",
-			Usage: "设置容器的 CPU 核心限制，例如: -cpuset 0,1",
-		},
 		// --name 参数：用于设置容器的名称
 		&cli.StringFlag{
 			Name:  "name",
@@ -61,18 +85,55 @@ var runCommand = &cli.Command{
 		// -net 参数：用于设置容器的网络配置
 		&cli.StringFlag{
 			Name:  "net",
-			Usage: "设置容器的网络配置，例如: --net bridge",
+			Usage: "设置容器的网络配置，例如: --net bridge，rootless 模式下只支持 --net slirp4netns",
 		},
 		// -p 参数：用于设置端口映射
 		&cli.StringSliceFlag{
 			Name:  "p",
 			Usage: "设置端口映射，例如: -p 8080:80",
 		},
-	},
+		// --entrypoint 参数：用于替换镜像的入口程序
+		&cli.StringFlag{
+			Name:  "entrypoint",
+			Usage: "替换镜像的入口程序，指定为空字符串时清除入口程序，例如: --entrypoint /bin/sh",
+		},
+		// -w 参数：用于设置容器的工作目录
+		&cli.StringFlag{
+			Name:    "workdir",
+			Aliases: []string{"w"},
+			Usage:   "设置容器的工作目录，例如: -w /app",
+		},
+		// -u 参数：用于设置运行容器命令的用户
+		&cli.StringFlag{
+			Name:    "user",
+			Aliases: []string{"u"},
+			Usage:   "设置运行容器命令的用户，格式为 user[:group]，例如: -u nobody 或 -u 1000:1000",
+		},
+		// --userns-remap 参数：在用户命名空间中运行容器
+		&cli.StringFlag{
+			Name:  "userns-remap",
+			Usage: "在用户命名空间中运行容器，按 /etc/subuid 和 /etc/subgid 中该用户的范围映射 uid/gid，格式为 user[:group]，例如: --userns-remap dockremap",
+		},
+		// --cgroupns 参数：容器是否使用自己的 cgroup 命名空间
+		&cli.StringFlag{
+			Name:  "cgroupns",
+			Value: container.CgroupNamespaceHost,
+			Usage: "容器的 cgroup 命名空间，private 为容器创建新的 cgroup 命名空间并在 /sys/fs/cgroup 只读挂载自己的 cgroup，host 与宿主机共用",
+		},
+		// --monotonic-offset 和 --boottime-offset 参数：在时间命名空间中运行容器
+		&cli.DurationFlag{
+			Name:  "monotonic-offset",
+			Usage: "在时间命名空间中运行容器，容器中的 CLOCK_MONOTONIC 比宿主机快指定的时长（可以为负），例如: --monotonic-offset 240h",
+		},
+		&cli.DurationFlag{
+			Name:  "boottime-offset",
+			Usage: "在时间命名空间中运行容器，容器中的 CLOCK_BOOTTIME（开机时长）比宿主机快指定的时长（可以为负），例如: --boottime-offset 240h",
+		},
+	}, resourceFlags...),
 	Action: func(ctx *cli.Context) error {
-		// 参数检查：至少需要一个命令参数（即用户要运行的程序）
+		// 参数检查：至少需要镜像名，命令可以省略，省略时执行镜像的默认命令
 		if ctx.NArg() < 1 {
-			return fmt.Errorf("缺少要执行的命令参数")
+			return fmt.Errorf("缺少镜像名参数")
 		}
 		// 获取完整的命令数组（包含命令和其参数）
 		var commandArray []string
@@ -91,26 +152,55 @@ var runCommand = &cli.Command{
 		if createTty && detach {
 			return fmt.Errorf("不能同时使用 -ti 和 -d 参数")
 		}
-		// resConf 是资源限制配置结构体，包含内存、CPU 权重和 CPU 核心限制
-		resConf := &subsystems.ResourceConfig{
-			MemoryLimit: ctx.String("m"),        // 内存限制
-			CpuShare:    ctx.String("cpushare"), // CPU 权重限制
-			CpuSet:      ctx.String("cpuset"),   // CPU 核心限制
+		// resConf 是资源限制配置结构体，包含内存、CPU、进程数和块设备限速等限制
+		// 在创建容器之前解析并检查取值范围，非法的值直接报错
+		resConf := &subsystems.ResourceConfig{}
+		if err := parseResourceConfig(ctx, resConf); err != nil {
+			return fmt.Errorf("资源限制参数错误: %v", err)
 		}
 		logrus.Infof("createTty: %v", createTty)
-		// 获取容器名称参数
-		containerName := ctx.String("name")
-		// 获取用户指定的挂载目录（形如 /宿主机路径:/容器路径）
-		volume := ctx.String("v")
-		// envSlice 是一个字符串切片，用于存储环境变量
-		envSlice := ctx.StringSlice("e") // 获取环境变量参数
-		// network 是网络配置参数
-		network := ctx.String("net")
-		// portmapping 是端口映射参数
-		portmapping := ctx.StringSlice("p") // 获取端口映射参数
+		// 容器的全部运行参数，-v 为挂载目录（形如 /宿主机路径:/容器路径），-e 为环境变量，-p 为端口映射
+		cfg := &runConfig{
+			Tty:           createTty,
+			CommandArray:  commandArray,
+			Volume:        ctx.String("v"),
+			Resource:      resConf,
+			ContainerName: ctx.String("name"),
+			ImageName:     imageName,
+			EnvSlice:      ctx.StringSlice("e"),
+			Network:       ctx.String("net"),
+			PortMapping:   ctx.StringSlice("p"),
+			WorkingDir:    ctx.String("workdir"),
+			User:          ctx.String("user"),
+		}
+		if remap := ctx.String("userns-remap"); remap != "" {
+			userns, err := container.LookupRemapUser(remap)
+			if err != nil {
+				return err
+			}
+			cfg.UserNamespace = userns
+		}
+		cgroupns, err := container.CheckCgroupNamespace(ctx.String("cgroupns"))
+		if err != nil {
+			return err
+		}
+		cfg.CgroupNamespace = cgroupns
+		// 指定了任何一个时钟偏移量时才创建时间命名空间
+		if ctx.IsSet("monotonic-offset") || ctx.IsSet("boottime-offset") {
+			cfg.TimeOffsets = &container.TimeOffsets{
+				Monotonic: ctx.Duration("monotonic-offset"),
+				Boottime:  ctx.Duration("boottime-offset"),
+			}
+		}
+		// 只有指定了 --entrypoint 才替换镜像的入口程序，指定为空字符串表示清除入口程序
+		if ctx.IsSet("entrypoint") {
+			cfg.Entrypoint = []string{}
+			if entrypoint := ctx.String("entrypoint"); entrypoint != "" {
+				cfg.Entrypoint = []string{entrypoint}
+			}
+		}
 		// 执行容器创建与运行逻辑
-		Run(createTty, commandArray, volume, resConf, containerName, imageName, envSlice, network, portmapping)
-		return nil
+		return Run(cfg)
 	},
 }
 
@@ -128,18 +218,117 @@ var initCommand = &cli.Command{
 	},
 }
 
+// shimCommand 命令定义：后台容器的 shim 进程
+// 注意：这个命令不是用户手动调用的，而是由 run 命令在后台运行容器时自动启动
+var shimCommand = &cli.Command{
+	Name:  "shim",
+	Usage: `启动并看护后台运行的容器，由 run -d 自动调用`,
+	Action: func(ctx *cli.Context) error {
+		return runShim()
+	},
+}
+
+// stringList 可以多次指定的字符串参数，与 StringSliceFlag 不同，不会按逗号拆分参数值
+type stringList []string
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
 // commitCommand 命令定义：提交容器的更改为新的镜像
 var commitCommand = &cli.Command{
 	Name:  "commit",
 	Usage: "提交容器的更改",
+	Flags: []cli.Flag{
+		// -m 参数：提交说明
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "提交说明，例如: -m \"安装了 curl\"",
+		},
+		// -a 参数：作者
+		&cli.StringFlag{
+			Name:    "author",
+			Aliases: []string{"a"},
+			Usage:   "镜像的作者，例如: -a \"name <mail@example.com>\"",
+		},
+		// -c 参数：修改镜像配置，指令中可能含有逗号，所以不能用会按逗号拆分的 StringSliceFlag
+		&cli.GenericFlag{
+			Name:    "change",
+			Aliases: []string{"c"},
+			Value:   &stringList{},
+			Usage:   "修改镜像配置，支持 CMD、ENTRYPOINT、ENV、WORKDIR、USER 和 EXPOSE 指令，可以指定多次，例如: -c 'CMD [\"sh\", \"-l\"]' -c 'ENV DEBUG=1'",
+		},
+	},
 	Action: func(ctx *cli.Context) error {
 		if ctx.NArg() < 2 {
 			return fmt.Errorf("缺少容器名称参数和镜像名称参数")
 		}
 		containerName := ctx.Args().Get(0) // 获取容器名称
 		imageName := ctx.Args().Get(1)     // 获取镜像名称
-		commitContainer(containerName, imageName)
-		return nil
+		return commitContainer(containerName, imageName, commitOptions{
+			Message: ctx.String("message"),
+			Author:  ctx.String("author"),
+			Changes: *ctx.Generic("change").(*stringList),
+		})
+	},
+}
+
+// buildCommand 命令定义：根据 Dockerfile 构建镜像
+var buildCommand = &cli.Command{
+	Name:      "build",
+	Usage:     "根据 Dockerfile 构建镜像，支持 FROM、RUN、COPY、ENV、WORKDIR、CMD 和 ENTRYPOINT，例如: MiniDocker build -t myapp:v1 .",
+	ArgsUsage: "构建上下文目录",
+	Flags: []cli.Flag{
+		// -t 参数：构建出的镜像名
+		&cli.StringFlag{
+			Name:     "tag",
+			Aliases:  []string{"t"},
+			Usage:    "构建出的镜像名，例如: -t myapp:v1",
+			Required: true,
+		},
+		// -f 参数：Dockerfile 路径
+		&cli.StringFlag{
+			Name:    "file",
+			Aliases: []string{"f"},
+			Usage:   "Dockerfile 的路径，默认为构建上下文目录中的 Dockerfile",
+		},
+		// --no-cache 参数：不使用缓存
+		&cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "不使用之前构建的缓存，重新执行所有步骤",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少构建上下文目录参数")
+		}
+		return buildImage(buildOptions{
+			Tag:        ctx.String("tag"),
+			Dockerfile: ctx.String("file"),
+			Context:    ctx.Args().Get(0),
+			NoCache:    ctx.Bool("no-cache"),
+		})
+	},
+}
+
+// builderCommand 命令定义：管理 build 命令的缓存
+var builderCommand = &cli.Command{
+	Name:  "builder",
+	Usage: "管理 build 命令的缓存",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "prune",
+			Usage: "删除 build 命令缓存的中间镜像，构建出的镜像仍然使用的镜像层会保留",
+			Action: func(ctx *cli.Context) error {
+				return pruneBuildCache()
+			},
+		},
 	},
 }
 
@@ -172,45 +361,10 @@ var execCommand = &cli.Command{
 	Name:  "exec",
 	Usage: "在容器中执行命令",
 	Action: func(ctx *cli.Context) error {
-		// 这里检查环境变量，表示我们已经在容器内部了
+		// 这里检查环境变量，表示 nsenter 已经把当前进程放进了容器，从管道读取要执行的命令
 		if os.Getenv(ENV_EXEC_PID) != "" {
 			logrus.Infof("pid callback pid %d", os.Getpid())
-
-			// 强制确保当前在容器根目录下
-			if err := os.Chdir("/"); err != nil {
-				logrus.Errorf("切换到根目录失败: %v", err)
-			}
-
-			// 记录当前工作目录
-			cwd, err := os.Getwd()
-			if err == nil {
-				logrus.Infof("当前工作目录: %s", cwd)
-			} else {
-				logrus.Errorf("获取工作目录失败: %v", err)
-			}
-
-			// 获取要执行的命令
-			cmdStr := os.Getenv(ENV_EXEC_CMD)
-			if cmdStr == "" {
-				return fmt.Errorf("没有指定要执行的命令")
-			}
-
-			// 分割命令字符串为命令和参数
-			// 这里需要特别注意空格分隔的处理
-			cmdParts := strings.Fields(cmdStr) // 使用 Fields 更好地处理多个空格
-			if len(cmdParts) == 0 {
-				return fmt.Errorf("命令为空")
-			}
-
-			// 创建命令
-			cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			cmd.Dir = "/" // 强制设置工作目录为根目录
-
-			// 执行命令
-			return cmd.Run()
+			return container.RunExecProcess()
 		}
 
 		// 原有的代码，处理非容器内部的情况
@@ -233,6 +387,15 @@ var execCommand = &cli.Command{
 var stopCommand = &cli.Command{
 	Name:  "stop",
 	Usage: "停止容器",
+	Flags: []cli.Flag{
+		// -t 参数：等待容器退出的时间，超时后强制杀死容器
+		&cli.DurationFlag{
+			Name:    "time",
+			Aliases: []string{"t"},
+			Value:   defaultStopTimeout,
+			Usage:   "发送 SIGTERM 后等待容器退出的时间，超时后发送 SIGKILL，例如: -t 30s",
+		},
+	},
 	Action: func(ctx *cli.Context) error {
 		// 参数检查：至少需要一个容器名称参数
 		if ctx.NArg() < 1 {
@@ -240,7 +403,7 @@ var stopCommand = &cli.Command{
 		}
 		containerName := ctx.Args().Get(0) // 获取容器名称
 		// 停止容器
-		stopContainer(containerName)
+		stopContainer(containerName, ctx.Duration("time"))
 		return nil
 	},
 }
@@ -261,10 +424,292 @@ var removeCommand = &cli.Command{
 	},
 }
 
+// updateCommand 命令定义：修改运行中容器的资源限制
+var updateCommand = &cli.Command{
+	Name:      "update",
+	Usage:     "修改运行中容器的资源限制，例如: MiniDocker update -m 256m [容器名称或 ID]",
+	ArgsUsage: "[容器名称或 ID]",
+	Flags:     resourceFlags,
+	Before:    requireRoot("update", "容器不使用 cgroup，无法修改资源限制"),
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少容器名称参数")
+		}
+		if ctx.NumFlags() == 0 {
+			return fmt.Errorf("至少需要指定一个资源限制参数")
+		}
+		return updateContainer(ctx, ctx.Args().Get(0))
+	},
+}
+
+// statsCommand 命令定义：查看容器的资源使用情况
+var statsCommand = &cli.Command{
+	Name:      "stats",
+	Usage:     "实时查看容器的 CPU、内存和进程数使用情况，例如: MiniDocker stats [容器名称或 ID...]",
+	ArgsUsage: "[容器名称或 ID...]",
+	Before:    requireRoot("stats", "容器不使用 cgroup，无法统计资源使用情况"),
+	Flags: []cli.Flag{
+		// --no-stream 参数：只输出一次结果，不持续刷新
+		&cli.BoolFlag{
+			Name:  "no-stream",
+			Usage: "只输出一次结果，不持续刷新",
+		},
+		// --json 参数：以 JSON 格式输出
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "以 JSON 格式输出，每次采样输出一行",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return statsContainers(ctx.Args().Slice(), ctx.Bool("no-stream"), ctx.Bool("json"))
+	},
+}
+
+// inspectCommand 命令定义：查看容器的详细信息
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "以 JSON 格式查看容器的详细信息，例如: MiniDocker inspect --format '{{.Status}}' [容器名称或 ID...]",
+	ArgsUsage: "[容器名称或 ID...]",
+	Flags: []cli.Flag{
+		// --format 参数：使用 Go 模板格式化输出
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "使用 Go 模板格式化输出，例如: --format '{{.Status}} {{.ExitCode}}'",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少容器名称参数")
+		}
+		return inspectContainers(ctx.Args().Slice(), ctx.String("format"))
+	},
+}
+
+// imagesCommand 命令定义：列出本地镜像
+var imagesCommand = &cli.Command{
+	Name:  "images",
+	Usage: "列出本地镜像",
+	Flags: []cli.Flag{
+		// -a 参数：同时列出 build 产生的中间镜像
+		&cli.BoolFlag{
+			Name:    "all",
+			Aliases: []string{"a"},
+			Usage:   "同时列出 build 命令缓存的中间镜像",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		return listImages(ctx.Bool("all"))
+	},
+}
+
+// rmiCommand 命令定义：删除本地镜像
+var rmiCommand = &cli.Command{
+	Name:      "rmi",
+	Usage:     "删除本地镜像，镜像还在被容器使用时拒绝删除，例如: MiniDocker rmi busybox:latest",
+	ArgsUsage: "[镜像名或 ID...]",
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少镜像名称参数")
+		}
+		return removeImages(ctx.Args().Slice())
+	},
+}
+
+// tagCommand 命令定义：给镜像添加新的标签
+var tagCommand = &cli.Command{
+	Name:      "tag",
+	Usage:     "给镜像添加新的标签，例如: MiniDocker tag busybox:1.36 localhost:5000/tools/busybox:v1",
+	ArgsUsage: "[源镜像名或 ID] [新镜像名[:标签]]",
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 2 {
+			return fmt.Errorf("缺少源镜像或新镜像名参数")
+		}
+		return tagImage(ctx.Args().Get(0), ctx.Args().Get(1))
+	},
+}
+
+// loadCommand 命令定义：从 OCI 镜像布局或 docker save 归档中导入镜像
+var loadCommand = &cli.Command{
+	Name:      "load",
+	Usage:     "从 OCI 镜像布局或 docker save 归档中导入镜像，例如: MiniDocker load -i busybox.tar",
+	ArgsUsage: "[归档文件或目录]",
+	Flags: []cli.Flag{
+		// -i 参数：要导入的归档文件或 OCI 镜像布局目录
+		&cli.StringFlag{
+			Name:    "input",
+			Aliases: []string{"i"},
+			Usage:   "要导入的归档文件或 OCI 镜像布局目录",
+		},
+		// --name 参数：归档中只记录了标签或没有记录镜像名时使用的镜像名
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "归档中只有标签或没有镜像名时使用的镜像名，例如: --name busybox",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		input := ctx.String("input")
+		if input == "" {
+			input = ctx.Args().Get(0)
+		}
+		if input == "" {
+			return fmt.Errorf("缺少要导入的归档文件参数")
+		}
+		return loadImages(input, ctx.String("name"))
+	},
+}
+
+// saveCommand 命令定义：把镜像导出为 OCI 镜像布局或 docker save 归档
+var saveCommand = &cli.Command{
+	Name:      "save",
+	Usage:     "把镜像导出为 OCI 镜像布局的 tar 包，例如: MiniDocker save -o busybox.tar busybox:latest",
+	ArgsUsage: "[镜像名[:标签]或镜像 ID...]",
+	Flags: []cli.Flag{
+		// -o 参数：导出的文件，不指定时写到标准输出
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "导出的文件，不指定时写到标准输出",
+		},
+		// --format 参数：归档格式
+		&cli.StringFlag{
+			Name:  "format",
+			Value: "oci",
+			Usage: "归档格式，oci 为 OCI 镜像布局，docker 在此基础上额外写入 docker save 的 manifest.json",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少镜像名称参数")
+		}
+		output := ctx.String("output")
+		// tar 包写到标准输出时，日志改为输出到标准错误，避免混进 tar 包
+		if output == "" {
+			logrus.SetOutput(os.Stderr)
+		}
+		return saveImages(ctx.Args().Slice(), output, ctx.String("format"))
+	},
+}
+
+// registryFlags 镜像仓库相关的参数，pull 命令和 push 命令共用
+var registryFlags = []cli.Flag{
+	// -u 参数：镜像仓库的用户名
+	&cli.StringFlag{
+		Name:    "username",
+		Aliases: []string{"u"},
+		EnvVars: []string{"MINIDOCKER_USERNAME"},
+		Usage:   "镜像仓库的用户名，不指定时匿名访问",
+	},
+	// -p 参数：镜像仓库的密码或访问令牌
+	&cli.StringFlag{
+		Name:    "password",
+		Aliases: []string{"p"},
+		EnvVars: []string{"MINIDOCKER_PASSWORD"},
+		Usage:   "镜像仓库的密码或访问令牌",
+	},
+	// --insecure 参数：使用 http 访问镜像仓库
+	&cli.BoolFlag{
+		Name:  "insecure",
+		Usage: "使用 http 而不是 https 访问镜像仓库，localhost 上的镜像仓库默认使用 http",
+	},
+}
+
+// registryOptions 从命令参数中取出镜像仓库的连接选项
+func registryOptions(ctx *cli.Context) registry.Options {
+	return registry.Options{
+		Username: ctx.String("username"),
+		Password: ctx.String("password"),
+		Insecure: ctx.Bool("insecure"),
+	}
+}
+
+// pullCommand 命令定义：从镜像仓库拉取镜像
+var pullCommand = &cli.Command{
+	Name:      "pull",
+	Usage:     "从镜像仓库拉取镜像，例如: MiniDocker pull busybox:1.36",
+	ArgsUsage: "[镜像名[:标签][@摘要]]",
+	Flags:     registryFlags,
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少镜像名称参数")
+		}
+		return pullImage(ctx.Args().Get(0), registryOptions(ctx))
+	},
+}
+
+// pushCommand 命令定义：把本地镜像推送到镜像仓库
+var pushCommand = &cli.Command{
+	Name:      "push",
+	Usage:     "把本地镜像推送到镜像仓库，例如: MiniDocker push localhost:5000/tools/busybox:v1",
+	ArgsUsage: "[镜像名[:标签]]",
+	Flags:     registryFlags,
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少镜像名称参数")
+		}
+		return pushImage(ctx.Args().Get(0), registryOptions(ctx))
+	},
+}
+
+// exportCommand 命令定义：把容器的文件系统导出为 tar 包
+var exportCommand = &cli.Command{
+	Name:      "export",
+	Usage:     "把容器的文件系统导出为 tar 包，例如: MiniDocker export web -o web.tar",
+	ArgsUsage: "[容器名称或 ID]",
+	Flags: []cli.Flag{
+		// -o 参数：导出的文件，不指定时写到标准输出
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "导出的文件，不指定时写到标准输出",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 1 {
+			return fmt.Errorf("缺少容器名称参数")
+		}
+		output := ctx.String("output")
+		// tar 包写到标准输出时，日志改为输出到标准错误，避免混进 tar 包
+		if output == "" {
+			logrus.SetOutput(os.Stderr)
+		}
+		return exportContainer(ctx.Args().Get(0), output)
+	},
+}
+
+// importCommand 命令定义：把 tar 包导入为镜像
+var importCommand = &cli.Command{
+	Name:      "import",
+	Usage:     "把容器文件系统的 tar 包（支持 gzip 和 zstd 压缩）导入为镜像，例如: MiniDocker import web.tar web:v1",
+	ArgsUsage: "[tar 包，- 表示标准输入] [镜像名[:标签]]",
+	Flags: []cli.Flag{
+		// -m 参数：导入说明
+		&cli.StringFlag{
+			Name:    "message",
+			Aliases: []string{"m"},
+			Usage:   "导入说明，记录在镜像历史中",
+		},
+		// -c 参数：修改镜像配置
+		&cli.GenericFlag{
+			Name:    "change",
+			Aliases: []string{"c"},
+			Value:   &stringList{},
+			Usage:   "修改镜像配置，格式与 commit 的 --change 相同，例如: -c 'CMD [\"sh\"]'",
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		if ctx.NArg() < 2 {
+			return fmt.Errorf("缺少 tar 包参数和镜像名称参数")
+		}
+		return importImage(ctx.Args().Get(0), ctx.Args().Get(1), ctx.String("message"), *ctx.Generic("change").(*stringList))
+	},
+}
+
 // networkCommand 命令定义：网络相关命令
 var networkCommand = &cli.Command{
-	Name:  "network",
-	Usage: "网络相关命令",
+	Name:   "network",
+	Usage:  "网络相关命令",
+	Before: requireRoot("network", "bridge 网络需要 root 权限创建网桥和 iptables 规则，容器可以使用 --net slirp4netns 接入网络"),
 	Subcommands: []*cli.Command{
 		{
 			Name:  "create",
@@ -78,9 +78,19 @@ func (d *BridgeNetworkDriver) Connect(network *NetWork, endpoint *Endpoint) erro
 	return nil
 }
 
-// Disconnect 断开网络和端点设备的连接
+// Disconnect 断开网络和端点设备的连接，删除宿主机一端的 veth 设备，另一端随之删除
+// 容器的网络命名空间已经销毁时 veth 设备也已经不存在，这时直接返回
 func (d *BridgeNetworkDriver) Disconnect(network NetWork, endpoint *Endpoint) error {
-	// 断开连接的逻辑可根据需求实现
+	link, err := netlink.LinkByName(endpoint.Device.Name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("获取端点设备 %s 时出错：%v", endpoint.Device.Name, err)
+	}
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("删除端点设备 %s 时出错：%v", endpoint.Device.Name, err)
+	}
 	return nil
 }
 
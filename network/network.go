@@ -177,7 +177,8 @@ func CreateNetWork(driver string, subnet string, name string) error {
 }
 
 // Connect 将容器连接到指定的网络，配置容器的 IP 地址和端口映射
-func Connect(networkName string, info *container.Info) error {
+// 中途失败时释放已经分配的 IP 地址并删除已经创建的端点设备
+func Connect(networkName string, info *container.Info) (err error) {
 	network, ok := networks[networkName]
 	if !ok {
 		return fmt.Errorf("未找到网络: %s", networkName)
@@ -188,6 +189,11 @@ func Connect(networkName string, info *container.Info) error {
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			ipAllocator.Release(network.IpRange, &ip)
+		}
+	}()
 
 	// 创建网络端点
 	ep := &Endpoint{
@@ -202,11 +208,78 @@ func Connect(networkName string, info *container.Info) error {
 	}
 	// 配置容器的 IP 地址和路由
 	if err = configEndpointIpAddressAndRoute(ep, info); err != nil {
+		drivers[network.Driver].Disconnect(*network, ep)
 		return err
 	}
 
 	// 配置端口映射
-	return configPortMapping(ep, info)
+	if err = configPortMapping(ep, info); err != nil {
+		return err
+	}
+
+	// 把端点信息记录到容器信息中，供 inspect 查看
+	interfaceIP := *network.IpRange
+	interfaceIP.IP = ep.IPAddress
+	info.Networks = append(info.Networks, &container.NetworkEndpoint{
+		Network:    networkName,
+		EndpointID: ep.ID,
+		IPAddress:  interfaceIP.String(),
+		Gateway:    network.IpRange.IP.String(),
+		HostDevice: ep.Device.Name,
+	})
+	return nil
+}
+
+// Disconnect 断开容器与它接入的所有网络的连接：删除端口映射的 iptables 规则和端点设备，释放容器的 IP 地址，
+// 终止为容器提供网络的 slirp4netns。用于容器启动失败、容器退出和删除容器时的清理，容器信息中的端点记录随之清空
+// shim 和 rm 中还没有加载网络配置，有网桥网络的端点时先调用 Init 加载
+func Disconnect(info *container.Info) error {
+	var errs []string
+	for _, record := range info.Networks {
+		if record.Network != SlirpNetwork && len(drivers) == 0 {
+			if err := Init(); err != nil {
+				return fmt.Errorf("加载网络配置失败: %v", err)
+			}
+			break
+		}
+	}
+	for _, record := range info.Networks {
+		if record.Network == SlirpNetwork {
+			if err := disconnectSlirp(record); err != nil {
+				errs = append(errs, err.Error())
+			}
+			continue
+		}
+		network, ok := networks[record.Network]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("未找到网络: %s", record.Network))
+			continue
+		}
+		ip, _, err := net.ParseCIDR(record.IPAddress)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("端点 %s 的 IP 地址 %s 格式错误", record.EndpointID, record.IPAddress))
+			continue
+		}
+		ep := &Endpoint{
+			ID:          record.EndpointID,
+			IPAddress:   ip,
+			Network:     network,
+			PortMapping: info.PortMapping,
+		}
+		ep.Device.Name = record.HostDevice
+		removePortMapping(ep)
+		if err := drivers[network.Driver].Disconnect(*network, ep); err != nil {
+			errs = append(errs, err.Error())
+		}
+		if err := ipAllocator.Release(network.IpRange, &ip); err != nil {
+			errs = append(errs, fmt.Sprintf("释放IP地址错误: %v", err))
+		}
+	}
+	info.Networks = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
 }
 
 // ListNetwork 列出所有网络的信息
@@ -330,6 +403,17 @@ func enterContainerNetns(enLink *netlink.Link, info *container.Info) func() {
 
 // configPortMapping 配置容器的端口映射
 func configPortMapping(ep *Endpoint, info *container.Info) error {
+	updatePortMapping(ep, "-A")
+	return nil
+}
+
+// removePortMapping 删除容器端口映射的 iptables 规则
+func removePortMapping(ep *Endpoint) {
+	updatePortMapping(ep, "-D")
+}
+
+// updatePortMapping 按端口映射添加（-A）或删除（-D）iptables 的 DNAT 规则
+func updatePortMapping(ep *Endpoint, action string) {
 	// 遍历端口映射列表
 	for _, pm := range ep.PortMapping {
 		// 分割端口映射字符串
@@ -338,9 +422,9 @@ func configPortMapping(ep *Endpoint, info *container.Info) error {
 			logrus.Errorf("端口映射格式错误，%v", pm)
 			continue
 		}
-		// 将端口映射添加到 iptables
-		iptablesCmd := fmt.Sprintf("-t nat -A PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
-			portMapping[0], ep.IPAddress.String(), portMapping[1])
+		// 将端口映射添加到 iptables 或从中删除
+		iptablesCmd := fmt.Sprintf("-t nat %s PREROUTING -p tcp -m tcp --dport %s -j DNAT --to-destination %s:%s",
+			action, portMapping[0], ep.IPAddress.String(), portMapping[1])
 		// 执行 iptables 命令进行端口映射
 		cmd := exec.Command("iptables", strings.Split(iptablesCmd, " ")...)
 		output, err := cmd.Output()
@@ -349,5 +433,4 @@ func configPortMapping(ep *Endpoint, info *container.Info) error {
 			continue
 		}
 	}
-	return nil
 }
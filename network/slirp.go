@@ -0,0 +1,79 @@
+package network
+
+import (
+	"MiniDocker/container"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SlirpNetwork 用户态网络的名字，通过 slirp4netns 在容器的网络命名空间中创建 tap 设备，
+// 由用户态的 TCP/IP 协议栈转发流量，不需要网桥、veth 和 iptables，rootless 模式下也可以使用
+const SlirpNetwork = "slirp4netns"
+
+// slirp4netns --configure 为容器配置的固定地址，见 slirp4netns(1)
+const (
+	slirpDevice    = "tap0"
+	slirpIPAddress = "10.0.2.100/24"
+	slirpGateway   = "10.0.2.2"
+)
+
+// ConnectSlirp 启动 slirp4netns 为容器提供网络，等到它配置好容器中的 tap 设备和默认路由后返回
+// slirp4netns 在后台一直运行，进程号记录在容器的网络端点中，Disconnect 时终止它
+func ConnectSlirp(info *container.Info) error {
+	path, err := exec.LookPath(SlirpNetwork)
+	if err != nil {
+		return fmt.Errorf("没有找到 %s，请先安装: %v", SlirpNetwork, err)
+	}
+	readyRead, readyWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyRead.Close()
+
+	// --ready-fd 为 fd3，配置完成后 slirp4netns 向它写入 1；--disable-host-loopback 禁止容器访问宿主机的 127.0.0.1
+	cmd := exec.Command(path, "--configure", "--mtu=65520", "--disable-host-loopback", "--ready-fd=3", info.Pid, slirpDevice)
+	cmd.ExtraFiles = []*os.File{readyWrite}
+	// 脱离当前终端，前台容器按 Ctrl-C 时不会把 slirp4netns 一起终止
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	readyWrite.Close()
+	if err != nil {
+		return fmt.Errorf("启动 %s 失败: %v", SlirpNetwork, err)
+	}
+	ready := make([]byte, 1)
+	if n, _ := readyRead.Read(ready); n != 1 || ready[0] != '1' {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("%s 没有完成容器网络的配置", SlirpNetwork)
+	}
+	info.Networks = append(info.Networks, &container.NetworkEndpoint{
+		Network:    SlirpNetwork,
+		EndpointID: fmt.Sprintf("%s-%s", info.Id, SlirpNetwork),
+		IPAddress:  slirpIPAddress,
+		Gateway:    slirpGateway,
+		HostDevice: slirpDevice,
+		HelperPid:  cmd.Process.Pid,
+	})
+	return nil
+}
+
+// disconnectSlirp 终止为容器提供网络的 slirp4netns
+// 先确认进程还是 slirp4netns，避免进程号被复用后误杀其他进程
+func disconnectSlirp(record *container.NetworkEndpoint) error {
+	if record.HelperPid <= 0 {
+		return nil
+	}
+	comm, err := ioutil.ReadFile("/proc/" + strconv.Itoa(record.HelperPid) + "/comm")
+	if err != nil || strings.TrimSpace(string(comm)) != SlirpNetwork {
+		return nil
+	}
+	if err := syscall.Kill(record.HelperPid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("终止 %s 进程 %d 失败: %v", SlirpNetwork, record.HelperPid, err)
+	}
+	return nil
+}
@@ -10,27 +10,10 @@ package nsenter
 #include <fcntl.h>
 #include <unistd.h>
 #include <sys/mount.h>
-
-// 辅助函数：把命令字符串分割成参数数组
-char **split_cmd(char *cmd, int *argc) {
-    char **argv = NULL;
-    char *token = strtok(cmd, " ");
-    int count = 0;
-
-    while (token != NULL) {
-        argv = realloc(argv, sizeof(char*) * (count + 1));
-        argv[count] = token;
-        count++;
-        token = strtok(NULL, " ");
-    }
-
-    // 最后添加一个 NULL，execvp 需要
-    argv = realloc(argv, sizeof(char*) * (count + 1));
-    argv[count] = NULL;
-
-    *argc = count;
-    return argv;
-}
+#include <sys/stat.h>
+#include <sys/wait.h>
+#include <signal.h>
+#include <grp.h>
 
 // 该函数被标记为 constructor，意思是：在 Go 程序加载这个包时，
 // 这段 C 代码会自动执行，不需要手动调用。
@@ -41,29 +24,49 @@ __attribute__((constructor)) void enter_namespace(void) {
         return;  // 没有设置环境变量，直接返回
     }
 
-    char *MiniDocker_cmd;
-    MiniDocker_cmd = getenv("MiniDocker_cmd");
-    if (!MiniDocker_cmd) {
-        return;  // 没有命令，直接返回
-    }
+    int i;
+    char nspath[1024];
 
-    // 获取容器挂载目录路径
-    char *MiniDocker_rootfs = getenv("MiniDocker_rootfs");
-    if (!MiniDocker_rootfs) {
-        fprintf(stderr, "未设置挂载目录路径 MiniDocker_rootfs\n");
-        exit(1);
+    // 容器启用了用户命名空间时最先进入它，之后才有权限进入它所拥有的其余命名空间。
+    // 容器没有单独的用户命名空间时与当前进程相同，内核不允许重复进入，跳过
+    struct stat self_ns, container_ns;
+    sprintf(nspath, "/proc/%s/ns/user", MiniDocker_pid);
+    if (stat("/proc/self/ns/user", &self_ns) == 0 && stat(nspath, &container_ns) == 0 &&
+        (self_ns.st_dev != container_ns.st_dev || self_ns.st_ino != container_ns.st_ino)) {
+        int fd = open(nspath, O_RDONLY);
+        if (fd < 0 || setns(fd, CLONE_NEWUSER) == -1) {
+            fprintf(stderr, "进入命名空间 user 失败: %s\n", strerror(errno));
+            exit(1);
+        }
+        close(fd);
+        // 进入用户命名空间后以容器中的 root 身份运行，与容器的 init 进程一致
+        // rootless 模式的用户命名空间禁用了 setgroups，这时返回 EPERM，保留原有的附加组即可
+        if (setresgid(0, 0, 0) != 0 || (setgroups(0, NULL) != 0 && errno != EPERM) || setresuid(0, 0, 0) != 0) {
+            fprintf(stderr, "切换到容器中的 root 用户失败: %s\n", strerror(errno));
+            exit(1);
+        }
     }
 
-    int i;
-    char nspath[1024];
-    // 顺序很重要：先进入 uts, ipc, net，再进入 pid，最后进入 mnt
-    char *namespaces[] = { "uts", "ipc", "net", "pid", "mnt" };
+    // 顺序很重要：先进入 cgroup, time, uts, ipc, net，再进入 pid，最后进入 mnt
+    char *namespaces[] = { "cgroup", "time", "uts", "ipc", "net", "pid", "mnt" };
 
     // 遍历所有需要进入的 namespace
-    for (i = 0; i < 5; i++) {
+    for (i = 0; i < 7; i++) {
         // 构造 namespace 文件的路径，例如 /proc/1234/ns/ipc
         sprintf(nspath, "/proc/%s/ns/%s", MiniDocker_pid, namespaces[i]);
 
+        // 内核不支持的命名空间（例如较老内核上的 time）跳过。容器与宿主机共用的命名空间
+        // （例如 --cgroupns host 时的 cgroup）也不需要进入，rootless 模式下没有权限重新进入宿主机的命名空间
+        char selfpath[64];
+        sprintf(selfpath, "/proc/self/ns/%s", namespaces[i]);
+        if (stat(selfpath, &self_ns) != 0) {
+            continue;
+        }
+        if (stat(nspath, &container_ns) == 0 &&
+            self_ns.st_dev == container_ns.st_dev && self_ns.st_ino == container_ns.st_ino) {
+            continue;
+        }
+
         // 打开 namespace 文件，获得文件描述符
         int fd = open(nspath, O_RDONLY);
         if (fd < 0) {
@@ -80,28 +83,36 @@ __attribute__((constructor)) void enter_namespace(void) {
         close(fd);
     }
 
-	// 打印切换前的工作目录，用于调试
-	char cwd_before[1024];
-    if (getcwd(cwd_before, sizeof(cwd_before)) != NULL) {
-        fprintf(stderr, "chroot 前工作目录: %s\n", cwd_before);
-    }
-
-    // 切换到容器的根文件系统
-    if (chroot(MiniDocker_rootfs) != 0) {
-        fprintf(stderr, "chroot 到容器挂载目录失败: %s\n", strerror(errno));
-        exit(1);
-    }
-
-    // 切换工作目录
+    // 进入 mnt 命名空间时内核已经把根目录和工作目录切换到了该命名空间的根，
+    // 也就是容器 init 进程 pivot_root 之后的根文件系统，宿主机上的挂载点路径在这里已经不存在，不需要再 chroot
     if (chdir("/") != 0) {
         fprintf(stderr, "切换工作目录失败: %s\n", strerror(errno));
         exit(1);
     }
 
-    // 打印 chroot 后的工作目录
-    char cwd_after[1024];
-    if (getcwd(cwd_after, sizeof(cwd_after)) != NULL) {
-        fprintf(stderr, "chroot 后工作目录: %s\n", cwd_after);
+    // setns 进入 pid 命名空间只对之后创建的子进程生效，而且在这之后当前进程不能再创建线程，
+    // Go 运行时无法启动，所以再 fork 一次，由真正位于容器 pid 命名空间中的子进程继续执行 Go 代码。
+    // 当前进程只负责等待子进程退出，并以同样的退出码退出
+    pid_t child = fork();
+    if (child < 0) {
+        fprintf(stderr, "创建子进程失败: %s\n", strerror(errno));
+        exit(1);
+    }
+    if (child > 0) {
+        int status;
+        // 与 system() 一样，等待期间忽略终端发来的中断信号，由子进程处理
+        signal(SIGINT, SIG_IGN);
+        signal(SIGQUIT, SIG_IGN);
+        while (waitpid(child, &status, 0) < 0) {
+            if (errno != EINTR) {
+                fprintf(stderr, "等待子进程失败: %s\n", strerror(errno));
+                exit(1);
+            }
+        }
+        if (WIFSIGNALED(status)) {
+            exit(128 + WTERMSIG(status));
+        }
+        exit(WEXITSTATUS(status));
     }
 
     // 确保 /proc 在容器内部已挂载
@@ -111,21 +122,8 @@ __attribute__((constructor)) void enter_namespace(void) {
         }
     }
 
-    // 分割命令字符串为参数数组
-    int argc = 0;
-    char **argv = split_cmd(MiniDocker_cmd, &argc);
-    if (argv == NULL || argc == 0) {
-        fprintf(stderr, "命令解析失败\n");
-        exit(1);
-    }
-
-    // 使用 execvp 执行命令
-    // 在执行前再次确认工作目录是根目录
-    execvp(argv[0], argv);
-
-    // 如果 execvp 返回，说明执行失败
-    fprintf(stderr, "执行命令 %s 失败: %s\n", argv[0], strerror(errno));
-    exit(1);
+    // 返回后 Go 程序正常启动，exec 命令从管道中读取要执行的命令及参数、环境变量等，
+    // 命令参数不在这里解析，参数中可以包含空格、引号或者是空字符串
 }
 */
 import "C"
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"MiniDocker/registry"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+)
+
+// pullCachePath 拉取镜像时下载目录所在的位置，每个镜像引用一个目录，拉取中断后再次拉取时从断点继续
+var pullCachePath = "/var/lib/MiniDocker/image/downloads"
+
+// pullImage 从镜像仓库拉取镜像并登记到本地镜像索引
+func pullImage(refName string, opts registry.Options) error {
+	ref, err := image.ParseReference(refName)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(ref.String()))
+	dir := filepath.Join(pullCachePath, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("创建下载目录 %s 失败: %v", dir, err)
+	}
+
+	logrus.Infof("从 %s 拉取镜像 %s", ref.Registry(), ref.String())
+	if err := registry.Pull(registry.NewClient(ref, opts), ref, dir); err != nil {
+		return fmt.Errorf("拉取镜像 %s 失败: %v", ref.String(), err)
+	}
+	sources, err := image.ReadOCILayout(dir)
+	if err != nil {
+		return fmt.Errorf("读取下载的镜像失败: %v", err)
+	}
+	if err := registerSources(sources, ""); err != nil {
+		return err
+	}
+	// 镜像已经保存到层存储中，下载目录不再需要
+	if err := os.RemoveAll(dir); err != nil {
+		logrus.Warnf("删除下载目录 %s 失败: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"MiniDocker/registry"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+)
+
+// pushImage 把本地镜像推送到镜像名中的镜像仓库，推送前先通过 tag 命令给镜像起一个带仓库地址的名字
+func pushImage(refName string, opts registry.Options) error {
+	ref, err := image.ParseReference(refName)
+	if err != nil {
+		return err
+	}
+	if ref.Digest != "" {
+		return fmt.Errorf("推送镜像时不能指定摘要，摘要由镜像内容决定")
+	}
+	img, err := image.Get(ref.String())
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "MiniDocker-push-")
+	if err != nil {
+		return fmt.Errorf("创建临时目录失败: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := image.WriteLayout(dir, []*image.Image{img}, false)
+	if err != nil {
+		return err
+	}
+
+	opts.Push = true
+	logrus.Infof("推送镜像 %s 到 %s", ref.String(), ref.Registry())
+	digest, err := registry.Push(registry.NewClient(ref, opts), dir, index.Manifests[0], ref.Tag)
+	if err != nil {
+		return fmt.Errorf("推送镜像 %s 失败: %v", ref.String(), err)
+	}
+	logrus.Infof("镜像 %s 推送完成，摘要: %s", ref.String(), digest)
+	return nil
+}
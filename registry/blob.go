@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	// chunkSize 分块上传时每一块的大小
+	chunkSize int64 = 8 << 20
+	// maxRetries 下载或上传中断后最多重试的次数
+	maxRetries = 3
+)
+
+// BlobExists 判断仓库中是否已经有摘要为 digest 的 blob
+func (c *Client) BlobExists(digest string) (bool, error) {
+	resp, err := c.do(http.MethodHead, c.url("/blobs/%s", digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer drainBody(resp)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("查询 blob %s 失败: %s", digest, resp.Status)
+	}
+}
+
+// FetchBlob 下载 desc 对应的 blob 并保存到 file，下载完成后校验摘要和大小
+// 下载中的内容保存在 file.partial 中，连接中断或者下次拉取时通过 Range 请求从断点继续
+func (c *Client) FetchBlob(desc image.Descriptor, file string) error {
+	partial := file + ".partial"
+	var lastErr error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			logrus.Warnf("下载 %s 中断，从断点重试（第 %d 次）: %v", desc.Digest, attempt, lastErr)
+		}
+		if lastErr = c.fetchRange(desc, partial); lastErr == nil {
+			break
+		}
+	}
+	if lastErr != nil {
+		return fmt.Errorf("下载 %s 失败: %v", desc.Digest, lastErr)
+	}
+	if err := image.VerifyDigest(partial, desc.Digest); err != nil {
+		// 内容损坏时删掉已经下载的部分，下次重新下载
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, file)
+}
+
+// fetchRange 从 partial 已有的长度开始继续下载，没有出错时 partial 就是完整的内容
+func (c *Client) fetchRange(desc image.Descriptor, partial string) error {
+	var offset int64
+	if stat, err := os.Stat(partial); err == nil {
+		offset = stat.Size()
+	}
+	if desc.Size > 0 && offset > desc.Size {
+		os.Remove(partial)
+		offset = 0
+	}
+	if desc.Size > 0 && offset == desc.Size {
+		return nil
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(http.MethodGet, c.url("/blobs/%s", desc.Digest), header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// 镜像仓库不支持断点续传时从头下载
+		flags |= os.O_TRUNC
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partial)
+		return fmt.Errorf("镜像仓库不接受断点位置 %d，重新下载", offset)
+	default:
+		return fmt.Errorf("%s", responseError(resp))
+	}
+
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = resp.Body
+	if desc.Size > 0 {
+		// 多读一个字节，用于发现比描述符中记录的更长的内容
+		body = io.LimitReader(resp.Body, desc.Size-offset+1)
+	}
+	n, err := io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset+n != desc.Size {
+		if offset+n > desc.Size {
+			os.Remove(partial)
+			return fmt.Errorf("下载的内容超过了 %d 字节", desc.Size)
+		}
+		return fmt.Errorf("只下载了 %d/%d 字节", offset+n, desc.Size)
+	}
+	return nil
+}
+
+// PushBlob 把文件 file 作为 desc 对应的 blob 分块上传到仓库
+// 每一块通过 PATCH 上传，上传失败时向镜像仓库查询已经收到的长度，从那里继续
+func (c *Client) PushBlob(desc image.Descriptor, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	resp, err := c.do(http.MethodPost, c.url("/blobs/uploads/"), nil, nil)
+	if err != nil {
+		return fmt.Errorf("开始上传 %s 失败: %v", desc.Digest, err)
+	}
+	drainBody(resp)
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("开始上传 %s 失败: %s", desc.Digest, resp.Status)
+	}
+	location, err := resolveLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	retries := 0
+	for offset < desc.Size {
+		end := offset + chunkSize
+		if end > desc.Size {
+			end = desc.Size
+		}
+		next, nextOffset, err := c.patchChunk(f, location, offset, end)
+		if err == nil {
+			location, offset = next, nextOffset
+			continue
+		}
+		if retries++; retries > maxRetries {
+			return fmt.Errorf("上传 %s 失败: %v", desc.Digest, err)
+		}
+		logrus.Warnf("上传 %s 中断，查询上传进度后重试（第 %d 次）: %v", desc.Digest, retries, err)
+		if location, offset, err = c.uploadStatus(location); err != nil {
+			return fmt.Errorf("查询 %s 的上传进度失败: %v", desc.Digest, err)
+		}
+	}
+
+	finishURL := location + "?digest=" + desc.Digest
+	if strings.Contains(location, "?") {
+		finishURL = location + "&digest=" + desc.Digest
+	}
+	resp, err = c.do(http.MethodPut, finishURL, nil, nil)
+	if err != nil {
+		return fmt.Errorf("完成上传 %s 失败: %v", desc.Digest, err)
+	}
+	defer drainBody(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("完成上传 %s 失败: %s", desc.Digest, responseError(resp))
+	}
+	return nil
+}
+
+// patchChunk 上传文件中 [start, end) 的部分，返回新的上传地址和镜像仓库已经收到的长度
+func (c *Client) patchChunk(f *os.File, location string, start int64, end int64) (string, int64, error) {
+	chunk := make([]byte, end-start)
+	if _, err := f.ReadAt(chunk, start); err != nil {
+		return "", 0, err
+	}
+	header := http.Header{
+		"Content-Type":  {"application/octet-stream"},
+		"Content-Range": {fmt.Sprintf("%d-%d", start, end-1)},
+	}
+	resp, err := c.do(http.MethodPatch, location, header, chunk)
+	if err != nil {
+		return "", 0, err
+	}
+	defer drainBody(resp)
+	if resp.StatusCode != http.StatusAccepted {
+		return "", 0, fmt.Errorf("%s", resp.Status)
+	}
+	next, err := resolveLocation(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	if received, ok := parseRange(resp.Header.Get("Range")); ok && received > 0 {
+		return next, received, nil
+	}
+	return next, end, nil
+}
+
+// uploadStatus 查询上传进度，返回新的上传地址和镜像仓库已经收到的长度
+func (c *Client) uploadStatus(location string) (string, int64, error) {
+	resp, err := c.do(http.MethodGet, location, nil, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer drainBody(resp)
+	if resp.StatusCode != http.StatusNoContent {
+		return "", 0, fmt.Errorf("%s", resp.Status)
+	}
+	next, err := resolveLocation(resp)
+	if err != nil {
+		return "", 0, err
+	}
+	received, _ := parseRange(resp.Header.Get("Range"))
+	return next, received, nil
+}
+
+// parseRange 解析上传接口返回的 Range 头，例如 0-1023 表示已经收到 1024 字节
+// 还没有收到任何内容时镜像仓库也会返回 0-0，按没有收到处理，重新上传第一个字节
+func parseRange(value string) (int64, bool) {
+	_, end, ok := strings.Cut(strings.TrimPrefix(value, "bytes="), "-")
+	if !ok {
+		return 0, false
+	}
+	if end == "0" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n + 1, true
+}
@@ -0,0 +1,225 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dockerHubHost docker.io 上的镜像实际通过这个地址访问
+const dockerHubHost = "registry-1.docker.io"
+
+// Options 连接镜像仓库时使用的选项
+type Options struct {
+	Username string // 用户名，为空时匿名访问
+	Password string // 密码或访问令牌
+	Insecure bool   // 使用 http 而不是 https 访问镜像仓库
+	Push     bool   // 是否需要推送权限，申请 token 时会带上 push
+}
+
+// Client 访问镜像仓库中的一个仓库（repository），实现了 OCI distribution 规范中拉取和推送需要的接口
+type Client struct {
+	baseURL    string       // 镜像仓库地址，例如 https://registry-1.docker.io
+	repository string       // 镜像在仓库中的路径，例如 library/busybox
+	opts       Options      // 连接选项
+	token      string       // 当前使用的 Bearer token
+	httpClient *http.Client // 发送请求使用的 HTTP 客户端
+}
+
+// NewClient 为镜像引用 ref 所在的仓库创建客户端
+// localhost 和 127.0.0.1 上的镜像仓库默认使用 http，其他仓库使用 https，除非指定了 Insecure
+func NewClient(ref *image.Reference, opts Options) *Client {
+	host := ref.Registry()
+	if host == image.DefaultRegistry {
+		host = dockerHubHost
+	}
+	scheme := "https"
+	hostname := strings.Split(host, ":")[0]
+	if opts.Insecure || hostname == "localhost" || hostname == "127.0.0.1" {
+		scheme = "http"
+	}
+	// 镜像层可能很大，不限制整个请求的时间，只限制等待响应头的时间
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = time.Minute
+	return &Client{
+		baseURL:    scheme + "://" + host,
+		repository: ref.Repository(),
+		opts:       opts,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+// url 返回仓库下某个接口的完整地址，例如 /v2/library/busybox/manifests/latest
+func (c *Client) url(format string, args ...interface{}) string {
+	return c.baseURL + "/v2/" + c.repository + fmt.Sprintf(format, args...)
+}
+
+// do 发送请求，镜像仓库要求认证时按 WWW-Authenticate 申请 token 后重新发送一次
+// body 在重新发送时需要再读一次，所以用字节切片传入
+func (c *Client) do(method string, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	resp, err := c.send(method, rawURL, header, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	drainBody(resp)
+	if err := c.authorize(challenge); err != nil {
+		return nil, err
+	}
+	return c.send(method, rawURL, header, body)
+}
+
+// send 发送一次请求，带上当前的认证信息
+func (c *Client) send(method string, rawURL string, header http.Header, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	return c.httpClient.Do(req)
+}
+
+// authorize 按镜像仓库返回的认证要求处理认证
+// Basic 认证直接使用用户名和密码；Bearer 认证向 realm 申请一个带有当前仓库权限的 token
+func (c *Client) authorize(challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.opts.Username == "" {
+			return fmt.Errorf("镜像仓库要求用户名和密码，请通过 --username 和 --password 指定")
+		}
+		return fmt.Errorf("用户名或密码错误")
+	case "bearer":
+	default:
+		return fmt.Errorf("镜像仓库拒绝访问，不支持的认证方式 %q", challenge)
+	}
+
+	realm := params["realm"]
+	if realm == "" {
+		return fmt.Errorf("镜像仓库的认证要求中缺少 realm: %s", challenge)
+	}
+	query := url.Values{}
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	actions := "pull"
+	if c.opts.Push {
+		actions = "pull,push"
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:%s", c.repository, actions))
+	tokenURL := realm
+	if strings.Contains(realm, "?") {
+		tokenURL += "&" + query.Encode()
+	} else {
+		tokenURL += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return err
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("申请 token 失败: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("申请 token 失败: %s", responseError(resp))
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("解析 token 失败: %v", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("认证服务没有返回 token")
+	}
+	return nil
+}
+
+// parseChallenge 解析 WWW-Authenticate 头，例如 Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return scheme, params
+}
+
+// responseError 把镜像仓库返回的错误转换成可读的信息，distribution 规范中错误以 {"errors": [...]} 的格式返回
+func responseError(resp *http.Response) string {
+	content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(content, &body) == nil && len(body.Errors) > 0 {
+		var messages []string
+		for _, e := range body.Errors {
+			messages = append(messages, e.Code+": "+e.Message)
+		}
+		return fmt.Sprintf("%s (%s)", resp.Status, strings.Join(messages, "; "))
+	}
+	return resp.Status
+}
+
+// drainBody 读完并关闭响应体，让底层连接可以复用
+func drainBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
+
+// resolveLocation 把响应中的 Location 解析成完整地址，镜像仓库返回的可能是相对路径
+func resolveLocation(resp *http.Response) (string, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("镜像仓库的响应中缺少 Location")
+	}
+	u, err := resp.Request.URL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("解析 Location %q 失败: %v", location, err)
+	}
+	return u.String(), nil
+}
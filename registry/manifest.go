@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxManifestSize manifest 的最大长度，防止镜像仓库返回异常的大文件
+const maxManifestSize = 4 << 20
+
+// manifestAccept 拉取 manifest 时接受的类型，多平台镜像的 manifest 列表排在前面
+var manifestAccept = []string{
+	image.MediaTypeOCIIndex,
+	image.MediaTypeDockerManifestList,
+	image.MediaTypeOCIManifest,
+	image.MediaTypeDockerManifest,
+}
+
+// GetManifest 拉取 reference（标签或摘要）对应的 manifest，返回原始内容和它的描述符
+// 按摘要拉取时校验内容的摘要，镜像仓库返回了 Docker-Content-Digest 时同样校验
+func (c *Client) GetManifest(reference string) ([]byte, image.Descriptor, error) {
+	header := http.Header{"Accept": {strings.Join(manifestAccept, ", ")}}
+	resp, err := c.do(http.MethodGet, c.url("/manifests/%s", reference), header, nil)
+	if err != nil {
+		return nil, image.Descriptor{}, fmt.Errorf("获取 manifest %s 失败: %v", reference, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, image.Descriptor{}, fmt.Errorf("获取 manifest %s 失败: %s", reference, responseError(resp))
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, image.Descriptor{}, fmt.Errorf("读取 manifest %s 失败: %v", reference, err)
+	}
+	if len(content) > maxManifestSize {
+		return nil, image.Descriptor{}, fmt.Errorf("manifest %s 超过了 %d 字节", reference, maxManifestSize)
+	}
+
+	desc := image.Descriptor{Digest: digestBytes(content), Size: int64(len(content))}
+	if strings.Contains(reference, ":") && desc.Digest != reference {
+		return nil, image.Descriptor{}, fmt.Errorf("manifest 的摘要为 %s，与请求的 %s 不一致", desc.Digest, reference)
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" && digest != desc.Digest {
+		return nil, image.Descriptor{}, fmt.Errorf("manifest 的摘要为 %s，与镜像仓库返回的 %s 不一致", desc.Digest, digest)
+	}
+	desc.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	// 有的镜像仓库返回 application/json，以 manifest 中记录的 mediaType 为准
+	var body struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(content, &body) == nil && body.MediaType != "" {
+		desc.MediaType = body.MediaType
+	}
+	switch desc.MediaType {
+	case image.MediaTypeOCIIndex, image.MediaTypeDockerManifestList, image.MediaTypeOCIManifest, image.MediaTypeDockerManifest:
+	default:
+		return nil, image.Descriptor{}, fmt.Errorf("不支持的 manifest 类型 %q，只支持 OCI 和 docker v2 schema 2 格式", desc.MediaType)
+	}
+	return content, desc, nil
+}
+
+// PutManifest 把 manifest 上传到 reference（通常是标签），返回镜像仓库记录的摘要
+func (c *Client) PutManifest(reference string, mediaType string, content []byte) (string, error) {
+	header := http.Header{"Content-Type": {mediaType}}
+	resp, err := c.do(http.MethodPut, c.url("/manifests/%s", reference), header, content)
+	if err != nil {
+		return "", fmt.Errorf("上传 manifest 失败: %v", err)
+	}
+	defer drainBody(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("上传 manifest 失败: %s", responseError(resp))
+	}
+	digest := digestBytes(content)
+	if actual := resp.Header.Get("Docker-Content-Digest"); actual != "" && actual != digest {
+		return "", fmt.Errorf("镜像仓库记录的 manifest 摘要为 %s，与上传的 %s 不一致", actual, digest)
+	}
+	return digest, nil
+}
+
+// digestBytes 计算内容的 sha256 摘要
+func digestBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// isIndex 判断 manifest 是否为多平台镜像的 manifest 列表
+func isIndex(mediaType string) bool {
+	return mediaType == image.MediaTypeOCIIndex || mediaType == image.MediaTypeDockerManifestList
+}
@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+)
+
+// Pull 把 ref 对应的镜像从镜像仓库下载到 dir 目录，写成 OCI 镜像布局，之后可以像 load 一样通过 image.ReadOCILayout 导入
+// 多平台镜像只下载与当前平台匹配的 manifest；已经在层存储中的镜像层不会下载。
+// 下载了一半的 blob 保存在 dir 中，对同一个目录再次调用时从断点继续
+func Pull(c *Client, ref *image.Reference, dir string) error {
+	if ref.Tag == "" {
+		return fmt.Errorf("按摘要拉取镜像时需要同时指定标签，例如 %s:latest@%s", ref.Name(), ref.Digest)
+	}
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest
+	}
+	content, desc, err := c.GetManifest(reference)
+	if err != nil {
+		return err
+	}
+	if isIndex(desc.MediaType) {
+		if desc, err = selectPlatform(content); err != nil {
+			return err
+		}
+		if content, desc, err = c.GetManifest(desc.Digest); err != nil {
+			return err
+		}
+		if isIndex(desc.MediaType) {
+			return fmt.Errorf("manifest %s 是嵌套的 manifest 列表，不支持", desc.Digest)
+		}
+	}
+	var manifest image.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return fmt.Errorf("解析 manifest %s 失败: %v", desc.Digest, err)
+	}
+	if err := writeBlob(dir, desc.Digest, content); err != nil {
+		return err
+	}
+
+	configPath, err := image.BlobPath(dir, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	if err := fetchBlobOnce(c, manifest.Config, configPath); err != nil {
+		return err
+	}
+	var config image.ConfigFile
+	if err := readJSON(configPath, &config); err != nil {
+		return fmt.Errorf("解析镜像 config 失败: %v", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("manifest %s 有 %d 层，但 config 中记录了 %d 层", desc.Digest, len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, layer := range manifest.Layers {
+		if image.LayerStored(config.RootFS.DiffIDs[i]) {
+			logrus.Infof("镜像层 %s 已存在，跳过下载", shortDigest(layer.Digest))
+			continue
+		}
+		layerPath, err := image.BlobPath(dir, layer.Digest)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("下载镜像层 %s (%d 字节)", shortDigest(layer.Digest), layer.Size)
+		if err := fetchBlobOnce(c, layer, layerPath); err != nil {
+			return err
+		}
+	}
+
+	desc.Annotations = map[string]string{image.AnnotationContainerdName: ref.Name() + ":" + ref.Tag}
+	index := image.Index{SchemaVersion: 2, MediaType: image.MediaTypeOCIIndex, Manifests: []image.Descriptor{desc}}
+	content, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(dir, "index.json"), content, 0644)
+}
+
+// selectPlatform 从 manifest 列表中选出与当前平台匹配的 manifest
+func selectPlatform(content []byte) (image.Descriptor, error) {
+	var index image.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		return image.Descriptor{}, fmt.Errorf("解析 manifest 列表失败: %v", err)
+	}
+	for _, m := range index.Manifests {
+		if m.Platform == nil || (m.Platform.OS == runtime.GOOS && m.Platform.Architecture == runtime.GOARCH) {
+			return m, nil
+		}
+	}
+	return image.Descriptor{}, fmt.Errorf("镜像没有 %s/%s 平台的版本", runtime.GOOS, runtime.GOARCH)
+}
+
+// fetchBlobOnce 下载 blob，之前已经完整下载过的直接跳过
+func fetchBlobOnce(c *Client, desc image.Descriptor, file string) error {
+	if image.VerifyDigest(file, desc.Digest) == nil {
+		return nil
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return c.FetchBlob(desc, file)
+}
+
+// writeBlob 把内容写入 OCI 镜像布局的 blobs 目录
+func writeBlob(dir string, digest string, content []byte) error {
+	file, err := image.BlobPath(dir, digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// readJSON 读取 JSON 文件
+func readJSON(file string, v interface{}) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// shortDigest 返回摘要去掉算法后的前 12 位，用于日志
+func shortDigest(digest string) string {
+	if len(digest) > 19 && digest[:7] == "sha256:" {
+		return digest[7:19]
+	}
+	return digest
+}
@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+)
+
+// Push 把 dir 目录中 OCI 镜像布局里 desc 指向的镜像推送到镜像仓库，标签为 tag，返回 manifest 的摘要
+// 仓库中已经有的镜像层和 config 不会重复上传
+func Push(c *Client, dir string, desc image.Descriptor, tag string) (string, error) {
+	manifestPath, err := image.BlobPath(dir, desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := image.VerifyDigest(manifestPath, desc.Digest); err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+	var manifest image.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return "", fmt.Errorf("解析 manifest %s 失败: %v", desc.Digest, err)
+	}
+
+	// 先上传镜像层再上传 config，manifest 引用的内容都上传完之后才能上传 manifest
+	for _, blob := range append(append([]image.Descriptor{}, manifest.Layers...), manifest.Config) {
+		exists, err := c.BlobExists(blob.Digest)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			logrus.Infof("%s 已存在，跳过上传", shortDigest(blob.Digest))
+			continue
+		}
+		file, err := image.BlobPath(dir, blob.Digest)
+		if err != nil {
+			return "", err
+		}
+		logrus.Infof("上传 %s (%d 字节)", shortDigest(blob.Digest), blob.Size)
+		if err := c.PushBlob(blob, file); err != nil {
+			return "", err
+		}
+	}
+
+	mediaType := manifest.MediaType
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	return c.PutManifest(tag, mediaType, content)
+}
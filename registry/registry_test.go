@@ -0,0 +1,349 @@
+package registry
+
+import (
+	"MiniDocker/image"
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeManifest 测试镜像仓库中保存的 manifest
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// fakeRegistry 在进程内实现 OCI distribution 规范的一个子集，用于测试
+// 支持 Bearer token 认证、manifest 和 blob 的上传下载、分块上传以及 Range 下载
+type fakeRegistry struct {
+	mu        sync.Mutex
+	server    *httptest.Server
+	blobs     map[string][]byte
+	manifests map[string]fakeManifest
+	uploads   map[string][]byte
+	nextID    int
+
+	password      string // 申请 token 时要求的密码
+	failPatches   int    // 接下来的几次 PATCH 在保存内容之后返回 500，模拟响应丢失
+	truncateGets  int    // 接下来的几次 blob 下载只返回一半内容就断开连接
+	rangeRequests int    // 收到的带 Range 的 blob 下载请求数
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string]fakeManifest{},
+		uploads:   map[string][]byte{},
+		password:  "secret",
+	}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// reference 返回测试镜像仓库中镜像的引用
+func (r *fakeRegistry) reference(t *testing.T, name string) *image.Reference {
+	ref, err := image.ParseReference(strings.TrimPrefix(r.server.URL, "http://") + "/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != r.password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if !strings.Contains(req.URL.Query().Get("scope"), "repository:") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-" + r.password})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer token-"+r.password {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(rest, "/manifests/"):
+		r.serveManifest(w, req, rest[strings.Index(rest, "/manifests/")+len("/manifests/"):])
+	case strings.Contains(rest, "/blobs/uploads/"):
+		r.serveUpload(w, req, rest[strings.Index(rest, "/blobs/uploads/")+len("/blobs/uploads/"):])
+	case strings.Contains(rest, "/blobs/"):
+		r.serveBlob(w, req, rest[strings.Index(rest, "/blobs/")+len("/blobs/"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, ref string) {
+	switch req.Method {
+	case http.MethodPut:
+		content, _ := ioutil.ReadAll(req.Body)
+		m := fakeManifest{mediaType: req.Header.Get("Content-Type"), content: content}
+		digest := digestBytes(content)
+		r.manifests[ref], r.manifests[digest] = m, m
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		m, ok := r.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestBytes(m.content))
+		w.Write(m.content)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	content, ok := r.blobs[digest]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		return
+	}
+	status := http.StatusOK
+	if rng := req.Header.Get("Range"); rng != "" {
+		r.rangeRequests++
+		start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		content, status = content[start:], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(status)
+	if r.truncateGets > 0 {
+		r.truncateGets--
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(content)
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	if req.Method == http.MethodPost {
+		r.nextID++
+		id = strconv.Itoa(r.nextID)
+		r.uploads[id] = []byte{}
+		w.Header().Set("Location", req.URL.Path+id)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	data, ok := r.uploads[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	setProgress := func() {
+		w.Header().Set("Location", req.URL.Path)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(r.uploads[id])-1))
+	}
+	switch req.Method {
+	case http.MethodGet:
+		setProgress()
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != len(data) || end-start+1 != len(body) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(data, body...)
+		if r.failPatches > 0 {
+			r.failPatches--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setProgress()
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data = append(data, body...)
+		digest := req.URL.Query().Get("digest")
+		if digestBytes(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors":[{"code":"DIGEST_INVALID","message":"digest mismatch"}]}`)
+			return
+		}
+		r.blobs[digest] = data
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// testLayer 生成一个包含 n 字节随机内容文件的 tar 包
+func testLayer(t *testing.T, name string, n int) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// 随机内容压缩后大小基本不变，保证镜像层需要分多块上传
+	content := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(content)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(n), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testLayout 在临时目录中生成一个两层的 OCI 镜像布局，第一层经过 gzip 压缩，返回目录、manifest 描述符和各层 diff_id
+func testLayout(t *testing.T) (string, image.Descriptor, []string) {
+	dir := t.TempDir()
+	layers := [][]byte{testLayer(t, "bin/sh", 3000), testLayer(t, "etc/hostname", 100)}
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(layers[0])
+	gw.Close()
+	blobs := []image.Descriptor{
+		{MediaType: image.MediaTypeOCILayerGzip, Digest: digestBytes(gz.Bytes()), Size: int64(gz.Len())},
+		{MediaType: image.MediaTypeOCILayer, Digest: digestBytes(layers[1]), Size: int64(len(layers[1]))},
+	}
+	for i, content := range [][]byte{gz.Bytes(), layers[1]} {
+		if err := writeBlob(dir, blobs[i].Digest, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diffIDs := []string{digestBytes(layers[0]), digestBytes(layers[1])}
+	config, _ := json.Marshal(image.ConfigFile{OS: runtime.GOOS, Architecture: runtime.GOARCH, RootFS: image.RootFS{Type: "layers", DiffIDs: diffIDs}})
+	configDesc := image.Descriptor{MediaType: image.MediaTypeOCIConfig, Digest: digestBytes(config), Size: int64(len(config))}
+	if err := writeBlob(dir, configDesc.Digest, config); err != nil {
+		t.Fatal(err)
+	}
+	manifest, _ := json.Marshal(image.Manifest{SchemaVersion: 2, MediaType: image.MediaTypeOCIManifest, Config: configDesc, Layers: blobs})
+	if err := writeBlob(dir, digestBytes(manifest), manifest); err != nil {
+		t.Fatal(err)
+	}
+	return dir, image.Descriptor{MediaType: image.MediaTypeOCIManifest, Digest: digestBytes(manifest), Size: int64(len(manifest))}, diffIDs
+}
+
+func TestPushAndPull(t *testing.T) {
+	oldChunkSize := chunkSize
+	chunkSize = 512
+	t.Cleanup(func() { chunkSize = oldChunkSize })
+
+	reg := newFakeRegistry(t)
+	dir, desc, diffIDs := testLayout(t)
+	opts := Options{Username: "user", Password: "secret", Push: true}
+
+	// 第二块上传后响应丢失，客户端应当查询进度后继续，而不是重复上传
+	reg.failPatches = 1
+	ref := reg.reference(t, "tools/app:v1")
+	digest, err := Push(NewClient(ref, opts), dir, desc, ref.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != desc.Digest {
+		t.Errorf("推送后的 manifest 摘要 = %s, 期望 %s", digest, desc.Digest)
+	}
+	if len(reg.blobs) != 3 {
+		t.Errorf("镜像仓库中有 %d 个 blob，期望 3 个", len(reg.blobs))
+	}
+	// 再次推送时所有 blob 都已存在
+	if _, err := Push(NewClient(ref, opts), dir, desc, "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if reg.nextID != 3 {
+		t.Errorf("再次推送时不应当重复上传 blob，共发起了 %d 次上传", reg.nextID)
+	}
+
+	// 多平台镜像的 manifest 列表，其他平台排在前面
+	list, _ := json.Marshal(image.Index{SchemaVersion: 2, MediaType: image.MediaTypeOCIIndex, Manifests: []image.Descriptor{
+		{MediaType: image.MediaTypeOCIManifest, Digest: digestBytes([]byte("other")), Size: 5, Platform: &image.Platform{OS: "windows", Architecture: "arm"}},
+		{MediaType: image.MediaTypeOCIManifest, Digest: desc.Digest, Size: desc.Size, Platform: &image.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}},
+	}})
+	reg.manifests["multi"] = fakeManifest{mediaType: image.MediaTypeOCIIndex, content: list}
+
+	// 第一次下载镜像层时连接中断，客户端应当通过 Range 请求继续下载
+	reg.truncateGets = 1
+	pullDir := t.TempDir()
+	pullRef := reg.reference(t, "tools/app:multi")
+	if err := Pull(NewClient(pullRef, Options{Username: "user", Password: "secret"}), pullRef, pullDir); err != nil {
+		t.Fatal(err)
+	}
+	if reg.rangeRequests == 0 {
+		t.Error("下载中断后应当从断点继续")
+	}
+	sources, err := image.ReadOCILayout(pullDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := sources[0]
+	if src.RepoDigest != desc.Digest || len(src.Names) != 1 || src.Names[0] != pullRef.String() {
+		t.Errorf("拉取的镜像信息错误: names = %v, repoDigest = %s", src.Names, src.RepoDigest)
+	}
+	for i, layer := range src.Layers {
+		if layer.DiffID != diffIDs[i] {
+			t.Errorf("第 %d 层 diff_id = %s, 期望 %s", i, layer.DiffID, diffIDs[i])
+		}
+	}
+	if _, err := ioutil.ReadFile(path.Join(pullDir, "blobs", "sha256", strings.TrimPrefix(desc.Digest, "sha256:"))); err != nil {
+		t.Errorf("manifest 没有保存到镜像布局中: %v", err)
+	}
+}
+
+func TestPullErrors(t *testing.T) {
+	reg := newFakeRegistry(t)
+	dir, desc, _ := testLayout(t)
+	ref := reg.reference(t, "app:v1")
+	if _, err := Push(NewClient(ref, Options{Username: "user", Password: "secret", Push: true}), dir, desc, ref.Tag); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Pull(NewClient(ref, Options{Username: "user", Password: "wrong"}), ref, t.TempDir()); err == nil {
+		t.Error("密码错误时应当报错")
+	}
+	missing := reg.reference(t, "app:missing")
+	if err := Pull(NewClient(missing, Options{Username: "user", Password: "secret"}), missing, t.TempDir()); err == nil {
+		t.Error("拉取不存在的标签应当报错")
+	}
+	// 镜像仓库返回的内容被篡改时应当发现摘要不一致
+	for digest, content := range reg.blobs {
+		if digest != desc.Digest {
+			reg.blobs[digest] = append([]byte{}, content...)
+			reg.blobs[digest][0] ^= 0xff
+		}
+	}
+	if err := Pull(NewClient(ref, Options{Username: "user", Password: "secret"}), ref, t.TempDir()); err == nil {
+		t.Error("blob 内容被篡改时应当报错")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/busybox:pull"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.docker.io/token" || params["service"] != "registry.docker.io" || params["scope"] != "repository:library/busybox:pull" {
+		t.Errorf("解析结果错误: %s %v", scheme, params)
+	}
+}
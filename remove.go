@@ -1,24 +1,38 @@
 package main
 
 import (
+	"MiniDocker/cgroup"
 	"MiniDocker/container"
+	"MiniDocker/network"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
 )
 
-func removeContainer(containerName string) {
-	// 根据容器名称获取容器信息
-	containerInfo, err := getContainerInfoByName(containerName)
+// removeContainer 删除已经停止或退出的容器，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+func removeContainer(containerRef string) {
+	// 根据容器名称或 ID 获取容器信息
+	containerInfo, err := resolveContainer(containerRef)
 	if err != nil {
 		logrus.Errorf("获取容器信息失败: %v", err)
 		return
 	}
-	// 只删除处于停止状态的容器
-	if containerInfo.Status != container.STOPPED {
+	containerName := containerInfo.Name
+	// 只删除已经停止或退出的容器
+	if containerInfo.Status != container.STOPPED && containerInfo.Status != container.EXIT {
 		logrus.Errorf("容器 %s 处于运行状态，无法删除", containerName)
 		return
 	}
+	// 删除容器的 cgroup
+	if containerInfo.CgroupPath != "" {
+		cgroup.NewCgroupManager(containerInfo.CgroupPath).Destroy()
+	}
+	// 容器退出时已经断开了网络，这里清理 shim 没有来得及断开的网络，避免 IP 地址和 iptables 规则泄漏
+	if len(containerInfo.Networks) > 0 {
+		if err := network.Disconnect(containerInfo); err != nil {
+			logrus.Warnf("断开容器 %s 的网络失败: %v", containerName, err)
+		}
+	}
 	// 删除存储容器信息的目录
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
 	if err := os.RemoveAll(dirURL); err != nil {
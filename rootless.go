@@ -0,0 +1,79 @@
+package main
+
+import (
+	"MiniDocker/cgroup/subsystems"
+	"MiniDocker/container"
+	"MiniDocker/image"
+	"MiniDocker/network"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// rootlessDirName rootless 模式下 MiniDocker 在 $XDG_RUNTIME_DIR 和 $XDG_DATA_HOME 中使用的子目录名
+const rootlessDirName = "MiniDocker"
+
+// setupRootless 以普通用户运行时（rootless 模式）把所有状态换到当前用户可写的位置：
+// 容器信息、挂载点和写层等运行时状态放在 $XDG_RUNTIME_DIR/MiniDocker 下，代替 /var/run/MiniDocker 和 /root；
+// 镜像和镜像层放在 $XDG_DATA_HOME/MiniDocker（默认为 ~/.local/share/MiniDocker）下，代替 /var/lib/MiniDocker
+func setupRootless() error {
+	if !container.Rootless() {
+		return nil
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return fmt.Errorf("rootless 模式需要设置 XDG_RUNTIME_DIR 环境变量，用于保存容器的运行时状态")
+	}
+	dataDir := os.Getenv("XDG_DATA_HOME")
+	if dataDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("rootless 模式需要设置 XDG_DATA_HOME 或 HOME 环境变量，用于保存镜像: %v", err)
+		}
+		dataDir = filepath.Join(home, ".local", "share")
+	}
+
+	stateRoot := filepath.Join(runtimeDir, rootlessDirName)
+	container.DefaultInfoLocation = filepath.Join(stateRoot, "containers") + "/%s/"
+	container.RootURL = filepath.Join(stateRoot, "root")
+	container.MntURL = filepath.Join(container.RootURL, "mnt") + "/%s"
+	container.WriteLayerURL = filepath.Join(container.RootURL, "writeLayer") + "/%s"
+
+	imageRoot := filepath.Join(dataDir, rootlessDirName)
+	image.SetRoot(imageRoot)
+	pullCachePath = filepath.Join(imageRoot, "image", "downloads")
+	return nil
+}
+
+// checkRootlessConfig 检查 rootless 模式下不支持的运行参数
+// 普通用户不能修改 cgroup、创建网桥和 iptables 规则，也不能使用 /etc/subuid 中的范围（需要 newuidmap）
+func checkRootlessConfig(cfg *runConfig) error {
+	if !container.Rootless() {
+		return nil
+	}
+	if cfg.Resource != nil && !reflect.DeepEqual(*cfg.Resource, subsystems.ResourceConfig{}) {
+		return fmt.Errorf("rootless 模式下容器不使用 cgroup，不支持资源限制")
+	}
+	if cfg.Network != "" && cfg.Network != network.SlirpNetwork {
+		return fmt.Errorf("rootless 模式不支持网络 %s，只能不接入网络或者使用 --net %s", cfg.Network, network.SlirpNetwork)
+	}
+	if len(cfg.PortMapping) > 0 {
+		return fmt.Errorf("rootless 模式不支持端口映射")
+	}
+	if cfg.UserNamespace != nil {
+		return fmt.Errorf("rootless 模式不支持 --userns-remap，容器总是运行在只映射了当前用户的用户命名空间中")
+	}
+	return nil
+}
+
+// requireRoot 返回 command 命令的 Before 钩子，rootless 模式下直接报错，reason 说明为什么需要 root 权限
+func requireRoot(command string, reason string) cli.BeforeFunc {
+	return func(*cli.Context) error {
+		if container.Rootless() {
+			return fmt.Errorf("rootless 模式不支持 %s 命令: %s", command, reason)
+		}
+		return nil
+	}
+}
@@ -4,130 +4,328 @@ import (
 	"MiniDocker/cgroup"
 	"MiniDocker/cgroup/subsystems"
 	"MiniDocker/container"
+	"MiniDocker/image"
 	"MiniDocker/network"
-	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"math/rand"
 	"os"
-	"path"
+	"os/exec"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Run 启动一个容器实例
-// tty 表示是否绑定终端（类似 docker run -it）
-// commandArray 是用户希望在容器中执行的命令及参数
-// volume 是宿主机与容器的挂载路径
-func Run(tty bool, commandArray []string, volume string, res *subsystems.ResourceConfig, containerName string, imageName string, envSlice []string, nw string, portmapping []string) {
-	containerID := randStringBytes(10)
-	if containerName == "" {
-		containerName = containerID
-	}
-	// 创建容器父进程和通信管道
-	parent, writePipe := container.NewParentProcess(tty, volume, containerName, imageName, envSlice)
-	if parent == nil {
-		logrus.Error("父进程创建失败")
-		return
+// runConfig 记录 run 命令的全部参数
+// 后台运行的容器由 shim 进程负责启动，这些参数会序列化后通过管道传给 shim
+type runConfig struct {
+	Tty           bool                       `json:"tty"`           // 是否绑定终端
+	CommandArray  []string                   `json:"commandArray"`  // 容器中执行的命令及参数
+	Volume        string                     `json:"volume"`        // 数据卷，格式为 /宿主机路径:/容器路径
+	Resource      *subsystems.ResourceConfig `json:"resource"`      // 资源限制
+	ContainerID   string                     `json:"containerId"`   // 容器 ID
+	ContainerName string                     `json:"containerName"` // 容器名
+	ImageName     string                     `json:"imageName"`     // 镜像名
+	EnvSlice      []string                   `json:"envSlice"`      // 环境变量
+	Entrypoint    []string                   `json:"entrypoint"`    // --entrypoint 指定的入口程序，nil 表示使用镜像的 Entrypoint
+	WorkingDir    string                     `json:"workingDir"`    // 工作目录
+	User          string                     `json:"user"`          // 运行用户
+	Network       string                     `json:"network"`       // 容器连接的网络
+	PortMapping   []string                   `json:"portMapping"`   // 端口映射
+	UserNamespace *container.UserNamespace   `json:"userNamespace"` // 用户命名空间的 uid/gid 映射，nil 表示不启用
+	// cgroup 命名空间模式，host 或 private
+	CgroupNamespace string `json:"cgroupNamespace"`
+	// 时间命名空间中的时钟偏移量，nil 表示不启用时间命名空间
+	TimeOffsets *container.TimeOffsets `json:"timeOffsets"`
+}
+
+// Run 启动一个容器实例，cfg 为 run 命令的参数
+// cfg.Tty 表示是否绑定终端（类似 docker run -it），cfg.CommandArray 是用户希望在容器中执行的命令及参数，
+// 为空时执行镜像的默认命令
+// 前台运行时由当前进程等待容器退出并清理现场，后台运行时交给 shim 进程负责
+func Run(cfg *runConfig) error {
+	cfg.ContainerID = randStringBytes(10)
+	if cfg.ContainerName == "" {
+		cfg.ContainerName = cfg.ContainerID
+	}
+	// 在创建任何资源之前检查容器名，避免覆盖已有容器的信息和工作空间
+	if err := checkContainerName(cfg.ContainerName); err != nil {
+		return err
+	}
+	if err := checkRootlessConfig(cfg); err != nil {
+		return err
+	}
+	if cfg.Network == network.SlirpNetwork && len(cfg.PortMapping) > 0 {
+		return fmt.Errorf("%s 网络不支持端口映射", network.SlirpNetwork)
+	}
+	// cgroup v1 的文件系统不能在用户命名空间中挂载，只有 cgroup v2 才能在用户命名空间中挂载容器自己的 cgroup
+	if cfg.CgroupNamespace == container.CgroupNamespacePrivate && (container.Rootless() || cfg.UserNamespace != nil) &&
+		!subsystems.IsCgroup2UnifiedMode() {
+		return fmt.Errorf("宿主机使用 cgroup v1，运行在用户命名空间中的容器不支持 --cgroupns %s", container.CgroupNamespacePrivate)
+	}
+	// 镜像的默认配置与 run 命令的参数合并后，得到容器最终执行的命令、环境变量、工作目录和用户
+	imageConfig := &image.ContainerConfig{}
+	if img, err := image.Get(cfg.ImageName); err == nil {
+		config, err := img.Config()
+		if err != nil {
+			return fmt.Errorf("读取镜像 %s 的 config 失败: %v", cfg.ImageName, err)
+		}
+		imageConfig = &config.Config
+	}
+	if err := applyImageConfig(cfg, imageConfig); err != nil {
+		return err
+	}
+	if !cfg.Tty {
+		return startShim(cfg)
+	}
+
+	parent, cgroupManager, err := startContainer(cfg)
+	if err != nil {
+		return err
+	}
+	// 前台模式，等待容器退出
+	waitContainer(cfg, parent, cgroupManager)
+	return nil
+}
+
+// defaultPathEnv 镜像和用户都没有设置 PATH 时使用的默认值，与 docker 一致
+const defaultPathEnv = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// applyImageConfig 按 docker 的规则把镜像的默认配置合并到 run 命令的参数中：
+// 指定了 --entrypoint 时替换镜像的 Entrypoint，同时不再使用镜像的 Cmd；run 命令中给出的命令替换 Cmd，
+// 最终执行 Entrypoint + Cmd。环境变量以镜像中的为基础，-e 指定的同名变量覆盖镜像中的值，
+// 只写变量名的 -e 从宿主机取值。-w 和 -u 没有指定时使用镜像中的工作目录和用户
+func applyImageConfig(cfg *runConfig, config *image.ContainerConfig) error {
+	entrypoint, cmd := config.Entrypoint, config.Cmd
+	if cfg.Entrypoint != nil {
+		entrypoint, cmd = cfg.Entrypoint, nil
+	}
+	if len(cfg.CommandArray) > 0 {
+		cmd = cfg.CommandArray
+	}
+	commandArray := append(append([]string{}, entrypoint...), cmd...)
+	if len(commandArray) == 0 {
+		return fmt.Errorf("没有指定要执行的命令，镜像 %s 也没有默认命令", cfg.ImageName)
+	}
+	cfg.CommandArray = commandArray
+
+	env := []string{defaultPathEnv}
+	if cfg.Tty {
+		env = append(env, "TERM=xterm")
+	}
+	var userEnv []string
+	for _, e := range cfg.EnvSlice {
+		if !strings.Contains(e, "=") {
+			value, ok := os.LookupEnv(e)
+			if !ok {
+				continue
+			}
+			e = e + "=" + value
+		}
+		userEnv = append(userEnv, e)
+	}
+	cfg.EnvSlice = mergeEnv(mergeEnv(env, config.Env), userEnv)
+
+	if cfg.WorkingDir == "" {
+		cfg.WorkingDir = config.WorkingDir
+	}
+	if cfg.User == "" {
+		cfg.User = config.User
+	}
+	return nil
+}
+
+// startContainer 创建容器进程、记录容器信息、设置 cgroup 和网络，然后把用户命令发送给 init 进程，
+// 等到 init 进程报告用户命令已经开始执行后返回
+// 返回容器的 init 进程以及它的 cgroup 管理器，调用者负责等待容器退出。
+// 任何一步失败都会终止 init 进程，清理 cgroup、网络、容器信息和工作空间
+func startContainer(cfg *runConfig) (*exec.Cmd, *cgroup.CgroupManager, error) {
+	containerName := cfg.ContainerName
+	// rootless 模式下只能在映射了当前用户的用户命名空间中创建其他命名空间
+	if container.Rootless() {
+		cfg.UserNamespace = container.RootlessUserNamespace()
+	}
+	// 每个容器使用独立的 cgroup，路径记录在容器信息中，供 stop/rm 清理
+	cgroupPath := fmt.Sprintf(container.CgroupPathFormat, cfg.ContainerID)
+	// 容器退出后由等待它的进程（前台为当前进程，后台为 shim）删除 cgroup
+	cgroupManager := cgroup.NewCgroupManager(cgroupPath)
+	var (
+		parent *exec.Cmd
+		pipes  *container.InitPipes
+		info   *container.Info
+	)
+	fail := func(err error) (*exec.Cmd, *cgroup.CgroupManager, error) {
+		// init 进程可能还没有启动，可能还在等待用户命令，也可能已经因为出错退出，启动了就直接终止它并清理现场
+		if parent != nil && parent.Process != nil {
+			parent.Process.Kill()
+			parent.Wait()
+		}
+		if pipes != nil {
+			pipes.Close()
+		}
+		cgroupManager.Destroy()
+		if info != nil && len(info.Networks) > 0 {
+			if err := network.Disconnect(info); err != nil {
+				logrus.Errorf("断开容器 %s 的网络失败: %v", containerName, err)
+			}
+		}
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(cfg.Volume, containerName)
+		return nil, nil, err
+	}
+
+	// 创建容器父进程和通信管道，工作空间（overlay 根文件系统和数据卷）在这里挂载，失败时直接报错，不会在空的根文件系统上启动容器
+	var err error
+	parent, pipes, err = container.NewParentProcess(cfg.Tty, cfg.Volume, containerName, cfg.ImageName, cfg.UserNamespace)
+	if err != nil {
+		return fail(fmt.Errorf("创建容器进程失败: %v", err))
 	}
 	// 启动父进程（fork 自身，进入 init 子流程）
-	if err := parent.Start(); err != nil {
-		logrus.Error(err)
-		return
+	if err := container.StartParentProcess(parent, cfg.UserNamespace); err != nil {
+		return fail(fmt.Errorf("启动容器进程失败: %v", err))
 	}
+	pipes.CloseChildFiles()
 
 	// 记录容器基本信息
-	containerName, err := recordContainerInfo(parent.Process.Pid, commandArray, containerName, containerID, volume)
+	info, err = recordContainerInfo(parent.Process.Pid, cfg, cgroupPath)
 	if err != nil {
-		logrus.Error("容器信息记录失败", err)
-		return
+		return fail(fmt.Errorf("容器信息记录失败: %v", err))
 	}
 
-	// 创建并配置 Cgroup 管理器
-	cgroupManager := cgroup.NewCgroupManager("MiniDocker-Cgroup")
-	defer cgroupManager.Destroy() // 确保退出时清理资源
-	// 设置 Cgroup 资源限制
-	cgroupManager.Set(res)
-	// 将容器进程加入 Cgroup
-	cgroupManager.Apply(parent.Process.Pid)
+	// 设置 Cgroup 资源限制，并将容器进程加入 Cgroup，rootless 模式下普通用户没有权限修改 cgroup，跳过
+	if !container.Rootless() {
+		err = cgroupManager.Set(cfg.Resource)
+		if err == nil {
+			err = cgroupManager.Apply(parent.Process.Pid)
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
 
-	if nw != "" {
+	if cfg.Network == network.SlirpNetwork {
+		// 用户态网络不需要网桥和 IP 地址分配，rootless 模式下也可以使用
+		if err := network.ConnectSlirp(info); err != nil {
+			return fail(fmt.Errorf("网络连接失败: %v", err))
+		}
+		if err := updateContainerInfo(info); err != nil {
+			logrus.Errorf("记录容器 %s 的网络信息失败: %v", containerName, err)
+		}
+	} else if cfg.Network != "" {
 		// 初始化网络配置
 		network.Init()
-		// 配置容器网络
-		containerInfo := &container.Info{
-			Id:          containerID,
-			Pid:         strconv.Itoa(parent.Process.Pid),
-			Name:        containerName,
-			PortMapping: portmapping,
+		// 配置容器网络，分配到的 IP 等端点信息会记录到容器信息中
+		if err := network.Connect(cfg.Network, info); err != nil {
+			return fail(fmt.Errorf("网络连接失败: %v", err))
 		}
-		if err := network.Connect(nw, containerInfo); err != nil {
-			logrus.Error("网络连接失败", err)
-			return
+		if err := updateContainerInfo(info); err != nil {
+			logrus.Errorf("记录容器 %s 的网络信息失败: %v", containerName, err)
 		}
 	}
 
-	// 发送用户命令给 init 进程执行
-	sendInitCommand(commandArray, writePipe)
-
-	if tty {
-		// 前台模式，等待容器退出
-		parent.Wait()
-		deleteContainerInfo(containerName)
-		container.DeleteWorkSpace(volume, containerName) // 删除容器工作空间
+	// 发送用户命令给 init 进程执行，等待它报告执行结果
+	if err := sendInitCommand(cfg, pipes); err != nil {
+		return fail(err)
+	}
+	if err := pipes.WaitExec(); err != nil {
+		return fail(err)
 	}
+	return parent, cgroupManager, nil
+}
+
+// waitContainer 等待容器的 init 进程退出，记录退出状态并清理 cgroup 和工作空间
+// 容器信息会保留下来供 ps/inspect 查看，由 rm 删除
+func waitContainer(cfg *runConfig, parent *exec.Cmd, cgroupManager *cgroup.CgroupManager) {
+	// 退出码非 0 时 Wait 也会返回错误，退出状态统一从 ProcessState 中读取
+	parent.Wait()
+	recordContainerExit(cfg.ContainerName, parent.ProcessState, cgroupManager)
+	cgroupManager.Destroy()
+	container.DeleteWorkSpace(cfg.Volume, cfg.ContainerName) // 删除容器工作空间
 }
 
-// sendInitCommand 将用户命令写入管道，传递给子进程（init 进程）
-func sendInitCommand(commandArray []string, writePipe *os.File) {
-	command := strings.Join(commandArray, " ")
-	logrus.Infof("用户传入的命令：%s", command)
+// sendInitCommand 将用户命令、环境变量、工作目录、用户、主机名和挂载信息写入管道，传递给子进程（init 进程）
+// 主机名与 docker 一致，默认为容器 ID。rootless 模式下根文件系统和数据卷也由 init 进程挂载
+func sendInitCommand(cfg *runConfig, pipes *container.InitPipes) error {
+	logrus.Infof("用户传入的命令：%q", cfg.CommandArray)
+	logrus.Infof("传递给容器的环境变量: %v", cfg.EnvSlice)
 
-	writePipe.WriteString(command)
-	writePipe.Close()
+	rootfs, err := container.RootfsMount(cfg.ImageName, cfg.ContainerName)
+	if err != nil {
+		return fmt.Errorf("准备镜像 %s 的只读层失败: %v", cfg.ImageName, err)
+	}
+	mounts := container.DefaultMounts()
+	cgroupns := cfg.CgroupNamespace == container.CgroupNamespacePrivate
+	if cgroupns {
+		cgroupMounts, err := container.CgroupMounts()
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, cgroupMounts...)
+	}
+	err = pipes.SendConfig(&container.InitConfig{
+		Args:            cfg.CommandArray,
+		Env:             cfg.EnvSlice,
+		Cwd:             cfg.WorkingDir,
+		User:            cfg.User,
+		Hostname:        cfg.ContainerID,
+		Mounts:          append(mounts, container.VolumeMounts(cfg.Volume)...),
+		Rootfs:          rootfs,
+		CgroupNamespace: cgroupns,
+		TimeOffsets:     cfg.TimeOffsets,
+	})
+	if err != nil {
+		return fmt.Errorf("发送用户命令失败: %v", err)
+	}
+	return nil
 }
 
-// recordContainerInfo 保存容器信息到本地
-func recordContainerInfo(containerPID int, commandAry []string, containerName string, id string, volume string) (string, error) {
+// recordContainerInfo 保存容器信息到本地，包括完整的运行参数
+func recordContainerInfo(containerPID int, cfg *runConfig, cgroupPath string) (*container.Info, error) {
 	currentTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandAry, "")
+	command := strings.Join(cfg.CommandArray, " ")
 
 	containerInfo := &container.Info{
-		Id:          id,
-		Pid:         strconv.Itoa(containerPID),
-		Command:     command,
-		CreatedTime: currentTime,
-		Status:      container.RUNNING,
-		Name:        containerName,
-		Volume:      volume,
+		Id:              cfg.ContainerID,
+		Pid:             strconv.Itoa(containerPID),
+		Command:         command,
+		Args:            cfg.CommandArray,
+		Image:           cfg.ImageName,
+		Env:             cfg.EnvSlice,
+		WorkingDir:      cfg.WorkingDir,
+		User:            cfg.User,
+		Tty:             cfg.Tty,
+		CreatedTime:     currentTime,
+		Status:          container.RUNNING,
+		Name:            cfg.ContainerName,
+		Rootfs:          fmt.Sprintf(container.MntURL, cfg.ContainerName),
+		Volume:          cfg.Volume,
+		PortMapping:     cfg.PortMapping,
+		CgroupPath:      cgroupPath,
+		Resource:        cfg.Resource,
+		Mounts:          container.VolumeMountPoints(cfg.Volume),
+		UserNamespace:   cfg.UserNamespace,
+		CgroupNamespace: cfg.CgroupNamespace,
+		TimeOffsets:     cfg.TimeOffsets,
 	}
-
-	containerInfoJson, err := json.Marshal(containerInfo)
-	if err != nil {
-		logrus.Errorf("容器信息序列化失败: %v", err)
-		return "", err
+	// 工作空间创建时镜像已经登记到本地镜像索引中，记录镜像 ID 供 rmi 检查镜像是否被使用
+	if img, err := image.Get(cfg.ImageName); err == nil {
+		containerInfo.ImageID = img.ID
 	}
-
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	if err := os.MkdirAll(dirURL, 0622); err != nil {
-		logrus.Errorf("创建目录失败: %v", err)
-		return "", err
+	// 后台运行的容器由 shim 进程启动，当前进程就是 shim
+	if !cfg.Tty {
+		containerInfo.ShimPid = os.Getpid()
 	}
 
-	fileName := path.Join(dirURL, container.ConfigName)
-	file, err := os.Create(fileName)
-	if err != nil {
-		logrus.Errorf("创建文件失败: %v", err)
-		return "", err
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, cfg.ContainerName)
+	if err := os.MkdirAll(dirURL, 0755); err != nil {
+		logrus.Errorf("创建目录失败: %v", err)
+		return nil, err
 	}
-
-	if _, err := file.WriteString(string(containerInfoJson)); err != nil {
-		logrus.Errorf("写入容器信息失败: %v", err)
-		return "", err
+	if err := updateContainerInfo(containerInfo); err != nil {
+		logrus.Error(err)
+		return nil, err
 	}
-
-	return containerName, nil
+	return containerInfo, nil
 }
 
 // randStringBytes 生成指定长度的随机字符串（仅包含数字）
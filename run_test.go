@@ -0,0 +1,89 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"reflect"
+	"testing"
+)
+
+func TestApplyImageConfig(t *testing.T) {
+	imageConfig := &image.ContainerConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.25"},
+		WorkingDir: "/srv",
+		User:       "nginx",
+	}
+	cases := []struct {
+		name       string
+		cfg        runConfig
+		wantArgs   []string
+		wantEnv    []string
+		wantDir    string
+		wantUser   string
+		wantErrors bool
+	}{
+		{
+			name:     "使用镜像的默认配置",
+			cfg:      runConfig{},
+			wantArgs: []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"},
+			wantEnv:  []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.25"},
+			wantDir:  "/srv",
+			wantUser: "nginx",
+		},
+		{
+			name:     "命令替换 Cmd，-e 覆盖镜像的环境变量",
+			cfg:      runConfig{CommandArray: []string{"sh"}, EnvSlice: []string{"NGINX_VERSION=1.26", "DEBUG=1"}, WorkingDir: "/tmp", User: "root", Tty: true},
+			wantArgs: []string{"/docker-entrypoint.sh", "sh"},
+			wantEnv:  []string{"PATH=/usr/sbin:/usr/bin", "TERM=xterm", "NGINX_VERSION=1.26", "DEBUG=1"},
+			wantDir:  "/tmp",
+			wantUser: "root",
+		},
+		{
+			name:     "--entrypoint 替换 Entrypoint 并忽略镜像的 Cmd",
+			cfg:      runConfig{Entrypoint: []string{"/bin/sh"}},
+			wantArgs: []string{"/bin/sh"},
+			wantEnv:  []string{"PATH=/usr/sbin:/usr/bin", "NGINX_VERSION=1.25"},
+			wantDir:  "/srv",
+			wantUser: "nginx",
+		},
+		{
+			name:       "--entrypoint 为空且没有命令",
+			cfg:        runConfig{Entrypoint: []string{}},
+			wantErrors: true,
+		},
+	}
+	for _, c := range cases {
+		cfg := c.cfg
+		err := applyImageConfig(&cfg, imageConfig)
+		if c.wantErrors {
+			if err == nil {
+				t.Errorf("%s: 期望报错", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.CommandArray, c.wantArgs) {
+			t.Errorf("%s: 命令为 %q，期望 %q", c.name, cfg.CommandArray, c.wantArgs)
+		}
+		if !reflect.DeepEqual(cfg.EnvSlice, c.wantEnv) {
+			t.Errorf("%s: 环境变量为 %q，期望 %q", c.name, cfg.EnvSlice, c.wantEnv)
+		}
+		if cfg.WorkingDir != c.wantDir || cfg.User != c.wantUser {
+			t.Errorf("%s: 工作目录为 %q、用户为 %q，期望 %q、%q", c.name, cfg.WorkingDir, cfg.User, c.wantDir, c.wantUser)
+		}
+	}
+}
+
+func TestApplyImageConfigDefaultPath(t *testing.T) {
+	cfg := runConfig{CommandArray: []string{"sh"}}
+	if err := applyImageConfig(&cfg, &image.ContainerConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{defaultPathEnv}; !reflect.DeepEqual(cfg.EnvSlice, want) {
+		t.Errorf("环境变量为 %q，期望 %q", cfg.EnvSlice, want)
+	}
+}
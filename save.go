@@ -0,0 +1,62 @@
+package main
+
+import (
+	"MiniDocker/image"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+)
+
+// saveImages 把镜像导出为 OCI 镜像布局的 tar 包，refs 可以是镜像名、镜像名:标签或镜像 ID
+// format 为 docker 时额外写入 docker save 格式的 manifest.json；output 为空时写到标准输出
+func saveImages(refs []string, output string, format string) error {
+	var dockerManifest bool
+	switch format {
+	case "", "oci":
+	case "docker":
+		dockerManifest = true
+	default:
+		return fmt.Errorf("不支持的导出格式 %s，可选 oci 或 docker", format)
+	}
+
+	var images []*image.Image
+	for _, ref := range refs {
+		img, err := image.Get(ref)
+		if err != nil {
+			return err
+		}
+		images = append(images, img)
+	}
+
+	if output == "" {
+		if stat, err := os.Stdout.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("不能把 tar 包写到终端，请通过 -o 指定文件或重定向标准输出")
+		}
+		return writeImages(images, os.Stdout, dockerManifest)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return fmt.Errorf("创建文件 %s 失败: %v", output, err)
+	}
+	err = writeImages(images, f, dockerManifest)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+		return err
+	}
+	logrus.Infof("镜像 %s 已导出到 %s", strings.Join(refs, ", "), output)
+	return nil
+}
+
+// writeImages 把镜像写成 tar 包
+func writeImages(images []*image.Image, w io.Writer, dockerManifest bool) error {
+	if err := image.Save(images, w, dockerManifest); err != nil {
+		return fmt.Errorf("导出镜像失败: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// shim 进程与 run 命令之间的状态约定
+// shim 启动容器成功后写入 shimStatusOK，失败时写入 shimStatusErrorPrefix 加错误信息
+const (
+	shimStatusOK          = "ok"
+	shimStatusErrorPrefix = "error: "
+	shimLogFile           = "shim.log" // shim 进程的日志文件，与容器日志放在同一目录下
+)
+
+// startShim 为后台运行的容器启动一个常驻的 shim 进程
+// shim 负责创建并等待容器的 init 进程，容器退出后记录退出状态并清理 cgroup 和工作空间。
+// 当前进程把运行参数通过管道发给 shim，等 shim 报告容器启动成功或失败后返回
+func startShim(cfg *runConfig) error {
+	cfgJson, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("运行参数序列化失败: %v", err)
+	}
+	// configRead/configWrite 用于传递运行参数，statusRead/statusWrite 用于 shim 报告启动结果
+	configRead, configWrite, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("管道创建失败: %v", err)
+	}
+	defer configWrite.Close()
+	statusRead, statusWrite, err := os.Pipe()
+	if err != nil {
+		configRead.Close()
+		return fmt.Errorf("管道创建失败: %v", err)
+	}
+	defer statusRead.Close()
+
+	// shim 的日志写入容器信息目录，当前进程退出后仍然可以查看
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, cfg.ContainerName)
+	if err := os.MkdirAll(dirURL, 0755); err != nil {
+		return fmt.Errorf("创建目录 %s 失败: %v", dirURL, err)
+	}
+	shimLogPath := dirURL + shimLogFile
+	logFile, err := os.Create(shimLogPath)
+	if err != nil {
+		return fmt.Errorf("创建 shim 日志文件 %s 失败: %v", shimLogPath, err)
+	}
+
+	cmd := exec.Command("/proc/self/exe", "shim")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// fd3 为运行参数管道的读端，fd4 为状态管道的写端
+	cmd.ExtraFiles = []*os.File{configRead, statusWrite}
+	// 创建新的会话，脱离当前终端，当前进程退出后 shim 继续运行
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	// 交给 shim 的文件在当前进程中不再需要，必须关闭，否则读状态管道时收不到 EOF
+	configRead.Close()
+	statusWrite.Close()
+	logFile.Close()
+	if err != nil {
+		return fmt.Errorf("启动 shim 进程失败: %v", err)
+	}
+
+	if _, err := configWrite.Write(cfgJson); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("发送运行参数给 shim 失败: %v", err)
+	}
+	configWrite.Close()
+
+	// 读取 shim 报告的启动结果，shim 写完后会关闭状态管道
+	statusBytes, err := ioutil.ReadAll(statusRead)
+	if err != nil {
+		return fmt.Errorf("读取 shim 启动结果失败: %v", err)
+	}
+	status := strings.TrimSpace(string(statusBytes))
+	if status == shimStatusOK {
+		logrus.Infof("容器 %s 已在后台运行，ID: %s", cfg.ContainerName, cfg.ContainerID)
+		// shim 与容器同生命周期，当前进程不再等待它
+		return cmd.Process.Release()
+	}
+	// 启动失败时 shim 会自行退出，回收它避免留下僵尸进程
+	cmd.Wait()
+	if strings.HasPrefix(status, shimStatusErrorPrefix) {
+		return fmt.Errorf("%s", strings.TrimPrefix(status, shimStatusErrorPrefix))
+	}
+	return fmt.Errorf("shim 进程异常退出，详见 %s", shimLogPath)
+}
+
+// runShim 是 shim 进程的入口，由 run 命令通过 /proc/self/exe shim 启动
+// 它从 fd3 读取运行参数并启动容器，通过 fd4 报告启动结果，然后一直等到容器退出
+func runShim() error {
+	// 这两个管道是从父进程继承的，没有 close-on-exec 标记，
+	// 不设置的话会被容器 init 进程继承，run 命令就永远等不到状态管道的 EOF
+	syscall.CloseOnExec(3)
+	syscall.CloseOnExec(4)
+	configPipe := os.NewFile(uintptr(3), "config")
+	statusPipe := os.NewFile(uintptr(4), "status")
+
+	cfgJson, err := ioutil.ReadAll(configPipe)
+	configPipe.Close()
+	if err != nil {
+		return reportShimStatus(statusPipe, fmt.Errorf("读取运行参数失败: %v", err))
+	}
+	var cfg runConfig
+	if err := json.Unmarshal(cfgJson, &cfg); err != nil {
+		return reportShimStatus(statusPipe, fmt.Errorf("解析运行参数失败: %v", err))
+	}
+	logrus.Infof("shim 进程 %d 开始启动容器 %s", os.Getpid(), cfg.ContainerName)
+
+	parent, cgroupManager, err := startContainer(&cfg)
+	if err := reportShimStatus(statusPipe, err); err != nil {
+		return err
+	}
+
+	// 容器的 init 进程是 shim 的子进程，由 shim 回收并记录退出状态
+	waitContainer(&cfg, parent, cgroupManager)
+	logrus.Infof("容器 %s 已退出，shim 进程结束", cfg.ContainerName)
+	return nil
+}
+
+// reportShimStatus 把容器的启动结果写入状态管道并关闭它，返回原来的错误
+func reportShimStatus(statusPipe *os.File, err error) error {
+	defer statusPipe.Close()
+	status := shimStatusOK
+	if err != nil {
+		logrus.Errorf("启动容器失败: %v", err)
+		status = shimStatusErrorPrefix + err.Error()
+	}
+	if _, writeErr := statusPipe.WriteString(status); writeErr != nil {
+		logrus.Errorf("报告容器启动结果失败: %v", writeErr)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"MiniDocker/cgroup"
+	"MiniDocker/container"
+	"os/exec"
+	"testing"
+)
+
+func TestRecordContainerExit(t *testing.T) {
+	setInfoLocation(t)
+	cases := []struct {
+		name   string
+		script string
+		want   int
+	}{
+		{name: "exit3", script: "exit 3", want: 3},
+		{name: "killed", script: "kill -KILL $$", want: 137},
+	}
+	for _, c := range cases {
+		// shim 启动容器后记录的状态
+		saveContainerInfo(t, &container.Info{
+			Name:       c.name,
+			Pid:        "12345",
+			ShimPid:    12344,
+			Status:     container.RUNNING,
+			CgroupPath: "MiniDocker/test-record-exit-" + c.name,
+		})
+		cmd := exec.Command("sh", "-c", c.script)
+		cmd.Run()
+		// 容器的 cgroup 不存在时没有 OOM 事件可读，按没有被 OOM 杀死处理
+		recordContainerExit(c.name, cmd.ProcessState, cgroup.NewCgroupManager("MiniDocker/test-record-exit-"+c.name))
+
+		info, err := getContainerInfoByName(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Status != container.EXIT || info.Pid != "" || info.ExitCode != c.want || info.OOMKilled || info.FinishedAt == "" {
+			t.Errorf("%s: 记录的退出状态为 status=%s pid=%q exitCode=%d oomKilled=%v finishedAt=%q，期望 status=%s exitCode=%d",
+				c.name, info.Status, info.Pid, info.ExitCode, info.OOMKilled, info.FinishedAt, container.EXIT, c.want)
+		}
+	}
+
+	// 容器信息已经被删除时只记录日志，不会重新创建
+	recordContainerExit("missing", nil, cgroup.NewCgroupManager("MiniDocker/test-record-exit-missing"))
+	if _, err := getContainerInfoByName("missing"); err == nil {
+		t.Error("容器信息已经被删除时不应该重新创建")
+	}
+}
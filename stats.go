@@ -0,0 +1,191 @@
+package main
+
+import (
+	"MiniDocker/cgroup"
+	"MiniDocker/container"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// statsInterval 两次采样之间的间隔，CPU 使用率根据两次采样之间的 CPU 时间增量计算
+const statsInterval = time.Second
+
+// containerStats 一个容器在某一时刻的资源使用情况
+type containerStats struct {
+	ID            string  `json:"id"`            // 容器 ID
+	Name          string  `json:"name"`          // 容器名
+	CpuPercent    float64 `json:"cpuPercent"`    // CPU 使用率，100% 表示占满一个 CPU
+	MemoryUsage   uint64  `json:"memoryUsage"`   // 内存使用量（字节）
+	MemoryLimit   uint64  `json:"memoryLimit"`   // 内存上限（字节），没有限制时为宿主机内存总量
+	MemoryPercent float64 `json:"memoryPercent"` // 内存使用率
+	Pids          uint64  `json:"pids"`          // 进程数
+
+	cpuUsage   uint64    // 本次采样时累计使用的 CPU 时间（纳秒）
+	sampleTime time.Time // 本次采样的时间
+}
+
+// statsContainers 读取容器的资源使用情况并输出
+// containerNames 为空时统计所有运行中的容器；noStream 为 true 时只输出一次；jsonFormat 为 true 时以 JSON 格式输出
+func statsContainers(containerNames []string, noStream bool, jsonFormat bool) error {
+	infos, err := getStatsTargets(containerNames)
+	if err != nil {
+		return err
+	}
+
+	// 第一次采样只作为计算 CPU 使用率的基准
+	previous := sampleContainerStats(infos, nil)
+	for {
+		time.Sleep(statsInterval)
+		current := sampleContainerStats(infos, previous)
+		if jsonFormat {
+			if err := printStatsJSON(current); err != nil {
+				return err
+			}
+		} else {
+			if !noStream {
+				// 清屏并把光标移动到左上角，实现类似 docker stats 的刷新效果
+				fmt.Fprint(os.Stdout, "\033[2J\033[H")
+			}
+			if err := printStatsTable(current); err != nil {
+				return err
+			}
+		}
+		if noStream {
+			return nil
+		}
+		previous = current
+	}
+}
+
+// getStatsTargets 获取需要统计的容器，未指定容器时返回所有运行中的容器
+func getStatsTargets(containerNames []string) ([]*container.Info, error) {
+	var infos []*container.Info
+	if len(containerNames) == 0 {
+		containers, err := getAllContainerInfos()
+		if err != nil {
+			return nil, fmt.Errorf("读取容器信息失败: %v", err)
+		}
+		for _, c := range containers {
+			if c.Status == container.RUNNING && c.CgroupPath != "" {
+				infos = append(infos, c)
+			}
+		}
+		return infos, nil
+	}
+	for _, name := range containerNames {
+		info, err := resolveContainer(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.CgroupPath == "" {
+			return nil, fmt.Errorf("容器 %s 没有记录 cgroup 路径", name)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// sampleContainerStats 对每个容器的 cgroup 采样一次，previous 为上一次的采样结果，用于计算 CPU 使用率
+// 读取失败的容器（例如已经退出）会被跳过
+func sampleContainerStats(infos []*container.Info, previous map[string]*containerStats) map[string]*containerStats {
+	hostMemory := getHostMemory()
+	current := map[string]*containerStats{}
+	for _, info := range infos {
+		stats, err := cgroup.NewCgroupManager(info.CgroupPath).GetStats()
+		if err != nil {
+			logrus.Debugf("读取容器 %s 的资源使用情况失败: %v", info.Name, err)
+			continue
+		}
+		s := &containerStats{
+			ID:          info.Id,
+			Name:        info.Name,
+			MemoryUsage: stats.MemoryUsage,
+			MemoryLimit: stats.MemoryLimit,
+			Pids:        stats.PidsCurrent,
+			cpuUsage:    stats.CpuUsage,
+			sampleTime:  time.Now(),
+		}
+		if s.MemoryLimit == 0 || (hostMemory > 0 && s.MemoryLimit > hostMemory) {
+			s.MemoryLimit = hostMemory
+		}
+		if s.MemoryLimit > 0 {
+			s.MemoryPercent = float64(s.MemoryUsage) / float64(s.MemoryLimit) * 100
+		}
+		if prev, ok := previous[info.Id]; ok && s.cpuUsage >= prev.cpuUsage {
+			elapsed := s.sampleTime.Sub(prev.sampleTime)
+			if elapsed > 0 {
+				s.CpuPercent = float64(s.cpuUsage-prev.cpuUsage) / float64(elapsed.Nanoseconds()) * 100
+			}
+		}
+		current[info.Id] = s
+	}
+	return current
+}
+
+// printStatsTable 以表格形式输出容器的资源使用情况
+func printStatsTable(current map[string]*containerStats) error {
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tPIDS\n")
+	for _, s := range sortedStats(current) {
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%d\n",
+			s.ID,
+			s.Name,
+			s.CpuPercent,
+			formatBytes(s.MemoryUsage),
+			formatBytes(s.MemoryLimit),
+			s.MemoryPercent,
+			s.Pids,
+		)
+	}
+	return w.Flush()
+}
+
+// printStatsJSON 以 JSON 数组的形式输出容器的资源使用情况，每次采样输出一行
+func printStatsJSON(current map[string]*containerStats) error {
+	statsJson, err := json.Marshal(sortedStats(current))
+	if err != nil {
+		return fmt.Errorf("资源使用情况序列化失败: %v", err)
+	}
+	fmt.Fprintln(os.Stdout, string(statsJson))
+	return nil
+}
+
+// sortedStats 按容器名排序，保证每次刷新时行的顺序不变
+func sortedStats(current map[string]*containerStats) []*containerStats {
+	list := make([]*containerStats, 0, len(current))
+	for _, s := range current {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// getHostMemory 获取宿主机的内存总量，容器没有内存限制时用它作为上限
+func getHostMemory() uint64 {
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err != nil {
+		return 0
+	}
+	return uint64(info.Totalram) * uint64(info.Unit)
+}
+
+// formatBytes 将字节数格式化为便于阅读的字符串，例如 1.5MiB
+func formatBytes(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", size, units[i])
+	}
+	return fmt.Sprintf("%.2f%s", value, units[i])
+}
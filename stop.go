@@ -1,68 +1,177 @@
 package main
 
 import (
+	"MiniDocker/cgroup"
 	"MiniDocker/container"
-	"encoding/json"
+	"bytes"
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"io/ioutil"
-	"os"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
-// stopContainer 函数：停止指定名称的容器
-func stopContainer(containerName string) {
-	// 根据容器名称获取pid
-	pid, err := GetContainerPidByName(containerName)
+const (
+	defaultStopTimeout = 10 * time.Second       // stop 默认等待容器退出的时间，超时后发送 SIGKILL
+	stopKillTimeout    = 5 * time.Second        // 发送 SIGKILL 之后等待容器退出的时间
+	stopRecordTimeout  = 2 * time.Second        // 容器退出后等待 shim 或前台的 run 进程记录退出状态的时间
+	stopPollInterval   = 100 * time.Millisecond // 轮询的间隔
+)
+
+// stopContainer 函数：停止指定的容器，containerRef 可以是容器名、容器 ID 或唯一的 ID 前缀
+// 先发送 SIGTERM，timeout 内没有退出再发送 SIGKILL。容器的 init 进程由 shim 或前台的 run 进程等待，
+// 它们会记录退出码、OOM 信息和退出时间并清理 cgroup 和工作空间，这里只负责让进程退出。
+// shim 已经不在了（被杀死、宿主机重启过）时没有人记录退出状态，由 stop 记录并清理，之后就可以 rm
+func stopContainer(containerRef string, timeout time.Duration) {
+	info, err := resolveContainer(containerRef)
 	if err != nil {
-		logrus.Errorf("获取容器 %s 的 PID 失败: %v", containerName, err)
+		logrus.Errorf("获取容器信息失败: %v", err)
+		return
+	}
+	containerName := info.Name
+	if info.Status != container.RUNNING {
+		logrus.Infof("容器 %s 没有在运行", containerName)
 		return
 	}
 	// 将 pid 转换为整数
-	pidInt, err := strconv.Atoi(pid)
+	pidInt, err := strconv.Atoi(info.Pid)
 	if err != nil {
 		logrus.Errorf("PID 转换失败: %v", err)
 		return
 	}
 
-	// 检查 PID 是否存在
-	_, err = os.FindProcess(pidInt)
-	if err != nil {
-		logrus.Errorf("无法找到容器 %s 的进程: %v", containerName, err)
-		return
+	// 宿主机重启过时进程号可能已经被其他进程复用，只向仍在容器 cgroup 中的进程发送信号
+	if containerProcessAlive(info, pidInt) {
+		logrus.Infof("向容器 %s 的进程 %d 发送 SIGTERM", containerName, pidInt)
+		// 发送 SIGTERM 信号给容器进程，优雅停止
+		if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			logrus.Errorf("停止容器 %s 失败: %v", containerName, err)
+			return
+		}
+		if !waitProcessExit(pidInt, timeout) {
+			logrus.Warnf("容器 %s 在 %v 内没有退出，发送 SIGKILL", containerName, timeout)
+			if err := syscall.Kill(pidInt, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				logrus.Errorf("停止容器 %s 失败: %v", containerName, err)
+				return
+			}
+			if !waitProcessExit(pidInt, stopKillTimeout) {
+				logrus.Errorf("容器 %s 的进程 %d 在 SIGKILL 之后仍然没有退出", containerName, pidInt)
+				return
+			}
+		}
+	} else {
+		logrus.Infof("容器 %s 的进程 %d 已经不存在", containerName, pidInt)
 	}
 
-	logrus.Infof("容器 %s 进程存在，准备发送信号", containerName)
+	// 等 shim 或前台的 run 进程记录退出状态，这样 stop 返回后就可以直接 rm
+	// 后台容器的 shim 已经不在时不用再等；前台容器没有 shim，等满 stopRecordTimeout 还没有记录说明 run 进程也不在了
+	deadline := time.Now().Add(stopRecordTimeout)
+	for time.Now().Before(deadline) {
+		if info, err = getContainerInfoByName(containerName); err != nil {
+			logrus.Errorf("获取容器 %s 信息失败: %v", containerName, err)
+			return
+		}
+		if info.Status != container.RUNNING || (info.ShimPid > 0 && !shimAlive(info.ShimPid)) {
+			break
+		}
+		time.Sleep(stopPollInterval)
+	}
+	if info.Status == container.RUNNING && !shimAlive(info.ShimPid) {
+		cleanupExitedContainer(info)
+	}
+	logrus.Infof("容器 %s 停止成功", containerName)
+}
 
-	// 发送 SIGTERM 信号给容器进程，优雅停止
-	if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
-		logrus.Errorf("停止容器 %s 失败: %v", containerName, err)
-		return
+// cleanupExitedContainer 代替已经不在的 shim 记录容器的退出状态，并清理 cgroup、网络和工作空间
+// 容器的 init 进程不是当前进程的子进程，拿不到它的退出状态，退出码记录为 -1
+func cleanupExitedContainer(info *container.Info) {
+	logrus.Warnf("没有进程记录容器 %s 的退出状态，由 stop 记录并清理", info.Name)
+	var cgroupManager *cgroup.CgroupManager
+	if info.CgroupPath != "" {
+		cgroupManager = cgroup.NewCgroupManager(info.CgroupPath)
 	}
+	recordContainerExit(info.Name, nil, cgroupManager)
+	if cgroupManager != nil {
+		cgroupManager.Destroy()
+	}
+	container.DeleteWorkSpace(info.Volume, info.Name)
+}
 
-	// 跟据容器名称获取容器信息
-	info, err := getContainerInfoByName(containerName)
+// containerProcessAlive 判断进程是否还在运行并且仍然是容器的进程
+// 进程的 /proc/<pid>/cgroup 中有一项是容器的 cgroup 时才认为是容器的进程；rootless 模式下容器不使用 cgroup，无法判断
+func containerProcessAlive(info *container.Info, pid int) bool {
+	if processExited(pid) {
+		return false
+	}
+	if container.Rootless() || info.CgroupPath == "" {
+		return true
+	}
+	content, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
 	if err != nil {
-		logrus.Errorf("获取容器信息失败: %v", err)
-		return
+		return false
 	}
-	// 容器进程已经停止，修改容器状态和PID
-	info.Status = container.STOPPED
-	info.Pid = ""
-	// 更新容器信息
-	newContentBytes, err := json.Marshal(info)
+	// 每行的格式为 "hierarchy-ID:子系统列表:cgroup 路径"
+	for _, line := range strings.Split(string(content), "\n") {
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 && parts[2] == "/"+info.CgroupPath {
+			return true
+		}
+	}
+	return false
+}
+
+// shimAlive 判断看护容器的 shim 进程是否还在运行，前台运行的容器没有 shim（shimPid 为 0），返回 false
+// 先确认进程的命令行还是 shim，避免进程号被复用后误判
+func shimAlive(shimPid int) bool {
+	if shimPid <= 0 || processExited(shimPid) {
+		return false
+	}
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", shimPid))
 	if err != nil {
-		logrus.Errorf("容器信息序列化失败: %v", err)
-		return
+		return false
 	}
-	// 获取容器信息的目录路径
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
-	// 写入新的容器信息
-	if err := ioutil.WriteFile(configFilePath, newContentBytes, 0622); err != nil {
-		logrus.Errorf("写入容器信息失败: %v", err)
-		return
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) > 1 && args[1] == "shim"
+}
+
+// waitProcessExit 轮询等待进程退出，timeout 内退出时返回 true
+func waitProcessExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if processExited(pid) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
 	}
-	logrus.Infof("容器 %s 停止成功", containerName)
+}
+
+// processExited 判断进程是否已经退出
+// 退出后还没有被父进程（shim 或前台的 run 进程）回收的僵尸进程也算已经退出
+func processExited(pid int) bool {
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return true
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	return processState(stat) == "Z"
+}
+
+// processState 从 /proc/<pid>/stat 的内容中解析进程状态
+// 格式为 "pid (comm) state ..."，进程名中可能包含空格和括号，从最后一个右括号之后开始解析
+func processState(stat []byte) string {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
 }
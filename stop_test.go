@@ -0,0 +1,44 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"os"
+	"testing"
+)
+
+func TestProcessState(t *testing.T) {
+	cases := map[string]string{
+		"1234 (sh) R 1 1234 1234 0 -1":           "R",
+		"1234 (my (weird) proc) Z 1 1234 1234 0": "Z",
+		"1234 (sleep) S":                         "S",
+		"garbage":                                "",
+	}
+	for stat, want := range cases {
+		if got := processState([]byte(stat)); got != want {
+			t.Errorf("processState(%q) = %q，期望 %q", stat, got, want)
+		}
+	}
+	if processExited(os.Getpid()) {
+		t.Error("当前进程不应该被判断为已经退出")
+	}
+}
+
+func TestContainerProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+	if container.Rootless() {
+		t.Skip("rootless 模式下不检查进程的 cgroup")
+	}
+	// 进程号被复用时，新进程不在容器的 cgroup 中
+	if containerProcessAlive(&container.Info{CgroupPath: "MiniDocker/test-not-in-cgroup"}, pid) {
+		t.Error("不在容器 cgroup 中的进程不应该被当作容器的进程")
+	}
+	if !containerProcessAlive(&container.Info{}, pid) {
+		t.Error("没有记录 cgroup 路径时只要进程还在运行就是容器的进程")
+	}
+	// 当前进程不是 shim，前台运行的容器没有 shim
+	for _, shimPid := range []int{0, pid} {
+		if shimAlive(shimPid) {
+			t.Errorf("shimAlive(%d) 期望为 false", shimPid)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"MiniDocker/cgroup"
+	"MiniDocker/cgroup/subsystems"
+	"MiniDocker/container"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// updateContainer 修改运行中容器的资源限制
+// 在容器当前的资源限制基础上覆盖命令行中指定的参数，重新写入容器的 cgroup，并保存到 config.json
+func updateContainer(ctx *cli.Context, containerRef string) error {
+	info, err := resolveContainer(containerRef)
+	if err != nil {
+		return err
+	}
+	containerName := info.Name
+	if info.Status != container.RUNNING {
+		return fmt.Errorf("容器 %s 没有在运行，无法修改资源限制", containerName)
+	}
+	if info.CgroupPath == "" {
+		return fmt.Errorf("容器 %s 没有记录 cgroup 路径", containerName)
+	}
+
+	// 复制一份当前的资源限制，避免修改失败时污染原有配置
+	res := &subsystems.ResourceConfig{}
+	if info.Resource != nil {
+		*res = *info.Resource
+	}
+	if err := parseResourceConfig(ctx, res); err != nil {
+		return fmt.Errorf("资源限制参数错误: %v", err)
+	}
+
+	if err := cgroup.NewCgroupManager(info.CgroupPath).Set(res); err != nil {
+		return fmt.Errorf("更新容器 %s 的资源限制失败: %v", containerName, err)
+	}
+
+	info.Resource = res
+	if err := updateContainerInfo(info); err != nil {
+		return err
+	}
+	logrus.Infof("容器 %s 的资源限制已更新", containerName)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"MiniDocker/cgroup"
+	"MiniDocker/cgroup/subsystems"
+	"MiniDocker/container"
+	"flag"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resourceContext 用 update 命令的参数定义解析 args，生成 cli.Context
+func resourceContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("update", flag.ContinueOnError)
+	for _, f := range resourceFlags {
+		if err := f.Apply(set); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := set.Parse(args); err != nil {
+		t.Fatalf("解析参数 %q 失败: %v", args, err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func TestParseResourceConfigMerge(t *testing.T) {
+	current := subsystems.ResourceConfig{
+		MemoryLimit: 100 << 20,
+		CpuShare:    512,
+		CpuPeriod:   100000,
+		CpuQuota:    50000,
+		PidsLimit:   64,
+	}
+	cases := []struct {
+		args []string
+		want func(res *subsystems.ResourceConfig)
+	}{
+		// 没有指定的参数保持容器当前的限制
+		{args: []string{"-m", "256m"}, want: func(res *subsystems.ResourceConfig) { res.MemoryLimit = 256 << 20 }},
+		{args: []string{"--cpus", "0.25"}, want: func(res *subsystems.ResourceConfig) { res.CpuQuota = 25000 }},
+		{args: []string{"--cpushare", "1024", "--pids-limit", "-1"}, want: func(res *subsystems.ResourceConfig) {
+			res.CpuShare = 1024
+			res.PidsLimit = -1
+		}},
+		{args: []string{"--cpuset", "0"}, want: func(res *subsystems.ResourceConfig) { res.CpuSet = "0" }},
+	}
+	for _, c := range cases {
+		res := current
+		if err := parseResourceConfig(resourceContext(t, c.args...), &res); err != nil {
+			t.Errorf("parseResourceConfig(%q) 失败: %v", c.args, err)
+			continue
+		}
+		want := current
+		c.want(&want)
+		if !reflect.DeepEqual(res, want) {
+			t.Errorf("parseResourceConfig(%q) = %+v, 期望 %+v", c.args, res, want)
+		}
+	}
+
+	for _, args := range [][]string{{"-m", "1k"}, {"--cpushare", "abc"}, {"--cpus", "-1"}} {
+		res := current
+		if err := parseResourceConfig(resourceContext(t, args...), &res); err == nil {
+			t.Errorf("parseResourceConfig(%q) 期望报错", args)
+		}
+	}
+}
+
+func TestUpdateResetsLimits(t *testing.T) {
+	if container.Rootless() {
+		t.Skip("rootless 模式下容器不使用 cgroup")
+	}
+	setInfoLocation(t)
+	cgroupPath := fmt.Sprintf(container.CgroupPathFormat, "test-update-"+strconv.Itoa(os.Getpid()))
+	cgroupManager := cgroup.NewCgroupManager(cgroupPath)
+	t.Cleanup(func() { cgroupManager.Destroy() })
+	res := &subsystems.ResourceConfig{MemoryLimit: 100 << 20, CpuPeriod: subsystems.DefaultCpuPeriod, CpuQuota: 50000}
+	if err := cgroupManager.Set(res); err != nil {
+		t.Skipf("无法创建 cgroup: %v", err)
+	}
+	saveContainerInfo(t, &container.Info{Name: "web", Status: container.RUNNING, CgroupPath: cgroupPath, Resource: res})
+
+	// -m 0 和 --cpus 0 取消之前的限制，内核中的限制也要随之取消
+	if err := updateContainer(resourceContext(t, "-m", "0", "--cpus", "0"), "web"); err != nil {
+		t.Fatalf("update 失败: %v", err)
+	}
+	memoryFile, quotaFile := "memory.limit_in_bytes", "cpu.cfs_quota_us"
+	if subsystems.IsCgroup2UnifiedMode() {
+		memoryFile, quotaFile = "memory.max", "cpu.max"
+	}
+	for subsystem, file := range map[string]string{"memory": memoryFile, "cpu": quotaFile} {
+		dir, err := subsystems.GetCgroupPath(subsystem, cgroupPath, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// v1 的内存限制取消后读出的是按页对齐的最大值
+		unlimited := map[string]bool{"max": true, "-1": true, "9223372036854771712": true}
+		if got := strings.Fields(string(content))[0]; !unlimited[got] {
+			t.Errorf("update 取消限制后 %s = %q，期望不限制", file, got)
+		}
+	}
+	info, err := getContainerInfoByName("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Resource.MemoryLimit != 0 || info.Resource.CpuQuota != 0 {
+		t.Errorf("config.json 中的资源限制为 %+v，期望已经取消", info.Resource)
+	}
+}
@@ -1,35 +1,87 @@
 package main
 
 import (
+	"MiniDocker/cgroup/subsystems"
 	"MiniDocker/container"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-// GetContainerPidByName 根据容器名字获取其 PID
-func GetContainerPidByName(containerName string) (string, error) {
-	// 拼接出容器对应的配置文件路径
-	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
-	configFilePath := dirURL + container.ConfigName
+// containerNamePattern 合法的容器名，与 docker 一致，容器名会作为目录名使用
+var containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
 
-	// 读取容器的配置信息
-	contentBytes, err := ioutil.ReadFile(configFilePath)
+// resolveContainer 根据完整 ID、唯一的 ID 前缀或容器名查找容器
+// 所有需要指定容器的命令都通过它查找容器
+func resolveContainer(ref string) (*container.Info, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("容器名称或 ID 不能为空")
+	}
+	infos, err := getAllContainerInfos()
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("读取容器信息失败: %v", err)
 	}
+	return matchContainer(infos, ref)
+}
 
-	var containerInfo container.Info
-	// 反序列化 JSON 数据到 containerInfo 结构体
-	if err := json.Unmarshal(contentBytes, &containerInfo); err != nil {
-		return "", err
+// matchContainer 在 infos 中查找 ref 对应的容器
+// 依次按完整 ID、容器名、ID 前缀匹配，前缀匹配到多个容器时报错
+func matchContainer(infos []*container.Info, ref string) (*container.Info, error) {
+	for _, info := range infos {
+		if info.Id == ref {
+			return info, nil
+		}
 	}
+	for _, info := range infos {
+		if info.Name == ref {
+			return info, nil
+		}
+	}
+	var matches []*container.Info
+	for _, info := range infos {
+		if strings.HasPrefix(info.Id, ref) {
+			matches = append(matches, info)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("容器 %s 不存在", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		var ids []string
+		for _, info := range matches {
+			ids = append(ids, info.Id)
+		}
+		return nil, fmt.Errorf("ID 前缀 %s 匹配到多个容器: %s，请指定更长的前缀", ref, strings.Join(ids, ", "))
+	}
+}
 
-	// 返回容器的 PID
-	return containerInfo.Pid, nil
+// checkContainerName 检查新容器的名字是否合法并且没有被其他容器使用
+func checkContainerName(containerName string) error {
+	if !containerNamePattern.MatchString(containerName) {
+		return fmt.Errorf("容器名 %q 不合法，只能包含字母、数字、_、. 和 -，并以字母或数字开头", containerName)
+	}
+	infos, err := getAllContainerInfos()
+	if err != nil {
+		return fmt.Errorf("读取容器信息失败: %v", err)
+	}
+	for _, info := range infos {
+		if info.Name == containerName {
+			return fmt.Errorf("容器名 %s 已被容器 %s 使用，请先删除该容器或换一个名字", containerName, info.Id)
+		}
+	}
+	// 信息目录以容器名命名，残留的目录同样会造成冲突
+	if _, err := os.Stat(fmt.Sprintf(container.DefaultInfoLocation, containerName)); err == nil {
+		return fmt.Errorf("容器名 %s 已被使用", containerName)
+	}
+	return nil
 }
 
 // getContainerInfoByName 函数：根据容器名称获取容器信息
@@ -53,6 +105,20 @@ func getContainerInfoByName(containerName string) (*container.Info, error) {
 	return &info, nil
 }
 
+// updateContainerInfo 将容器信息重新写回该容器的配置文件
+func updateContainerInfo(info *container.Info) error {
+	contentBytes, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("容器信息序列化失败: %v", err)
+	}
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, info.Name)
+	configFilePath := dirURL + container.ConfigName
+	if err := ioutil.WriteFile(configFilePath, contentBytes, 0622); err != nil {
+		return fmt.Errorf("写入容器信息失败: %v", err)
+	}
+	return nil
+}
+
 // getContainerInfo 读取指定容器的配置文件，解析并返回容器信息
 func getContainerInfo(file os.FileInfo) (*container.Info, error) {
 	// 获取文件名
@@ -76,6 +142,43 @@ func getContainerInfo(file os.FileInfo) (*container.Info, error) {
 	return &containerInfo, nil
 }
 
+// getAllContainerInfos 读取所有容器的信息
+// 容器信息根目录下每个容器一个子目录，没有配置文件的目录（如 network）会被跳过
+func getAllContainerInfos() ([]*container.Info, error) {
+	// 容器信息根目录
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
+	dirURL = dirURL[:len(dirURL)-1]
+
+	// 读取该目录下的所有子目录（每个容器一个目录）
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var containers []*container.Info
+	// 遍历每个子目录，解析容器信息
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		configFilePath := fmt.Sprintf(container.DefaultInfoLocation, file.Name()) + container.ConfigName
+		if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
+			continue
+		}
+		// 根据配置文件名获取容器信息
+		tmpContainer, err := getContainerInfo(file)
+		if err != nil {
+			logrus.Errorf("获取容器信息失败: %v", err)
+			continue
+		}
+		containers = append(containers, tmpContainer)
+	}
+	return containers, nil
+}
+
 // getEnvsByPid 读取指定 PID 的环境变量
 func getEnvsByPid(pid string) ([]string, error) {
 	// 进程环境变量的路径
@@ -91,3 +194,54 @@ func getEnvsByPid(pid string) ([]string, error) {
 	// 返回环境变量列表
 	return envs, nil
 }
+
+// parseResourceConfig 根据命令行中的资源限制参数填充 res
+// 只覆盖用户显式指定的参数，最后交给各个子系统检查取值范围
+func parseResourceConfig(ctx *cli.Context, res *subsystems.ResourceConfig) error {
+	var err error
+	if ctx.IsSet("m") {
+		if res.MemoryLimit, err = subsystems.ParseMemory(ctx.String("m")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("cpushare") {
+		if res.CpuShare, err = strconv.ParseUint(strings.TrimSpace(ctx.String("cpushare")), 10, 64); err != nil {
+			return fmt.Errorf("CPU 权重 %q 不是合法的整数", ctx.String("cpushare"))
+		}
+	}
+	if ctx.IsSet("cpuset") {
+		res.CpuSet = strings.TrimSpace(ctx.String("cpuset"))
+	}
+	if ctx.IsSet("cpus") {
+		if res.CpuPeriod, res.CpuQuota, err = subsystems.ParseCpus(ctx.String("cpus")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("pids-limit") {
+		res.PidsLimit = ctx.Int64("pids-limit")
+	}
+	if ctx.IsSet("device-read-bps") {
+		if res.BlkioDeviceReadBps, err = parseThrottleDevices(ctx.StringSlice("device-read-bps")); err != nil {
+			return err
+		}
+	}
+	if ctx.IsSet("device-write-bps") {
+		if res.BlkioDeviceWriteBps, err = parseThrottleDevices(ctx.StringSlice("device-write-bps")); err != nil {
+			return err
+		}
+	}
+	return subsystems.ValidateResourceConfig(res)
+}
+
+// parseThrottleDevices 解析多个 "设备路径:速率" 格式的块设备限速配置
+func parseThrottleDevices(specs []string) ([]*subsystems.ThrottleDevice, error) {
+	var devices []*subsystems.ThrottleDevice
+	for _, spec := range specs {
+		device, err := subsystems.ParseThrottleDevice(spec)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
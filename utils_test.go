@@ -0,0 +1,74 @@
+package main
+
+import (
+	"MiniDocker/container"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMatchContainer(t *testing.T) {
+	infos := []*container.Info{
+		{Id: "1234567890", Name: "web"},
+		{Id: "1239999999", Name: "db"},
+		{Id: "5555555555", Name: "1234567890a"},
+	}
+	cases := []struct {
+		ref     string
+		want    string
+		wantErr bool
+	}{
+		{ref: "1234567890", want: "web"},          // 完整 ID
+		{ref: "db", want: "db"},                   // 容器名
+		{ref: "1234567890a", want: "1234567890a"}, // 容器名优先于 ID 前缀
+		{ref: "555", want: "1234567890a"},         // 唯一的 ID 前缀
+		{ref: "123", wantErr: true},               // 前缀匹配到多个容器
+		{ref: "999", wantErr: true},               // 不存在
+	}
+	for _, c := range cases {
+		info, err := matchContainer(infos, c.ref)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("matchContainer(%q) 期望报错，实际匹配到 %s", c.ref, info.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("matchContainer(%q) 失败: %v", c.ref, err)
+			continue
+		}
+		if info.Name != c.want {
+			t.Errorf("matchContainer(%q) = %s, 期望 %s", c.ref, info.Name, c.want)
+		}
+	}
+}
+
+func TestContainerNamePattern(t *testing.T) {
+	for _, name := range []string{"web", "my_container", "app-1.0", "1234567890"} {
+		if !containerNamePattern.MatchString(name) {
+			t.Errorf("容器名 %q 应当合法", name)
+		}
+	}
+	for _, name := range []string{"", "-web", "a/b", "../etc", "a b"} {
+		if containerNamePattern.MatchString(name) {
+			t.Errorf("容器名 %q 应当不合法", name)
+		}
+	}
+}
+
+// setInfoLocation 把容器信息的存储目录指向临时目录，并在测试结束后恢复
+func setInfoLocation(t *testing.T) {
+	old := container.DefaultInfoLocation
+	container.DefaultInfoLocation = t.TempDir() + "/%s/"
+	t.Cleanup(func() { container.DefaultInfoLocation = old })
+}
+
+// saveContainerInfo 在临时的存储目录中写入容器信息
+func saveContainerInfo(t *testing.T, info *container.Info) {
+	if err := os.MkdirAll(fmt.Sprintf(container.DefaultInfoLocation, info.Name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateContainerInfo(info); err != nil {
+		t.Fatal(err)
+	}
+}